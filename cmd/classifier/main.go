@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/slav123/email-catch/internal/classifier"
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/pkg/email"
+)
+
+func main() {
+	var (
+		configFile = flag.String("config", "config/config.yaml", "Path to configuration file")
+		modelFile  = flag.String("model", "", "Path to the model file; defaults to classifier.model_file from the configuration")
+		action     = flag.String("action", "info", "Action to perform: info, train, classify, remove")
+		category   = flag.String("category", "", "Category to train or remove")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [EML files or directories]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *modelFile == "" {
+		cfg, err := config.LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to load configuration: %v", err)
+		}
+		if cfg.Classifier.ModelFile == "" {
+			log.Fatal("No model file: set classifier.model_file in the configuration or use -model")
+		}
+		*modelFile = cfg.Classifier.ModelFile
+	}
+
+	switch *action {
+	case "info":
+		showInfo(loadModel(*modelFile, false))
+	case "train":
+		train(*modelFile, *category, flag.Args())
+	case "classify":
+		classify(loadModel(*modelFile, false), flag.Args())
+	case "remove":
+		remove(*modelFile, *category)
+	default:
+		fmt.Printf("Unknown action: %s\n", *action)
+		fmt.Println("Available actions: info, train, classify, remove")
+		os.Exit(1)
+	}
+}
+
+// loadModel reads the model, or starts an empty one when it does not exist
+// yet and create is set
+func loadModel(path string, create bool) *classifier.Model {
+	model, err := classifier.Load(path)
+	if errors.Is(err, fs.ErrNotExist) && create {
+		return classifier.NewModel()
+	}
+	if err != nil {
+		log.Fatalf("Failed to load model: %v", err)
+	}
+	return model
+}
+
+func showInfo(model *classifier.Model) {
+	names := model.Names()
+	if len(names) == 0 {
+		fmt.Println("The model has no categories yet")
+		return
+	}
+
+	fmt.Println("=== Classifier Categories ===")
+	for _, name := range names {
+		stats := model.Categories[name]
+		fmt.Printf("%-20s %6d messages %8d words\n", name, stats.Documents, stats.Words)
+	}
+}
+
+func train(path, category string, args []string) {
+	if category == "" || strings.TrimSpace(category) != category {
+		log.Fatal("A category without surrounding spaces must be specified with -category")
+	}
+	files := emlFiles(args)
+	if len(files) == 0 {
+		log.Fatal("No EML files to train with")
+	}
+
+	model := loadModel(path, true)
+	trained := 0
+	for _, file := range files {
+		msg, err := readEmail(file)
+		if err != nil {
+			log.Printf("Skipping %s: %v", file, err)
+			continue
+		}
+		model.Train(category, msg.ClassificationTokens())
+		trained++
+	}
+
+	if err := model.Save(path); err != nil {
+		log.Fatalf("Failed to save model: %v", err)
+	}
+	fmt.Printf("Trained %s with %d messages; it now has %d\n", category, trained, model.Categories[category].Documents)
+}
+
+func classify(model *classifier.Model, args []string) {
+	for _, file := range emlFiles(args) {
+		msg, err := readEmail(file)
+		if err != nil {
+			log.Printf("Skipping %s: %v", file, err)
+			continue
+		}
+		category, confidence, ok := model.Classify(msg.ClassificationTokens())
+		if !ok {
+			log.Fatal("The model has no categories yet")
+		}
+		fmt.Printf("%s\t%s\t%.3f\n", file, category, confidence)
+	}
+}
+
+func remove(path, category string) {
+	model := loadModel(path, false)
+	if !model.Remove(category) {
+		log.Fatalf("Unknown category %q", category)
+	}
+	if err := model.Save(path); err != nil {
+		log.Fatalf("Failed to save model: %v", err)
+	}
+	fmt.Printf("Removed %s\n", category)
+}
+
+// emlFiles expands directories to the EML files below them. The originals
+// kept next to modified messages (.orig.eml) are skipped, so a message is
+// not counted twice.
+func emlFiles(args []string) []string {
+	var files []string
+	for _, arg := range args {
+		err := filepath.WalkDir(arg, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == arg && !entry.IsDir() {
+				files = append(files, path)
+				return nil
+			}
+			if !entry.IsDir() && strings.HasSuffix(path, ".eml") && !strings.HasSuffix(path, ".orig.eml") {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", arg, err)
+		}
+	}
+	return files
+}
+
+func readEmail(path string) (*email.Email, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return email.ParseEmail(data, "", nil)
+}
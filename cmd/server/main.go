@@ -8,6 +8,7 @@ import (
 	"syscall"
 
 	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/privileges"
 	"github.com/slav123/email-catch/internal/smtp"
 	"github.com/slav123/email-catch/internal/storage"
 	"github.com/slav123/email-catch/internal/webhook"
@@ -23,6 +24,20 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	server := smtp.NewServer(cfg, nil)
+
+	// Bind ports while still privileged, then drop to the configured user
+	// before touching storage or accepting connections
+	if err := server.Listen(); err != nil {
+		log.Fatalf("Failed to start SMTP server: %v", err)
+	}
+
+	if cfg.Server.User != "" {
+		if err := privileges.Drop(cfg.Server.User, cfg.Server.Group, cfg.Server.UnixSockets...); err != nil {
+			log.Fatalf("Failed to drop privileges: %v", err)
+		}
+	}
+
 	storageBackend, err := storage.NewStorageBackend(cfg)
 	if err != nil {
 		log.Fatalf("Failed to initialize storage backend: %v", err)
@@ -32,14 +47,14 @@ func main() {
 
 	processor := email.NewProcessor(cfg, storageBackend, webhookClient)
 
-	server := smtp.NewServer(cfg, processor)
+	server.SetProcessor(processor)
 
-	if err := server.Start(); err != nil {
+	if err := server.Serve(); err != nil {
 		log.Fatalf("Failed to start SMTP server: %v", err)
 	}
 
 	log.Println("Email catch server started successfully")
-	log.Printf("Listening on ports: %v", cfg.Server.Ports)
+	log.Printf("Listening on: %v", server.Listeners())
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -48,5 +63,8 @@ func main() {
 	log.Println("Shutting down server...")
 
 	server.Stop()
+	if err := processor.Close(); err != nil {
+		log.Printf("Failed to close processor: %v", err)
+	}
 	log.Println("Server stopped")
 }
\ No newline at end of file
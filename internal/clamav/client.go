@@ -0,0 +1,239 @@
+// Package clamav scans data with a clamd daemon over its INSTREAM command.
+package clamav
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chunkSize is the largest chunk sent to clamd in one INSTREAM frame
+const chunkSize = 64 * 1024
+
+// Config describes a clamd daemon
+type Config struct {
+	// Address is "host:port", "tcp://host:port", a socket path or
+	// "unix:///path/to/clamd.sock"
+	Address string
+	// Timeout bounds one scan when the context has no deadline
+	Timeout time.Duration
+	// MaxIdle is the number of idle connections kept for reuse
+	MaxIdle int
+}
+
+// Result is the verdict of clamd on one stream
+type Result struct {
+	Infected bool
+	// Signature names the virus found, e.g. "Eicar-Test-Signature"
+	Signature string
+}
+
+// Client scans data with one clamd daemon. Connections are clamd sessions
+// (IDSESSION) kept in a pool, so consecutive scans do not reconnect.
+type Client struct {
+	network string
+	address string
+	timeout time.Duration
+	maxIdle int
+
+	mu     sync.Mutex
+	idle   []*session
+	closed bool
+}
+
+type session struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewClient(cfg Config) (*Client, error) {
+	network, address, err := parseAddress(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+	if cfg.MaxIdle == 0 {
+		cfg.MaxIdle = 4
+	}
+	if cfg.MaxIdle < 0 {
+		return nil, fmt.Errorf("invalid pool size: %d", cfg.MaxIdle)
+	}
+
+	return &Client{network: network, address: address, timeout: cfg.Timeout, maxIdle: cfg.MaxIdle}, nil
+}
+
+func parseAddress(address string) (string, string, error) {
+	switch {
+	case address == "":
+		return "", "", fmt.Errorf("clamd address must be specified")
+	case strings.HasPrefix(address, "unix://"):
+		return "unix", strings.TrimPrefix(address, "unix://"), nil
+	case strings.HasPrefix(address, "tcp://"):
+		address = strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "/"):
+		return "unix", address, nil
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("invalid clamd address %q: %w", address, err)
+	}
+	return "tcp", address, nil
+}
+
+// Scan streams data to clamd and returns its verdict. A pooled connection
+// that turns out to be closed by clamd is replaced once.
+func (c *Client) Scan(ctx context.Context, data []byte) (Result, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	s, pooled, err := c.get(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+
+	result, err := c.scan(ctx, s, data)
+	if err != nil && pooled && ctx.Err() == nil {
+		s.conn.Close()
+		if s, err = c.dial(ctx); err != nil {
+			return Result{}, err
+		}
+		result, err = c.scan(ctx, s, data)
+	}
+	if err != nil {
+		s.conn.Close()
+		return Result{}, err
+	}
+
+	c.put(s)
+	return result, nil
+}
+
+func (c *Client) scan(ctx context.Context, s *session, data []byte) (Result, error) {
+	deadline, _ := ctx.Deadline()
+	s.conn.SetDeadline(deadline)
+
+	// Expiring the deadline unblocks the I/O when the context is cancelled
+	stop := context.AfterFunc(ctx, func() { s.conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	w := bufio.NewWriter(s.conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(data) > 0 {
+		n := min(len(data), chunkSize)
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		w.Write(size[:])
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return Result{}, fmt.Errorf("failed to send to clamd: %w", err)
+	}
+
+	reply, err := s.reader.ReadString(0)
+	if err != nil {
+		if ctx.Err() != nil {
+			return Result{}, fmt.Errorf("clamd scan timed out: %w", ctx.Err())
+		}
+		return Result{}, fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	return parseReply(strings.TrimSuffix(reply, "\x00"))
+}
+
+// parseReply reads a session reply such as "1: stream: OK",
+// "2: stream: Eicar-Test-Signature FOUND" or
+// "3: INSTREAM size limit exceeded. ERROR"
+func parseReply(reply string) (Result, error) {
+	if id, rest, ok := strings.Cut(reply, ": "); ok && strings.Trim(id, "0123456789") == "" {
+		reply = rest
+	}
+
+	if message, ok := strings.CutSuffix(reply, " ERROR"); ok {
+		return Result{}, errors.New("clamd error: " + strings.TrimPrefix(message, "stream: "))
+	}
+	switch status, _ := strings.CutPrefix(reply, "stream: "); {
+	case status == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	}
+	return Result{}, fmt.Errorf("unexpected clamd reply %q", reply)
+}
+
+// get returns an idle session, or a new one. pooled reports whether the
+// session was reused.
+func (c *Client) get(ctx context.Context) (*session, bool, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		s := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return s, true, nil
+	}
+	c.mu.Unlock()
+
+	s, err := c.dial(ctx)
+	return s, false, err
+}
+
+func (c *Client) dial(ctx context.Context) (*session, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	if _, err := conn.Write([]byte("zIDSESSION\x00")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start clamd session: %w", err)
+	}
+	return &session{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (c *Client) put(s *session) {
+	s.conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	if !c.closed && len(c.idle) < c.maxIdle {
+		c.idle = append(c.idle, s)
+		s = nil
+	}
+	c.mu.Unlock()
+
+	if s != nil {
+		end(s)
+	}
+}
+
+// Close ends the idle sessions. Sessions of scans still running are ended
+// when they finish.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.closed = true
+	c.mu.Unlock()
+
+	for _, s := range idle {
+		end(s)
+	}
+	return nil
+}
+
+func end(s *session) {
+	s.conn.SetDeadline(time.Now().Add(time.Second))
+	s.conn.Write([]byte("zEND\x00"))
+	s.conn.Close()
+}
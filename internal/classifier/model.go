@@ -0,0 +1,217 @@
+// Package classifier sorts messages into categories with a multinomial
+// naive Bayes model over the words of their subject and body.
+package classifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// maxTokens bounds the words taken from one message, so long bodies do
+	// not outweigh everything else
+	maxTokens = 2000
+	// Words shorter or longer than this are ignored
+	minTokenLength = 2
+	maxTokenLength = 30
+)
+
+// Model holds the word counts of every trained category
+type Model struct {
+	Categories map[string]*Category `json:"categories"`
+
+	// vocabulary is the number of distinct words over all categories
+	vocabulary int
+}
+
+// Category is the training data of one category
+type Category struct {
+	Documents int            `json:"documents"`
+	Words     int            `json:"words"`
+	Counts    map[string]int `json:"counts"`
+}
+
+func NewModel() *Model {
+	return &Model{Categories: make(map[string]*Category)}
+}
+
+// Load reads a model saved with Save
+func Load(path string) (*Model, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read model: %w", err)
+	}
+
+	model := NewModel()
+	if err := json.Unmarshal(data, model); err != nil {
+		return nil, fmt.Errorf("failed to parse model %s: %w", path, err)
+	}
+	for name, category := range model.Categories {
+		if category == nil || category.Counts == nil {
+			return nil, fmt.Errorf("model %s: category %q has no word counts", path, name)
+		}
+	}
+	model.index()
+	return model, nil
+}
+
+// Save writes the model to path, replacing it atomically
+func (m *Model) Save(path string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode model: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".model-*")
+	if err != nil {
+		return fmt.Errorf("failed to save model: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save model: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save model: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save model: %w", err)
+	}
+	return nil
+}
+
+// Train adds one message, given by its tokens, to a category
+func (m *Model) Train(category string, tokens []string) {
+	stats := m.Categories[category]
+	if stats == nil {
+		stats = &Category{Counts: make(map[string]int)}
+		m.Categories[category] = stats
+	}
+
+	stats.Documents++
+	for _, token := range tokens {
+		if stats.Counts[token] == 0 && !m.known(token) {
+			m.vocabulary++
+		}
+		stats.Counts[token]++
+		stats.Words++
+	}
+}
+
+// known reports whether any category has seen the word
+func (m *Model) known(word string) bool {
+	for _, category := range m.Categories {
+		if category.Counts[word] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove forgets a category and everything trained for it
+func (m *Model) Remove(category string) bool {
+	if _, ok := m.Categories[category]; !ok {
+		return false
+	}
+	delete(m.Categories, category)
+	m.index()
+	return true
+}
+
+func (m *Model) index() {
+	words := make(map[string]bool)
+	for _, category := range m.Categories {
+		for word := range category.Counts {
+			words[word] = true
+		}
+	}
+	m.vocabulary = len(words)
+}
+
+// Names returns the trained categories in alphabetical order
+func (m *Model) Names() []string {
+	names := make([]string, 0, len(m.Categories))
+	for name := range m.Categories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Classify returns the most likely category for a message and its posterior
+// probability. ok is false when the model has no categories.
+func (m *Model) Classify(tokens []string) (category string, confidence float64, ok bool) {
+	documents := 0
+	for _, stats := range m.Categories {
+		documents += stats.Documents
+	}
+	if documents == 0 {
+		return "", 0, false
+	}
+
+	// Log-probabilities with Laplace smoothing, in a stable order so ties
+	// are decided the same way every time
+	names := m.Names()
+	scores := make([]float64, len(names))
+	for i, name := range names {
+		stats := m.Categories[name]
+		score := math.Log(float64(stats.Documents) / float64(documents))
+		denominator := math.Log(float64(stats.Words + m.vocabulary + 1))
+		for _, token := range tokens {
+			score += math.Log(float64(stats.Counts[token]+1)) - denominator
+		}
+		scores[i] = score
+	}
+
+	best := 0
+	for i, score := range scores {
+		if score > scores[best] {
+			best = i
+		}
+	}
+
+	// Normalise relative to the best score to avoid underflow
+	var sum float64
+	for _, score := range scores {
+		sum += math.Exp(score - scores[best])
+	}
+	return names[best], 1 / sum, true
+}
+
+// Tokenize splits the subject and body of a message into lower-case words.
+// Subject words are also counted with a "subject:" prefix, as they say more
+// about a message than its body does.
+func Tokenize(subject, body string) []string {
+	var tokens []string
+	for _, word := range words(subject) {
+		tokens = append(tokens, word, "subject:"+word)
+	}
+	for _, word := range words(body) {
+		if len(tokens) >= maxTokens {
+			break
+		}
+		tokens = append(tokens, word)
+	}
+	return tokens
+}
+
+func words(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	words := fields[:0]
+	for _, field := range fields {
+		if n := len([]rune(field)); n >= minTokenLength && n <= maxTokenLength {
+			words = append(words, field)
+		}
+	}
+	return words
+}
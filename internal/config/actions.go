@@ -0,0 +1,44 @@
+package config
+
+import "sync"
+
+// builtinActionTypes are implemented by pkg/email. They are known here so
+// that tools loading the configuration without the processor, such as the
+// certificate manager, accept every route.
+var builtinActionTypes = []string{
+	"store_local", "store_s3", "webhook", "forward", "autoreply", "exec", "modify",
+	"reject", "tempfail", "quarantine", "scan_clamav",
+}
+
+var (
+	actionTypesMu sync.RWMutex
+	actionTypes   = make(map[string]bool)
+)
+
+func init() {
+	for _, name := range builtinActionTypes {
+		actionTypes[name] = true
+	}
+}
+
+// RegisterActionType makes a custom action type known to configuration
+// validation. email.RegisterAction calls it; it must happen before
+// LoadConfig, typically from init.
+func RegisterActionType(name string) {
+	actionTypesMu.Lock()
+	defer actionTypesMu.Unlock()
+	actionTypes[name] = true
+}
+
+// IsActionTypeRegistered reports whether an action type is built in or has
+// been registered
+func IsActionTypeRegistered(name string) bool {
+	actionTypesMu.RLock()
+	defer actionTypesMu.RUnlock()
+	return actionTypes[name]
+}
+
+// BuiltinActionTypes returns the action types implemented by pkg/email
+func BuiltinActionTypes() []string {
+	return append([]string(nil), builtinActionTypes...)
+}
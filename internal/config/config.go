@@ -3,7 +3,11 @@ package config
 import (
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
 
+	"github.com/slav123/email-catch/pkg/action"
 	"gopkg.in/yaml.v3"
 )
 
@@ -12,6 +16,14 @@ type Config struct {
 	Storage StorageConfig `yaml:"storage"`
 	Routes  []RouteConfig `yaml:"routes"`
 	Logging LoggingConfig `yaml:"logging"`
+	Faults  FaultConfig   `yaml:"faults"`
+	Dedup   DedupConfig   `yaml:"dedup"`
+	Routing RoutingConfig `yaml:"routing"`
+	Spam    SpamConfig    `yaml:"spam"`
+
+	Classifier ClassifierConfig `yaml:"classifier"`
+
+	routeTable *RouteTable
 }
 
 type ServerConfig struct {
@@ -19,6 +31,17 @@ type ServerConfig struct {
 	Hostname string `yaml:"hostname"`
 	TLS      TLSConfig `yaml:"tls"`
 	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Tarpit    TarpitConfig    `yaml:"tarpit"`
+	Transcript TranscriptConfig `yaml:"transcript"`
+
+	// UnixSockets are additional listening paths for local clients
+	UnixSockets []string `yaml:"unix_sockets"`
+	// SocketActivation takes listeners from systemd (LISTEN_FDS) instead of
+	// binding ports and unix sockets itself
+	SocketActivation bool `yaml:"socket_activation"`
+	// User and Group to switch to after binding when started as root
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
 }
 
 type TLSConfig struct {
@@ -44,6 +67,46 @@ type RateLimitConfig struct {
 	MaxSize    int  `yaml:"max_email_size_mb"`
 }
 
+// TarpitConfig controls how abusive clients are slowed down. Every bad
+// command, unknown recipient or early talk adds to a per-session error score;
+// once the score reaches ErrorThreshold each response is delayed by a growing
+// amount, and at HardLimit the client is disconnected with 421.
+type TarpitConfig struct {
+	Enabled            bool `yaml:"enabled"`
+	PregreetDelayMs    int  `yaml:"pregreet_delay_ms"`
+	RejectEarlyTalkers bool `yaml:"reject_early_talkers"`
+	ErrorThreshold     int  `yaml:"error_threshold"`
+	DelayStepMs        int  `yaml:"delay_step_ms"`
+	MaxDelayMs         int  `yaml:"max_delay_ms"`
+	HardLimit          int  `yaml:"hard_limit"`
+}
+
+// TranscriptConfig enables recording of the SMTP conversation. When enabled
+// every session on the listed listeners (all listeners if none are listed) is
+// recorded; routes can also request transcripts individually.
+type TranscriptConfig struct {
+	Enabled        bool     `yaml:"enabled"`
+	Listeners      []string `yaml:"listeners"`
+	RejectedFolder string   `yaml:"rejected_folder"`
+}
+
+// RecordsListener reports whether sessions on the named listener (for example
+// "port 2525" or "unix:/run/email-catch/smtp.sock") are recorded.
+func (t TranscriptConfig) RecordsListener(name string) bool {
+	if !t.Enabled {
+		return false
+	}
+	if len(t.Listeners) == 0 {
+		return true
+	}
+	for _, listener := range t.Listeners {
+		if listener == name {
+			return true
+		}
+	}
+	return false
+}
+
 type StorageConfig struct {
 	S3Compatible S3Config    `yaml:"s3_compatible"`
 	Local        LocalConfig `yaml:"local"`
@@ -70,18 +133,228 @@ type RouteConfig struct {
 	Condition   Condition  `yaml:"condition"`
 	Actions     []Action   `yaml:"actions"`
 	Enabled     bool       `yaml:"enabled"`
+	Transcript  bool       `yaml:"transcript"`
+
+	// Priority orders route evaluation, highest first; routes with equal
+	// priority keep their order in the file
+	Priority int `yaml:"priority"`
+	// Final stops evaluation of further routes once this route matched
+	Final bool `yaml:"final"`
+	// Type is empty for normal routes or "fallback" for routes that only
+	// run when no normal route matched
+	Type string `yaml:"type"`
+	// Parallel runs the route's actions concurrently instead of in order
+	Parallel bool `yaml:"parallel"`
+	// Dedup decides what the route does with duplicate messages when
+	// deduplication is enabled: "tag" (default), "drop" or "link"
+	Dedup string `yaml:"dedup"`
+	// Attachments restricts the attachments the route's actions see
+	Attachments *AttachmentPolicy `yaml:"attachments"`
+}
+
+// AttachmentPolicy decides which attachments a route accepts. Types are
+// detected from the content, not taken from the declared Content-Type, and
+// may end in "/*" to match a whole family such as "image/*".
+type AttachmentPolicy struct {
+	AllowExtensions []string `yaml:"allow_extensions"`
+	DenyExtensions  []string `yaml:"deny_extensions"`
+	AllowTypes      []string `yaml:"allow_types"`
+	DenyTypes       []string `yaml:"deny_types"`
+	// MaxSize is the largest accepted attachment in bytes; 0 means no limit
+	MaxSize int64 `yaml:"max_size"`
+	// Action is what happens to a message with a disallowed attachment:
+	// "strip" (default) removes the attachment, "quarantine" stores the
+	// message in QuarantineFolder and stops processing, "reject" refuses it
+	Action           string `yaml:"action"`
+	QuarantineFolder string `yaml:"quarantine_folder"`
+}
+
+const (
+	AttachmentStrip      = "strip"
+	AttachmentQuarantine = "quarantine"
+	AttachmentReject     = "reject"
+)
+
+// PolicyAction returns the policy's action with the default applied
+func (p AttachmentPolicy) PolicyAction() string {
+	if p.Action == "" {
+		return AttachmentStrip
+	}
+	return p.Action
+}
+
+const (
+	DedupTag  = "tag"
+	DedupDrop = "drop"
+	DedupLink = "link"
+)
+
+// DedupMode returns the route's dedup setting with the default applied
+func (r RouteConfig) DedupMode() string {
+	if r.Dedup == "" {
+		return DedupTag
+	}
+	return r.Dedup
+}
+
+const RouteTypeFallback = "fallback"
+
+// IsFallback reports whether the route only runs when nothing else matched
+func (r RouteConfig) IsFallback() bool {
+	return r.Type == RouteTypeFallback
 }
 
+// Condition selects the messages a route applies to. Every field that is set
+// must match; an empty condition matches everything. All, Any and Not nest
+// further conditions for boolean composition.
 type Condition struct {
 	RecipientPattern string `yaml:"recipient_pattern"`
 	SenderPattern    string `yaml:"sender_pattern"`
 	SubjectPattern   string `yaml:"subject_pattern"`
+
+	// Parts of a subaddressed recipient (user+tag@domain); every set
+	// pattern, including recipient_pattern, must hold for the same recipient
+	RecipientUserPattern   string `yaml:"recipient_user_pattern"`
+	RecipientTagPattern    string `yaml:"recipient_tag_pattern"`
+	RecipientDomainPattern string `yaml:"recipient_domain_pattern"`
+
+	// Envelope and session fields
+	EnvelopeFromPattern string `yaml:"envelope_from_pattern"`
+	HeloPattern         string `yaml:"helo_pattern"`
+	RemoteAddrPattern   string `yaml:"remote_addr_pattern"`
+	ListenerPattern     string `yaml:"listener_pattern"`
+	TLS                 *bool  `yaml:"tls"`
+
+	// Headers maps a header name to a pattern one of its values must match
+	Headers map[string]string `yaml:"headers"`
+	// AuthResults maps an Authentication-Results method (spf, dkim, dmarc)
+	// to a pattern its result must match, e.g. {dkim: "^pass$"}
+	AuthResults map[string]string `yaml:"auth_results"`
+
+	BodyPattern string `yaml:"body_pattern"`
+	HTMLPattern string `yaml:"html_pattern"`
+
+	HasAttachments        *bool  `yaml:"has_attachments"`
+	MinAttachments        *int   `yaml:"min_attachments"`
+	MaxAttachments        *int   `yaml:"max_attachments"`
+	AttachmentTypePattern string `yaml:"attachment_type_pattern"`
+	AttachmentNamePattern string `yaml:"attachment_name_pattern"`
+
+	// Message size range in bytes; zero means unbounded
+	MinSize int64 `yaml:"min_size"`
+	MaxSize int64 `yaml:"max_size"`
+
+	// Spam checks, inclusive score bounds; none of them match a message
+	// spamd did not score
+	MinSpamScore    *float64 `yaml:"min_spam_score"`
+	MaxSpamScore    *float64 `yaml:"max_spam_score"`
+	IsSpam          *bool    `yaml:"is_spam"`
+	SpamRulePattern string   `yaml:"spam_rule_pattern"`
+
+	// Classifier prediction; neither matches an unclassified message
+	CategoryPattern       string   `yaml:"category_pattern"`
+	MinCategoryConfidence *float64 `yaml:"min_category_confidence"`
+
+	All []Condition `yaml:"all"`
+	Any []Condition `yaml:"any"`
+	Not *Condition  `yaml:"not"`
+}
+
+// Action is the configuration of one action of a route. It is defined in
+// pkg/action so that custom actions outside this module can use it.
+type Action = action.Config
+
+const (
+	OnErrorContinue = action.OnErrorContinue
+	OnErrorAbort    = action.OnErrorAbort
+	OnErrorTempFail = action.OnErrorTempFail
+)
+
+// RoutingConfig controls how messages are matched against routes
+type RoutingConfig struct {
+	// PerRecipient evaluates routes separately for every envelope
+	// recipient, so each recipient's routes see only its own address
+	PerRecipient bool `yaml:"per_recipient"`
+	// SubaddressSeparators lists the characters that split a local part
+	// into user and tag, e.g. "+-"; defaults to "+"
+	SubaddressSeparators string `yaml:"subaddress_separators"`
+	// AliasFile maps recipients to one or more replacement addresses before
+	// routing; it is read again whenever it changes
+	AliasFile string `yaml:"alias_file"`
+}
+
+// Separators returns the subaddress separators with the default applied
+func (r RoutingConfig) Separators() string {
+	if r.SubaddressSeparators == "" {
+		return "+"
+	}
+	return r.SubaddressSeparators
+}
+
+// SpamConfig enables scoring every message with SpamAssassin's spamd
+// before routing, so route conditions can use the score
+type SpamConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Address is "host:port" or "unix:///path"; defaults to 127.0.0.1:783
+	Address string `yaml:"address"`
+	// User is the spamd user whose preferences apply
+	User      string `yaml:"user"`
+	TimeoutMs int    `yaml:"timeout_ms"`
+	// MaxSize skips larger messages, as spamc does; 0 checks all
+	MaxSize int64 `yaml:"max_size"`
+	// AddHeaders adds X-Spam-Flag, X-Spam-Score and X-Spam-Status to the
+	// stored message
+	AddHeaders bool `yaml:"add_headers"`
+	// Fail decides what happens when spamd cannot check a message: "open"
+	// (default) routes it unscored, "closed" answers 451
+	Fail string `yaml:"fail"`
+}
+
+const (
+	SpamFailOpen   = "open"
+	SpamFailClosed = "closed"
+)
+
+// ClassifierConfig enables sorting every message into one of the
+// categories of a trained naive Bayes model before routing
+type ClassifierConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ModelFile is written by the classifier command and read again
+	// whenever it changes
+	ModelFile string `yaml:"model_file"`
+}
+
+// DedupConfig enables detection of messages seen before, keyed by
+// Message-ID and a hash of the body
+type DedupConfig struct {
+	Enabled       bool `yaml:"enabled"`
+	WindowMinutes int  `yaml:"window_minutes"`
+	// StoreFile keeps seen messages across restarts; empty keeps them in
+	// memory only
+	StoreFile string `yaml:"store_file"`
 }
 
-type Action struct {
-	Type     string            `yaml:"type"`
-	Config   map[string]string `yaml:"config"`
-	Enabled  bool              `yaml:"enabled"`
+// FaultConfig enables failure injection for testing SMTP clients. Rules are
+// checked in order and the first one that matches the stage wins.
+type FaultConfig struct {
+	Enabled bool        `yaml:"enabled"`
+	Header  string      `yaml:"header"`
+	Rules   []FaultRule `yaml:"rules"`
+}
+
+// FaultRule describes one injected failure. A rule applies at a single SMTP
+// stage (connect, mail, rcpt, data or starttls) and can be narrowed down by
+// recipient and by the value of the fault header (data stage only).
+type FaultRule struct {
+	Name             string  `yaml:"name"`
+	Stage            string  `yaml:"stage"`
+	RecipientPattern string  `yaml:"recipient_pattern"`
+	HeaderPattern    string  `yaml:"header_pattern"`
+	Code             int     `yaml:"code"`
+	Message          string  `yaml:"message"`
+	DelayMs          int     `yaml:"delay_ms"`
+	Drop             bool    `yaml:"drop"`
+	Probability      float64 `yaml:"probability"`
 }
 
 type LoggingConfig struct {
@@ -109,7 +382,7 @@ func LoadConfig(filename string) (*Config, error) {
 }
 
 func validateConfig(config *Config) error {
-	if len(config.Server.Ports) == 0 {
+	if len(config.Server.Ports) == 0 && len(config.Server.UnixSockets) == 0 && !config.Server.SocketActivation {
 		return fmt.Errorf("at least one server port must be specified")
 	}
 
@@ -119,8 +392,8 @@ func validateConfig(config *Config) error {
 		}
 	}
 
-	if config.Server.Hostname == "" {
-		config.Server.Hostname = "localhost"
+	if config.Server.Group != "" && config.Server.User == "" {
+		return fmt.Errorf("server group requires a server user")
 	}
 
 	if !config.Storage.S3Compatible.Enabled && !config.Storage.Local.Enabled {
@@ -140,21 +413,230 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("local directory must be specified when local storage is enabled")
 	}
 
+	return Prepare(config)
+}
+
+// Prepare fills in defaults and checks everything but the listeners and
+// storage backends, which embedders such as pkg/emailcatch provide themselves
+func Prepare(config *Config) error {
+	if config.Server.Hostname == "" {
+		config.Server.Hostname = "localhost"
+	}
+
+	if err := validateTarpit(&config.Server.Tarpit); err != nil {
+		return err
+	}
+
+	if config.Server.Transcript.RejectedFolder == "" {
+		config.Server.Transcript.RejectedFolder = "rejected"
+	}
+
+	if err := validateFaults(&config.Faults); err != nil {
+		return err
+	}
+
+	if strings.ContainsAny(config.Routing.SubaddressSeparators, "@ \t\r\n") {
+		return fmt.Errorf("routing subaddress_separators must not contain '@' or whitespace")
+	}
+
+	if err := validateSpam(&config.Spam); err != nil {
+		return err
+	}
+
+	if config.Classifier.Enabled && config.Classifier.ModelFile == "" {
+		return fmt.Errorf("classifier model_file must be specified when the classifier is enabled")
+	}
+
+	if config.Dedup.WindowMinutes < 0 {
+		return fmt.Errorf("dedup window_minutes must not be negative")
+	}
+	if config.Dedup.WindowMinutes == 0 {
+		config.Dedup.WindowMinutes = 60
+	}
+
 	for i, route := range config.Routes {
 		if route.Name == "" {
 			return fmt.Errorf("route %d must have a name", i)
 		}
-		if route.Condition.RecipientPattern == "" {
-			return fmt.Errorf("route %s must have a recipient pattern", route.Name)
-		}
 		if len(route.Actions) == 0 {
 			return fmt.Errorf("route %s must have at least one action", route.Name)
 		}
+		if route.Type != "" && route.Type != RouteTypeFallback {
+			return fmt.Errorf("route %s has invalid type %q", route.Name, route.Type)
+		}
+		switch route.Dedup {
+		case "", DedupTag, DedupDrop, DedupLink:
+		default:
+			return fmt.Errorf("route %s has invalid dedup %q, expected tag, drop or link", route.Name, route.Dedup)
+		}
+		if policy := route.Attachments; policy != nil {
+			switch policy.PolicyAction() {
+			case AttachmentStrip, AttachmentQuarantine, AttachmentReject:
+			default:
+				return fmt.Errorf("route %s has invalid attachments action %q, expected strip, quarantine or reject", route.Name, policy.Action)
+			}
+			if policy.MaxSize < 0 {
+				return fmt.Errorf("route %s: attachments max_size must not be negative", route.Name)
+			}
+		}
+		for j := range route.Actions {
+			action := &config.Routes[i].Actions[j]
+			if !IsActionTypeRegistered(action.Type) {
+				return fmt.Errorf("route %s: action %d has unknown type %q", route.Name, j, action.Type)
+			}
+			if err := validateAction(action); err != nil {
+				return fmt.Errorf("route %s: action %d: %w", route.Name, j, err)
+			}
+		}
+		// Disabled routes are checked too, so typos surface before they are enabled
+		if _, err := CompileCondition(route.Condition); err != nil {
+			return fmt.Errorf("route %s: %w", route.Name, err)
+		}
+	}
+
+	table, err := NewRouteTable(config.Routes)
+	if err != nil {
+		return err
+	}
+	config.routeTable = table
+
+	return nil
+}
+
+func validateAction(action *Action) error {
+	action.OnError = action.ErrorPolicy()
+	switch action.OnError {
+	case OnErrorContinue, OnErrorAbort, OnErrorTempFail:
+	default:
+		return fmt.Errorf("invalid on_error %q, expected continue, abort or tempfail", action.OnError)
+	}
+
+	if action.TimeoutMs < 0 {
+		return fmt.Errorf("timeout_ms must not be negative")
+	}
+
+	return nil
+}
+
+func validateTarpit(tarpit *TarpitConfig) error {
+	if !tarpit.Enabled {
+		return nil
+	}
+
+	if tarpit.PregreetDelayMs < 0 || tarpit.DelayStepMs < 0 || tarpit.MaxDelayMs < 0 {
+		return fmt.Errorf("tarpit delays must not be negative")
+	}
+	if tarpit.ErrorThreshold <= 0 {
+		tarpit.ErrorThreshold = 3
+	}
+	if tarpit.DelayStepMs == 0 {
+		tarpit.DelayStepMs = 1000
+	}
+	if tarpit.MaxDelayMs == 0 {
+		tarpit.MaxDelayMs = 30000
+	}
+	if tarpit.HardLimit <= 0 {
+		tarpit.HardLimit = 20
+	}
+	if tarpit.HardLimit < tarpit.ErrorThreshold {
+		return fmt.Errorf("tarpit hard_limit (%d) must not be lower than error_threshold (%d)", tarpit.HardLimit, tarpit.ErrorThreshold)
 	}
 
 	return nil
 }
 
+func validateSpam(spam *SpamConfig) error {
+	if !spam.Enabled {
+		return nil
+	}
+
+	if spam.Address == "" {
+		spam.Address = "127.0.0.1:783"
+	}
+	if spam.TimeoutMs < 0 || spam.MaxSize < 0 {
+		return fmt.Errorf("spam timeout_ms and max_size must not be negative")
+	}
+	if spam.TimeoutMs == 0 {
+		spam.TimeoutMs = 10000
+	}
+	switch spam.Fail {
+	case "":
+		spam.Fail = SpamFailOpen
+	case SpamFailOpen, SpamFailClosed:
+	default:
+		return fmt.Errorf("invalid spam fail %q, expected open or closed", spam.Fail)
+	}
+
+	return nil
+}
+
+func validateFaults(faults *FaultConfig) error {
+	if !faults.Enabled {
+		return nil
+	}
+
+	if faults.Header == "" {
+		faults.Header = "X-EmailCatch-Fault"
+	}
+
+	for i := range faults.Rules {
+		rule := &faults.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("fault %d", i)
+		}
+
+		switch rule.Stage {
+		case "connect", "mail", "rcpt", "data", "starttls":
+		default:
+			return fmt.Errorf("fault rule %s has invalid stage %q", rule.Name, rule.Stage)
+		}
+
+		if rule.Code != 0 && (rule.Code < 400 || rule.Code > 599) {
+			return fmt.Errorf("fault rule %s must use a 4xx or 5xx code, got %d", rule.Name, rule.Code)
+		}
+		if rule.Code == 0 && !rule.Drop && rule.DelayMs <= 0 {
+			return fmt.Errorf("fault rule %s must set a code, a delay or drop", rule.Name)
+		}
+		if rule.Probability < 0 || rule.Probability > 1 {
+			return fmt.Errorf("fault rule %s probability must be between 0 and 1", rule.Name)
+		}
+
+		if rule.RecipientPattern != "" {
+			if rule.Stage != "rcpt" && rule.Stage != "data" {
+				return fmt.Errorf("fault rule %s: recipient_pattern only applies to rcpt and data stages", rule.Name)
+			}
+			if _, err := regexp.Compile(rule.RecipientPattern); err != nil {
+				return fmt.Errorf("fault rule %s has invalid recipient_pattern: %w", rule.Name, err)
+			}
+		}
+		if rule.HeaderPattern != "" {
+			if rule.Stage != "data" {
+				return fmt.Errorf("fault rule %s: header_pattern only applies to the data stage", rule.Name)
+			}
+			if _, err := regexp.Compile(rule.HeaderPattern); err != nil {
+				return fmt.Errorf("fault rule %s has invalid header_pattern: %w", rule.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// WantsTranscripts reports whether sessions on the named listener need to be
+// recorded, either for the listener itself or for any enabled route.
+func (c *Config) WantsTranscripts(listener string) bool {
+	if c.Server.Transcript.RecordsListener(listener) {
+		return true
+	}
+	for _, route := range c.Routes {
+		if route.Enabled && route.Transcript {
+			return true
+		}
+	}
+	return false
+}
+
+// GetEnabledRoutes returns the enabled routes in evaluation order
 func (c *Config) GetEnabledRoutes() []RouteConfig {
 	var enabled []RouteConfig
 	for _, route := range c.Routes {
@@ -162,5 +644,8 @@ func (c *Config) GetEnabledRoutes() []RouteConfig {
 			enabled = append(enabled, route)
 		}
 	}
+	sort.SliceStable(enabled, func(i, j int) bool {
+		return enabled[i].Priority > enabled[j].Priority
+	})
 	return enabled
 }
\ No newline at end of file
@@ -0,0 +1,239 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// CompiledCondition is a Condition with every pattern compiled. A nil
+// pattern means the field was not set.
+type CompiledCondition struct {
+	Recipient       *regexp.Regexp
+	RecipientUser   *regexp.Regexp
+	RecipientTag    *regexp.Regexp
+	RecipientDomain *regexp.Regexp
+	Sender          *regexp.Regexp
+	Subject         *regexp.Regexp
+	EnvelopeFrom    *regexp.Regexp
+	Helo            *regexp.Regexp
+	RemoteAddr      *regexp.Regexp
+	Listener        *regexp.Regexp
+	Body            *regexp.Regexp
+	HTML            *regexp.Regexp
+	AttachmentType  *regexp.Regexp
+	AttachmentName  *regexp.Regexp
+	SpamRule        *regexp.Regexp
+	Category        *regexp.Regexp
+
+	// Headers is keyed by canonical header name, AuthResults by lowercase method
+	Headers     map[string]*regexp.Regexp
+	AuthResults map[string]*regexp.Regexp
+
+	TLS            *bool
+	HasAttachments *bool
+	MinAttachments *int
+	MaxAttachments *int
+	MinSize        int64
+	MaxSize        int64
+	MinSpamScore   *float64
+	MaxSpamScore   *float64
+	IsSpam         *bool
+
+	MinCategoryConfidence *float64
+
+	All []*CompiledCondition
+	Any []*CompiledCondition
+	Not *CompiledCondition
+}
+
+// CompiledRoute is an enabled route with its condition compiled
+type CompiledRoute struct {
+	RouteConfig
+	Matcher *CompiledCondition
+}
+
+// RouteTable holds the enabled routes in evaluation order, ready for matching
+type RouteTable struct {
+	Routes []*CompiledRoute
+}
+
+// NewRouteTable compiles the enabled routes. Routes whose patterns do not
+// compile are left out of the table and reported in the returned error.
+func NewRouteTable(routes []RouteConfig) (*RouteTable, error) {
+	table := &RouteTable{}
+	var errs []error
+
+	for _, route := range routes {
+		if !route.Enabled {
+			continue
+		}
+
+		matcher, err := CompileCondition(route.Condition)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", route.Name, err))
+			continue
+		}
+
+		table.Routes = append(table.Routes, &CompiledRoute{RouteConfig: route, Matcher: matcher})
+	}
+
+	sort.SliceStable(table.Routes, func(i, j int) bool {
+		return table.Routes[i].Priority > table.Routes[j].Priority
+	})
+
+	return table, errors.Join(errs...)
+}
+
+// RouteTable returns the compiled routes. LoadConfig builds the table once;
+// for configurations assembled in code it is compiled on every call, and
+// routes with invalid patterns are skipped with a log message.
+func (c *Config) RouteTable() *RouteTable {
+	if c.routeTable != nil {
+		return c.routeTable
+	}
+
+	table, err := NewRouteTable(c.Routes)
+	if err != nil {
+		log.Printf("Skipping invalid routes: %v", err)
+	}
+	return table
+}
+
+// CompileCondition compiles every pattern in a condition tree. Errors name
+// the offending field, e.g. "condition.any[1].sender_pattern".
+func CompileCondition(cond Condition) (*CompiledCondition, error) {
+	return compileCondition(cond, "condition")
+}
+
+func compileCondition(cond Condition, path string) (*CompiledCondition, error) {
+	compiled := &CompiledCondition{
+		TLS:            cond.TLS,
+		HasAttachments: cond.HasAttachments,
+		MinAttachments: cond.MinAttachments,
+		MaxAttachments: cond.MaxAttachments,
+		MinSize:        cond.MinSize,
+		MaxSize:        cond.MaxSize,
+		MinSpamScore:   cond.MinSpamScore,
+		MaxSpamScore:   cond.MaxSpamScore,
+		IsSpam:         cond.IsSpam,
+
+		MinCategoryConfidence: cond.MinCategoryConfidence,
+	}
+
+	patterns := []struct {
+		field   string
+		pattern string
+		target  **regexp.Regexp
+	}{
+		{"recipient_pattern", cond.RecipientPattern, &compiled.Recipient},
+		{"recipient_user_pattern", cond.RecipientUserPattern, &compiled.RecipientUser},
+		{"recipient_tag_pattern", cond.RecipientTagPattern, &compiled.RecipientTag},
+		{"recipient_domain_pattern", cond.RecipientDomainPattern, &compiled.RecipientDomain},
+		{"sender_pattern", cond.SenderPattern, &compiled.Sender},
+		{"subject_pattern", cond.SubjectPattern, &compiled.Subject},
+		{"envelope_from_pattern", cond.EnvelopeFromPattern, &compiled.EnvelopeFrom},
+		{"helo_pattern", cond.HeloPattern, &compiled.Helo},
+		{"remote_addr_pattern", cond.RemoteAddrPattern, &compiled.RemoteAddr},
+		{"listener_pattern", cond.ListenerPattern, &compiled.Listener},
+		{"body_pattern", cond.BodyPattern, &compiled.Body},
+		{"html_pattern", cond.HTMLPattern, &compiled.HTML},
+		{"attachment_type_pattern", cond.AttachmentTypePattern, &compiled.AttachmentType},
+		{"attachment_name_pattern", cond.AttachmentNamePattern, &compiled.AttachmentName},
+		{"spam_rule_pattern", cond.SpamRulePattern, &compiled.SpamRule},
+		{"category_pattern", cond.CategoryPattern, &compiled.Category},
+	}
+
+	for _, p := range patterns {
+		re, err := compilePattern(path+"."+p.field, p.pattern)
+		if err != nil {
+			return nil, err
+		}
+		*p.target = re
+	}
+
+	if len(cond.Headers) > 0 {
+		compiled.Headers = make(map[string]*regexp.Regexp, len(cond.Headers))
+		for name, pattern := range cond.Headers {
+			re, err := compilePattern(fmt.Sprintf("%s.headers[%s]", path, name), pattern)
+			if err != nil {
+				return nil, err
+			}
+			if re == nil {
+				return nil, fmt.Errorf("%s.headers[%s]: pattern must not be empty", path, name)
+			}
+			compiled.Headers[textproto.CanonicalMIMEHeaderKey(name)] = re
+		}
+	}
+
+	if len(cond.AuthResults) > 0 {
+		compiled.AuthResults = make(map[string]*regexp.Regexp, len(cond.AuthResults))
+		for method, pattern := range cond.AuthResults {
+			re, err := compilePattern(fmt.Sprintf("%s.auth_results[%s]", path, method), pattern)
+			if err != nil {
+				return nil, err
+			}
+			if re == nil {
+				return nil, fmt.Errorf("%s.auth_results[%s]: pattern must not be empty", path, method)
+			}
+			compiled.AuthResults[strings.ToLower(method)] = re
+		}
+	}
+
+	if cond.MinSize < 0 || cond.MaxSize < 0 {
+		return nil, fmt.Errorf("%s: message size limits must not be negative", path)
+	}
+	if cond.MaxSize > 0 && cond.MinSize > cond.MaxSize {
+		return nil, fmt.Errorf("%s: min_size (%d) is larger than max_size (%d)", path, cond.MinSize, cond.MaxSize)
+	}
+
+	if cond.MinSpamScore != nil && cond.MaxSpamScore != nil && *cond.MinSpamScore > *cond.MaxSpamScore {
+		return nil, fmt.Errorf("%s: min_spam_score (%g) is larger than max_spam_score (%g)", path, *cond.MinSpamScore, *cond.MaxSpamScore)
+	}
+
+	if c := cond.MinCategoryConfidence; c != nil && (*c < 0 || *c > 1) {
+		return nil, fmt.Errorf("%s: min_category_confidence must be between 0 and 1", path)
+	}
+
+	for i, sub := range cond.All {
+		child, err := compileCondition(sub, fmt.Sprintf("%s.all[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		compiled.All = append(compiled.All, child)
+	}
+
+	for i, sub := range cond.Any {
+		child, err := compileCondition(sub, fmt.Sprintf("%s.any[%d]", path, i))
+		if err != nil {
+			return nil, err
+		}
+		compiled.Any = append(compiled.Any, child)
+	}
+
+	if cond.Not != nil {
+		child, err := compileCondition(*cond.Not, path+".not")
+		if err != nil {
+			return nil, err
+		}
+		compiled.Not = child
+	}
+
+	return compiled, nil
+}
+
+func compilePattern(field, pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid pattern %q: %w", field, pattern, err)
+	}
+	return re, nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package privileges
+
+import "fmt"
+
+// Drop is not supported on this platform
+func Drop(username, groupname string, paths ...string) error {
+	return fmt.Errorf("dropping privileges is not supported on this platform")
+}
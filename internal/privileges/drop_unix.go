@@ -0,0 +1,50 @@
+//go:build unix
+
+package privileges
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+)
+
+// Drop switches the process to the given user and group. It is a no-op when
+// the process is not running as root. Paths (typically Unix sockets created
+// while still privileged) are handed over to the new owner first.
+func Drop(username, groupname string, paths ...string) error {
+	if os.Geteuid() != 0 {
+		log.Printf("Not running as root, keeping current user (uid %d)", os.Geteuid())
+		return nil
+	}
+
+	creds, err := Lookup(username, groupname)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if err := os.Chown(path, creds.UID, creds.GID); err != nil {
+			return fmt.Errorf("failed to chown %s: %w", path, err)
+		}
+	}
+
+	// Order matters: supplementary groups and gid can only be changed while
+	// we are still root.
+	if err := syscall.Setgroups([]int{creds.GID}); err != nil {
+		return fmt.Errorf("failed to set supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(creds.GID); err != nil {
+		return fmt.Errorf("failed to set gid %d: %w", creds.GID, err)
+	}
+	if err := syscall.Setuid(creds.UID); err != nil {
+		return fmt.Errorf("failed to set uid %d: %w", creds.UID, err)
+	}
+
+	if os.Geteuid() == 0 {
+		return fmt.Errorf("still running as root after dropping privileges")
+	}
+
+	log.Printf("Dropped privileges to uid %d, gid %d", creds.UID, creds.GID)
+	return nil
+}
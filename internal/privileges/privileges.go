@@ -0,0 +1,53 @@
+package privileges
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// Credentials identifies the unprivileged user and group the server runs as
+type Credentials struct {
+	UID int
+	GID int
+}
+
+// Lookup resolves a user and group name (or numeric ID) to credentials. When
+// group is empty the user's primary group is used.
+func Lookup(username, groupname string) (*Credentials, error) {
+	if username == "" {
+		return nil, fmt.Errorf("user must be specified")
+	}
+
+	u, err := user.Lookup(username)
+	if err != nil {
+		u, err = user.LookupId(username)
+		if err != nil {
+			return nil, fmt.Errorf("unknown user %q: %w", username, err)
+		}
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("user %q has non-numeric uid %q", username, u.Uid)
+	}
+
+	gidStr := u.Gid
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			g, err = user.LookupGroupId(groupname)
+			if err != nil {
+				return nil, fmt.Errorf("unknown group %q: %w", groupname, err)
+			}
+		}
+		gidStr = g.Gid
+	}
+
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return nil, fmt.Errorf("group %q has non-numeric gid %q", groupname, gidStr)
+	}
+
+	return &Credentials{UID: uid, GID: gid}, nil
+}
@@ -0,0 +1,220 @@
+// Package relay delivers messages to an upstream SMTP server (a smarthost).
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// TLS modes for the connection to the smarthost
+const (
+	// TLSOpportunistic upgrades with STARTTLS when the server offers it
+	TLSOpportunistic = ""
+	// TLSStartTLS requires STARTTLS
+	TLSStartTLS = "starttls"
+	// TLSImplicit connects with TLS from the start, usually on port 465
+	TLSImplicit = "implicit"
+	// TLSNone never uses TLS
+	TLSNone = "none"
+)
+
+// Config describes a smarthost
+type Config struct {
+	Host               string
+	Port               int
+	TLS                string
+	InsecureSkipVerify bool
+	Username           string
+	Password           string
+	// Helo is the name sent in EHLO; defaults to "localhost"
+	Helo    string
+	Timeout time.Duration
+}
+
+// Message is an envelope and the raw message to send
+type Message struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// Client sends messages through one smarthost
+type Client struct {
+	config Config
+}
+
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("smarthost host must be specified")
+	}
+
+	switch cfg.TLS {
+	case TLSOpportunistic, TLSStartTLS, TLSNone:
+		if cfg.Port == 0 {
+			cfg.Port = 25
+		}
+	case TLSImplicit:
+		if cfg.Port == 0 {
+			cfg.Port = 465
+		}
+	default:
+		return nil, fmt.Errorf("invalid TLS mode %q, expected starttls, implicit or none", cfg.TLS)
+	}
+
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		return nil, fmt.Errorf("invalid port number: %d", cfg.Port)
+	}
+	// net/smtp only sends credentials in the clear to localhost
+	if cfg.TLS == TLSNone && cfg.Username != "" && !isLocalhost(cfg.Host) {
+		return nil, fmt.Errorf("authentication with %s requires TLS, tls none is only allowed for localhost", cfg.Host)
+	}
+	if cfg.Helo == "" {
+		cfg.Helo = "localhost"
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 60 * time.Second
+	}
+
+	return &Client{config: cfg}, nil
+}
+
+// Addr returns the smarthost address
+func (c *Client) Addr() string {
+	return net.JoinHostPort(c.config.Host, strconv.Itoa(c.config.Port))
+}
+
+// Send delivers a message. Errors are wrapped in *Error, which tells whether
+// retrying may help.
+func (c *Client) Send(ctx context.Context, msg *Message) error {
+	if len(msg.To) == 0 {
+		return &Error{Err: errors.New("no recipients")}
+	}
+
+	if err := c.send(ctx, msg); err != nil {
+		return classify(err)
+	}
+
+	return nil
+}
+
+func (c *Client) send(ctx context.Context, msg *Message) error {
+	deadline := time.Now().Add(c.config.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	dialer := &net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", c.Addr())
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", c.Addr(), err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	// Abort blocked reads and writes when the context is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	tlsConfig := &tls.Config{
+		ServerName:         c.config.Host,
+		InsecureSkipVerify: c.config.InsecureSkipVerify,
+	}
+
+	if c.config.TLS == TLSImplicit {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	client, err := smtp.NewClient(conn, c.config.Host)
+	if err != nil {
+		return fmt.Errorf("failed to read greeting: %w", err)
+	}
+	defer client.Close()
+
+	if err := client.Hello(c.config.Helo); err != nil {
+		return fmt.Errorf("EHLO failed: %w", err)
+	}
+
+	if c.config.TLS == TLSStartTLS || c.config.TLS == TLSOpportunistic {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return fmt.Errorf("STARTTLS failed: %w", err)
+			}
+		} else if c.config.TLS == TLSStartTLS {
+			return fmt.Errorf("%s does not offer STARTTLS", c.Addr())
+		}
+	}
+
+	if c.config.Username != "" {
+		auth := smtp.PlainAuth("", c.config.Username, c.config.Password, c.config.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(msg.From); err != nil {
+		return fmt.Errorf("MAIL FROM rejected: %w", err)
+	}
+	for _, rcpt := range msg.To {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("RCPT TO %s rejected: %w", rcpt, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("DATA rejected: %w", err)
+	}
+	if _, err := w.Write(msg.Data); err != nil {
+		return fmt.Errorf("failed to send message data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("message rejected: %w", err)
+	}
+
+	return client.Quit()
+}
+
+// Error is a delivery failure
+type Error struct {
+	// Permanent is set when the smarthost rejected the message with a 5xx
+	// reply; retrying will not help
+	Permanent bool
+	Err       error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func classify(err error) error {
+	var protoErr *textproto.Error
+	permanent := errors.As(err, &protoErr) && protoErr.Code >= 500
+	return &Error{Permanent: permanent, Err: err}
+}
+
+// IsPermanent reports whether err is a delivery failure that retrying will
+// not fix
+func IsPermanent(err error) bool {
+	var relayErr *Error
+	return errors.As(err, &relayErr) && relayErr.Permanent
+}
+
+// isLocalhost matches the hosts net/smtp's PlainAuth accepts without TLS
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
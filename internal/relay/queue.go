@@ -0,0 +1,114 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// SendFunc delivers one message
+type SendFunc func(ctx context.Context, msg *Message) error
+
+// Queue retries deliveries that failed temporarily, with exponential backoff.
+// It is held in memory, so messages still queued when the process exits are
+// lost; the captured copy stays in storage either way.
+type Queue struct {
+	send        SendFunc
+	maxAttempts int
+	delay       time.Duration
+	maxDelay    time.Duration
+
+	mu      sync.Mutex
+	pending int
+	closed  bool
+	wg      sync.WaitGroup
+	done    chan struct{}
+}
+
+// NewQueue creates a queue that makes up to maxAttempts further attempts per
+// message, waiting delay before the first retry and doubling it after each.
+func NewQueue(send SendFunc, maxAttempts int, delay time.Duration) *Queue {
+	return &Queue{
+		send:        send,
+		maxAttempts: maxAttempts,
+		delay:       delay,
+		maxDelay:    time.Hour,
+		done:        make(chan struct{}),
+	}
+}
+
+// Enqueue schedules a message for retrying. It reports false when the queue
+// is closed.
+func (q *Queue) Enqueue(msg *Message) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.maxAttempts <= 0 {
+		return false
+	}
+
+	q.pending++
+	q.wg.Add(1)
+	go q.retry(msg)
+
+	return true
+}
+
+// Pending returns the number of messages waiting for a retry
+func (q *Queue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+// Close stops retrying and waits for running attempts to finish
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.done)
+	q.mu.Unlock()
+
+	q.wg.Wait()
+}
+
+func (q *Queue) retry(msg *Message) {
+	defer q.wg.Done()
+	defer func() {
+		q.mu.Lock()
+		q.pending--
+		q.mu.Unlock()
+	}()
+
+	delay := q.delay
+	for attempt := 1; attempt <= q.maxAttempts; attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-q.done:
+			log.Printf("Relay queue closed, dropping message to %v", msg.To)
+			return
+		}
+
+		err := q.send(context.Background(), msg)
+		if err == nil {
+			log.Printf("Relayed message to %v on retry %d", msg.To, attempt)
+			return
+		}
+		if IsPermanent(err) {
+			log.Printf("Relay to %v failed permanently on retry %d: %v", msg.To, attempt, err)
+			return
+		}
+		log.Printf("Relay retry %d/%d to %v failed: %v", attempt, q.maxAttempts, msg.To, err)
+
+		delay *= 2
+		if delay > q.maxDelay {
+			delay = q.maxDelay
+		}
+	}
+
+	log.Printf("Giving up relaying message to %v after %d retries", msg.To, q.maxAttempts)
+}
@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const srsTimestampAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+// SRS rewrites envelope senders with the Sender Rewriting Scheme, so a
+// forwarded message passes SPF checks at the destination while bounces can
+// still be traced back to the original sender.
+type SRS struct {
+	// Domain is the forwarding domain the rewritten address belongs to
+	Domain string
+	Secret []byte
+
+	now func() time.Time
+}
+
+func NewSRS(domain, secret string) (*SRS, error) {
+	if domain == "" || secret == "" {
+		return nil, fmt.Errorf("SRS requires a domain and a secret")
+	}
+	return &SRS{Domain: domain, Secret: []byte(secret), now: time.Now}, nil
+}
+
+// Rewrite returns the SRS address for sender. The null sender used by bounces
+// and addresses already in the forwarding domain are returned unchanged.
+func (s *SRS) Rewrite(sender string) string {
+	at := strings.LastIndex(sender, "@")
+	if sender == "" || at < 0 {
+		return sender
+	}
+
+	local, domain := sender[:at], sender[at+1:]
+	if strings.EqualFold(domain, s.Domain) {
+		return sender
+	}
+
+	switch {
+	case hasPrefixFold(local, "SRS0="):
+		// Already rewritten once: wrap it as SRS1, keeping the first forwarder
+		rest := local[len("SRS0"):]
+		return fmt.Sprintf("SRS1=%s=%s=%s@%s", s.hash(domain+rest), domain, rest, s.Domain)
+	case hasPrefixFold(local, "SRS1="):
+		// Keep the original first forwarder and its payload, re-sign it
+		parts := strings.SplitN(local, "=", 3)
+		if len(parts) == 3 {
+			if sep := strings.Index(parts[2], "="); sep >= 0 {
+				first, rest := parts[2][:sep], parts[2][sep:]
+				return fmt.Sprintf("SRS1=%s=%s%s@%s", s.hash(first+rest), first, rest, s.Domain)
+			}
+		}
+	}
+
+	timestamp := s.timestamp()
+	return fmt.Sprintf("SRS0=%s=%s=%s=%s@%s", s.hash(timestamp+domain+local), timestamp, domain, local, s.Domain)
+}
+
+func (s *SRS) timestamp() string {
+	days := s.now().Unix() / 86400
+	return string([]byte{
+		srsTimestampAlphabet[(days>>5)&31],
+		srsTimestampAlphabet[days&31],
+	})
+}
+
+func (s *SRS) hash(data string) string {
+	mac := hmac.New(sha1.New, s.Secret)
+	mac.Write([]byte(strings.ToLower(data)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:4]
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
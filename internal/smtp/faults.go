@@ -0,0 +1,166 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/mail"
+	"regexp"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+)
+
+// faultRule is a configured fault with its patterns compiled
+type faultRule struct {
+	config.FaultRule
+	recipient *regexp.Regexp
+	header    *regexp.Regexp
+}
+
+func compileFaults(cfg config.FaultConfig) []faultRule {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	var rules []faultRule
+	for _, rule := range cfg.Rules {
+		compiled := faultRule{FaultRule: rule}
+
+		if rule.RecipientPattern != "" {
+			pattern, err := regexp.Compile(rule.RecipientPattern)
+			if err != nil {
+				log.Printf("Skipping fault rule %s: invalid recipient pattern: %v", rule.Name, err)
+				continue
+			}
+			compiled.recipient = pattern
+		}
+
+		if rule.HeaderPattern != "" {
+			pattern, err := regexp.Compile(rule.HeaderPattern)
+			if err != nil {
+				log.Printf("Skipping fault rule %s: invalid header pattern: %v", rule.Name, err)
+				continue
+			}
+			compiled.header = pattern
+		}
+
+		rules = append(rules, compiled)
+	}
+
+	return rules
+}
+
+// matches reports whether the rule applies to the given recipients and fault
+// header value. Rules with a header pattern never match an empty header.
+func (r *faultRule) matches(recipients []string, headerValue string) bool {
+	if r.recipient != nil {
+		matched := false
+		for _, recipient := range recipients {
+			if r.recipient.MatchString(recipient) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if r.header != nil && (headerValue == "" || !r.header.MatchString(headerValue)) {
+		return false
+	}
+
+	if r.Probability > 0 && rand.Float64() >= r.Probability {
+		return false
+	}
+
+	return true
+}
+
+// findFault returns the first rule for the stage that matches, or nil
+func (s *Session) findFault(stage string, recipients []string, headerValue string) *faultRule {
+	for i := range s.server.faults {
+		rule := &s.server.faults[i]
+		if rule.Stage == stage && rule.matches(recipients, headerValue) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// applyFault performs an injected fault. It reports whether the fault
+// replaced the normal response and whether the connection stays open.
+func (s *Session) applyFault(rule *faultRule) (handled bool, keepOpen bool) {
+	log.Printf("Injecting fault %s at %s stage for %s", rule.Name, rule.Stage, s.conn.RemoteAddr())
+	s.transcript.note("injected fault %s", rule.Name)
+
+	if rule.DelayMs > 0 {
+		time.Sleep(time.Duration(rule.DelayMs) * time.Millisecond)
+	}
+
+	if rule.Drop {
+		if rule.Stage == "starttls" {
+			// Agree to TLS, then hang up instead of handshaking
+			s.writeResponse(220, "Ready to start TLS")
+		}
+		return true, false
+	}
+
+	if rule.Code == 0 {
+		return false, true
+	}
+
+	message := rule.Message
+	if message == "" {
+		message = fmt.Sprintf("Injected failure (%s)", rule.Name)
+	}
+	s.writeResponse(rule.Code, message)
+
+	// 421 always closes the channel, and there is no session to continue
+	// after refusing the connection itself
+	return true, rule.Code != 421 && rule.Stage != "connect"
+}
+
+// commandFault checks fault rules for commands handled in handleCommand
+func (s *Session) commandFault(command, args string) (handled bool, keepOpen bool) {
+	if len(s.server.faults) == 0 {
+		return false, true
+	}
+
+	var rule *faultRule
+	switch command {
+	case "MAIL":
+		rule = s.findFault("mail", nil, "")
+	case "RCPT":
+		rule = s.findFault("rcpt", []string{parsePath(args, "TO:")}, "")
+	case "STARTTLS":
+		rule = s.findFault("starttls", nil, "")
+	}
+
+	if rule == nil {
+		return false, true
+	}
+
+	handled, keepOpen = s.applyFault(rule)
+	if handled && keepOpen && command == "MAIL" {
+		s.mailFrom = ""
+		s.inMail = false
+	}
+	return handled, keepOpen
+}
+
+// dataFault checks data stage rules against the headers read so far
+func (s *Session) dataFault(data []byte) *faultRule {
+	if len(s.server.faults) == 0 {
+		return nil
+	}
+
+	headerValue := ""
+	if msg, err := mail.ReadMessage(bytes.NewReader(data)); err == nil {
+		headerValue = msg.Header.Get(s.server.config.Faults.Header)
+	}
+
+	return s.findFault("data", s.rcptTo, headerValue)
+}
@@ -4,28 +4,38 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/systemd"
 	tlsmanager "github.com/slav123/email-catch/internal/tls"
 	"github.com/slav123/email-catch/pkg/email"
 )
 
 type Server struct {
 	config            *config.Config
-	listeners         []net.Listener
+	listeners         []*listener
 	processor         *email.Processor
 	wg                sync.WaitGroup
 	shutdown          chan struct{}
 	letsencryptMgr    *tlsmanager.LetsEncryptManager
 	renewalCtx        context.Context
 	renewalCancel     context.CancelFunc
+	faults            []faultRule
+}
+
+// listener is a bound socket with the name used for it in logs
+type listener struct {
+	net.Listener
+	name string
 }
 
 type Session struct {
@@ -35,9 +45,15 @@ type Session struct {
 	server     *Server
 	helo       string
 	mailFrom   string
+	inMail     bool // MAIL was accepted; mailFrom is empty for the null sender
 	rcptTo     []string
 	data       []byte
 	tlsEnabled bool
+	errorScore int
+	listener   string
+	transcript *transcript
+	delivered  int
+	rejected   bool
 }
 
 func NewServer(cfg *config.Config, processor *email.Processor) *Server {
@@ -49,6 +65,7 @@ func NewServer(cfg *config.Config, processor *email.Processor) *Server {
 		shutdown:      make(chan struct{}),
 		renewalCtx:    renewalCtx,
 		renewalCancel: renewalCancel,
+		faults:        compileFaults(cfg.Faults),
 	}
 
 	if cfg.Server.TLS.LetsEncrypt.Enabled {
@@ -72,7 +89,25 @@ func NewServer(cfg *config.Config, processor *email.Processor) *Server {
 	return server
 }
 
+// Start binds all listeners and begins accepting connections
 func (s *Server) Start() error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+
+	return s.Serve()
+}
+
+// SetProcessor sets the processor used for received messages. It allows the
+// processor (and its storage) to be created after Listen, once privileges
+// have been dropped.
+func (s *Server) SetProcessor(processor *email.Processor) {
+	s.processor = processor
+}
+
+// Listen binds the configured ports and unix sockets, or takes over the
+// sockets passed in by systemd, without accepting connections yet.
+func (s *Server) Listen() error {
 	if s.letsencryptMgr != nil {
 		if err := s.letsencryptMgr.ValidateDomains(); err != nil {
 			return fmt.Errorf("Let's Encrypt domain validation failed: %w", err)
@@ -98,40 +133,119 @@ func (s *Server) Start() error {
 		}()
 	}
 
+	if s.config.Server.SocketActivation {
+		return s.listenActivated()
+	}
+
 	for _, port := range s.config.Server.Ports {
-		listener, err := s.startListener(port)
+		l, err := s.startListener(port)
 		if err != nil {
 			s.Stop()
 			return fmt.Errorf("failed to start listener on port %d: %w", port, err)
 		}
-		s.listeners = append(s.listeners, listener)
-		
+		s.listeners = append(s.listeners, &listener{Listener: l, name: fmt.Sprintf("port %d", port)})
+	}
+
+	for _, path := range s.config.Server.UnixSockets {
+		l, err := startUnixListener(path)
+		if err != nil {
+			s.Stop()
+			return fmt.Errorf("failed to start listener on %s: %w", path, err)
+		}
+		s.listeners = append(s.listeners, &listener{Listener: l, name: "unix:" + path})
+	}
+	
+	return nil
+}
+
+func (s *Server) listenActivated() error {
+	activated, err := systemd.Listeners()
+	if err != nil {
+		return fmt.Errorf("socket activation failed: %w", err)
+	}
+	if len(activated) == 0 {
+		return fmt.Errorf("socket activation enabled but no sockets were passed in (LISTEN_FDS)")
+	}
+
+	for _, a := range activated {
+		l := a.Listener
+		if addr, ok := l.Addr().(*net.TCPAddr); ok && s.implicitTLS(addr.Port) {
+			tlsConfig, err := s.tlsConfig()
+			if err != nil {
+				s.Stop()
+				return err
+			}
+			l = tls.NewListener(l, tlsConfig)
+		}
+		s.listeners = append(s.listeners, &listener{Listener: l, name: "systemd:" + a.Name})
+	}
+
+	return nil
+}
+
+// Serve starts accepting connections on the listeners bound by Listen
+func (s *Server) Serve() error {
+	if s.processor == nil {
+		return fmt.Errorf("no email processor configured")
+	}
+	if len(s.listeners) == 0 {
+		return fmt.Errorf("no listeners bound, call Listen first")
+	}
+
+	for _, l := range s.listeners {
 		s.wg.Add(1)
-		go s.handleListener(listener, port)
+		go s.handleListener(l)
 		
-		log.Printf("SMTP server listening on port %d", port)
+		log.Printf("SMTP server listening on %s (%s)", l.name, l.Addr())
 	}
-	
+
 	return nil
 }
 
+// Listeners returns the names of the bound listeners
+func (s *Server) Listeners() []string {
+	names := make([]string, len(s.listeners))
+	for i, l := range s.listeners {
+		names[i] = l.name
+	}
+	return names
+}
+
+// Addrs returns the network addresses of the bound listeners
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, l := range s.listeners {
+		addrs[i] = l.Addr()
+	}
+	return addrs
+}
+
+func (s *Server) implicitTLS(port int) bool {
+	return s.config.Server.TLS.Enabled && (port == 465 || port == 993)
+}
+
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	if s.letsencryptMgr != nil {
+		return s.letsencryptMgr.GetTLSConfig(), nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.config.Server.TLS.CertFile, s.config.Server.TLS.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificates: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
 func (s *Server) startListener(port int) (net.Listener, error) {
 	addr := fmt.Sprintf("%s:%d", s.config.Server.Hostname, port)
 	
-	if s.config.Server.TLS.Enabled && (port == 465 || port == 993) {
-		var tlsConfig *tls.Config
-		
-		if s.letsencryptMgr != nil {
-			tlsConfig = s.letsencryptMgr.GetTLSConfig()
-		} else {
-			cert, err := tls.LoadX509KeyPair(s.config.Server.TLS.CertFile, s.config.Server.TLS.KeyFile)
-			if err != nil {
-				return nil, fmt.Errorf("failed to load TLS certificates: %w", err)
-			}
-			
-			tlsConfig = &tls.Config{
-				Certificates: []tls.Certificate{cert},
-			}
+	if s.implicitTLS(port) {
+		tlsConfig, err := s.tlsConfig()
+		if err != nil {
+			return nil, err
 		}
 		
 		return tls.Listen("tcp", addr, tlsConfig)
@@ -140,7 +254,23 @@ func (s *Server) startListener(port int) (net.Listener, error) {
 	return net.Listen("tcp", addr)
 }
 
-func (s *Server) handleListener(listener net.Listener, port int) {
+func startUnixListener(path string) (net.Listener, error) {
+	// Remove a stale socket left behind by a previous run
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	return net.Listen("unix", path)
+}
+
+func (s *Server) closeListeners() {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+}
+
+func (s *Server) handleListener(l *listener) {
 	defer s.wg.Done()
 	
 	for {
@@ -148,34 +278,58 @@ func (s *Server) handleListener(listener net.Listener, port int) {
 		case <-s.shutdown:
 			return
 		default:
-			conn, err := listener.Accept()
+			conn, err := l.Accept()
 			if err != nil {
 				select {
 				case <-s.shutdown:
 					return
 				default:
-					log.Printf("Error accepting connection on port %d: %v", port, err)
+					log.Printf("Error accepting connection on %s: %v", l.name, err)
 					continue
 				}
 			}
 			
-			go s.handleConnection(conn, port)
+			go s.handleConnection(conn, l.name)
 		}
 	}
 }
 
-func (s *Server) handleConnection(conn net.Conn, port int) {
+func (s *Server) handleConnection(conn net.Conn, listenerName string) {
 	defer conn.Close()
 	
 	session := &Session{
-		conn:   conn,
-		reader: bufio.NewReader(conn),
-		writer: bufio.NewWriter(conn),
-		server: s,
-		rcptTo: make([]string, 0),
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		writer:   bufio.NewWriter(conn),
+		server:   s,
+		rcptTo:   make([]string, 0),
+		listener: listenerName,
+	}
+	
+	log.Printf("New connection from %s on %s", conn.RemoteAddr(), listenerName)
+	
+	if s.config.WantsTranscripts(listenerName) {
+		started := time.Now()
+		session.transcript = newTranscript()
+		session.transcript.note("connection from %s on %s", conn.RemoteAddr(), listenerName)
+		defer session.storeRejectedTranscript(started)
 	}
 	
-	log.Printf("New connection from %s on port %d", conn.RemoteAddr(), port)
+	if session.detectEarlyTalker() {
+		log.Printf("Early talker detected from %s on %s", conn.RemoteAddr(), listenerName)
+		session.transcript.note("client sent data before the greeting")
+		if s.config.Server.Tarpit.RejectEarlyTalkers {
+			session.writeResponse(554, "SMTP protocol synchronization error")
+			return
+		}
+		session.penalize(s.config.Server.Tarpit.ErrorThreshold)
+	}
+	
+	if rule := session.findFault("connect", nil, ""); rule != nil {
+		if handled, keepOpen := session.applyFault(rule); handled && !keepOpen {
+			return
+		}
+	}
 	
 	session.sendResponse(220, fmt.Sprintf("%s ESMTP Ready", s.config.Server.Hostname))
 	
@@ -193,6 +347,8 @@ func (s *Server) handleConnection(conn net.Conn, port int) {
 			continue
 		}
 		
+		session.transcript.client(line)
+		
 		parts := strings.SplitN(line, " ", 2)
 		command := strings.ToUpper(parts[0])
 		args := ""
@@ -203,10 +359,19 @@ func (s *Server) handleConnection(conn net.Conn, port int) {
 		if !session.handleCommand(command, args) {
 			break
 		}
+		
+		if session.overHardLimit() {
+			session.disconnectAbusive()
+			break
+		}
 	}
 }
 
 func (s *Session) handleCommand(command, args string) bool {
+	if handled, keepOpen := s.commandFault(command, args); handled {
+		return keepOpen
+	}
+	
 	switch command {
 	case "HELO":
 		return s.handleHelo(args)
@@ -228,14 +393,14 @@ func (s *Session) handleCommand(command, args string) bool {
 		s.sendResponse(250, "OK")
 		return true
 	default:
-		s.sendResponse(500, "Command not recognized")
+		s.sendError(500, "Command not recognized")
 		return true
 	}
 }
 
 func (s *Session) handleHelo(args string) bool {
 	if args == "" {
-		s.sendResponse(501, "HELO requires domain address")
+		s.sendError(501, "HELO requires domain address")
 		return true
 	}
 	
@@ -246,7 +411,7 @@ func (s *Session) handleHelo(args string) bool {
 
 func (s *Session) handleEhlo(args string) bool {
 	if args == "" {
-		s.sendResponse(501, "EHLO requires domain address")
+		s.sendError(501, "EHLO requires domain address")
 		return true
 	}
 	
@@ -282,28 +447,20 @@ func (s *Session) handleStartTLS() bool {
 	
 	s.sendResponse(220, "Ready to start TLS")
 	
-	var tlsConfig *tls.Config
-	
-	if s.server.letsencryptMgr != nil {
-		tlsConfig = s.server.letsencryptMgr.GetTLSConfig()
-	} else {
-		cert, err := tls.LoadX509KeyPair(s.server.config.Server.TLS.CertFile, s.server.config.Server.TLS.KeyFile)
-		if err != nil {
-			log.Printf("Failed to load TLS certificates: %v", err)
-			s.sendResponse(454, "TLS not available")
-			return true
-		}
-		
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		}
+	tlsConfig, err := s.server.tlsConfig()
+	if err != nil {
+		log.Printf("Failed to load TLS certificates: %v", err)
+		s.sendResponse(454, "TLS not available")
+		return true
 	}
 	
 	tlsConn := tls.Server(s.conn, tlsConfig)
 	if err := tlsConn.Handshake(); err != nil {
 		log.Printf("TLS handshake failed: %v", err)
+		s.transcript.note("TLS handshake failed: %v", err)
 		return false
 	}
+	s.transcript.note("TLS handshake completed")
 	
 	s.conn = tlsConn
 	s.reader = bufio.NewReader(tlsConn)
@@ -312,6 +469,7 @@ func (s *Session) handleStartTLS() bool {
 	
 	s.helo = ""
 	s.mailFrom = ""
+	s.inMail = false
 	s.rcptTo = s.rcptTo[:0]
 	
 	return true
@@ -319,40 +477,40 @@ func (s *Session) handleStartTLS() bool {
 
 func (s *Session) handleMail(args string) bool {
 	if s.helo == "" {
-		s.sendResponse(503, "Need HELO first")
+		s.sendError(503, "Need HELO first")
 		return true
 	}
 	
 	if !strings.HasPrefix(strings.ToUpper(args), "FROM:") {
-		s.sendResponse(501, "Syntax error in MAIL command")
+		s.sendError(501, "Syntax error in MAIL command")
 		return true
 	}
 	
-	from := strings.TrimSpace(args[5:])
-	if strings.HasPrefix(from, "<") && strings.HasSuffix(from, ">") {
-		from = from[1 : len(from)-1]
-	}
+	from := parsePath(args, "FROM:")
 	
 	s.mailFrom = from
+	s.inMail = true
 	s.rcptTo = s.rcptTo[:0]
 	s.sendResponse(250, "OK")
 	return true
 }
 
 func (s *Session) handleRcpt(args string) bool {
-	if s.mailFrom == "" {
-		s.sendResponse(503, "Need MAIL first")
+	if !s.inMail {
+		s.sendError(503, "Need MAIL first")
 		return true
 	}
 	
 	if !strings.HasPrefix(strings.ToUpper(args), "TO:") {
-		s.sendResponse(501, "Syntax error in RCPT command")
+		s.sendError(501, "Syntax error in RCPT command")
 		return true
 	}
 	
-	to := strings.TrimSpace(args[3:])
-	if strings.HasPrefix(to, "<") && strings.HasSuffix(to, ">") {
-		to = to[1 : len(to)-1]
+	to := parsePath(args, "TO:")
+	
+	// Unknown recipients are still accepted, but probing counts as an error
+	if s.server.config.Server.Tarpit.Enabled && !s.server.processor.AcceptsRecipient(to) {
+		s.penalize(1)
 	}
 	
 	s.rcptTo = append(s.rcptTo, to)
@@ -362,13 +520,15 @@ func (s *Session) handleRcpt(args string) bool {
 
 func (s *Session) handleData() bool {
 	if len(s.rcptTo) == 0 {
-		s.sendResponse(503, "Need RCPT first")
+		s.sendError(503, "Need RCPT first")
 		return true
 	}
 	
 	s.sendResponse(354, "Start mail input; end with <CRLF>.<CRLF>")
 	
 	var data []byte
+	var fault *faultRule
+	inHeaders := true
 	for {
 		line, err := s.reader.ReadBytes('\n')
 		if err != nil {
@@ -385,28 +545,101 @@ func (s *Session) handleData() bool {
 		}
 		
 		data = append(data, line...)
+		
+		// Fault rules can look at headers, so check them once the header
+		// block is complete. Dropping here cuts the client off mid-DATA.
+		if inHeaders && (string(line) == "\r\n" || string(line) == "\n") {
+			inHeaders = false
+			if fault = s.dataFault(data); fault != nil && fault.Drop {
+				s.transcript.client(summarizeData(data))
+				s.applyFault(fault)
+				return false
+			}
+		}
 	}
 	
 	s.data = data
+	s.transcript.client(summarizeData(data))
+	
+	if inHeaders {
+		fault = s.dataFault(data)
+	}
+	if fault != nil {
+		handled, keepOpen := s.applyFault(fault)
+		if handled {
+			s.mailFrom = ""
+			s.inMail = false
+			s.rcptTo = s.rcptTo[:0]
+			s.data = nil
+			return keepOpen
+		}
+	}
 	
-	err := s.server.processor.ProcessEmail(s.mailFrom, s.rcptTo, data)
+	received := time.Now()
+	envelope := email.Envelope{
+		ID:         email.NewID(received),
+		From:       s.mailFrom,
+		To:         append([]string(nil), s.rcptTo...),
+		Helo:       s.helo,
+		RemoteAddr: s.conn.RemoteAddr().String(),
+		Listener:   s.listener,
+		TLS:        s.tlsEnabled,
+		Received:   received,
+		Transcript: s.transcript.Bytes(),
+	}
+	
+	result, err := s.server.processor.ProcessEnvelope(envelope, data)
+	if result != nil {
+		log.Printf("Processed message %s: %s", result.MessageID, result.Summary())
+	}
 	if err != nil {
 		log.Printf("Error processing email: %v", err)
-		s.sendResponse(554, "Transaction failed")
+		var deliveryErr *email.DeliveryError
+		switch {
+		case errors.As(err, &deliveryErr) && deliveryErr.Code != 0:
+			s.sendResponse(deliveryErr.Code, deliveryErr.Message)
+		case deliveryErr != nil && deliveryErr.Temporary:
+			s.sendResponse(451, "Requested action aborted: local error in processing")
+		default:
+			s.sendResponse(554, "Transaction failed")
+		}
+		s.mailFrom = ""
+		s.inMail = false
+		s.rcptTo = s.rcptTo[:0]
+		s.data = nil
 		return true
 	}
 	
 	s.sendResponse(250, "OK")
+	s.delivered++
 	
 	s.mailFrom = ""
+	s.inMail = false
 	s.rcptTo = s.rcptTo[:0]
 	s.data = nil
 	
 	return true
 }
 
+// parsePath extracts the address from a MAIL FROM or RCPT TO argument
+func parsePath(args, prefix string) string {
+	if len(args) < len(prefix) || !strings.EqualFold(args[:len(prefix)], prefix) {
+		return ""
+	}
+	
+	path := strings.TrimSpace(args[len(prefix):])
+	if strings.HasPrefix(path, "<") {
+		// Drop ESMTP parameters such as BODY=8BITMIME after the path
+		if end := strings.Index(path, ">"); end > 0 {
+			path = path[1:end]
+		}
+	}
+	return path
+}
+
 func (s *Session) handleRset() bool {
 	s.mailFrom = ""
+	s.inMail = false
 	s.rcptTo = s.rcptTo[:0]
 	s.data = nil
 	s.sendResponse(250, "OK")
@@ -419,19 +652,28 @@ func (s *Session) handleQuit() bool {
 }
 
 func (s *Session) sendResponse(code int, message string) {
+	s.tarpit()
+	s.writeResponse(code, message)
+}
+
+func (s *Session) writeResponse(code int, message string) {
+	s.recordResponse(code, fmt.Sprintf("%d %s", code, message))
 	response := fmt.Sprintf("%d %s\r\n", code, message)
 	s.writer.WriteString(response)
 	s.writer.Flush()
 }
 
 func (s *Session) sendMultiLineResponse(code int, messages []string) {
+	s.tarpit()
 	for i, message := range messages {
 		if i == len(messages)-1 {
 			// Last line uses space (final response)
+			s.recordResponse(code, fmt.Sprintf("%d %s", code, message))
 			response := fmt.Sprintf("%d %s\r\n", code, message)
 			s.writer.WriteString(response)
 		} else {
 			// Non-last lines use hyphen (continuation)
+			s.recordResponse(code, fmt.Sprintf("%d-%s", code, message))
 			response := fmt.Sprintf("%d-%s\r\n", code, message)
 			s.writer.WriteString(response)
 		}
@@ -439,6 +681,26 @@ func (s *Session) sendMultiLineResponse(code int, messages []string) {
 	s.writer.Flush()
 }
 
+func (s *Session) recordResponse(code int, line string) {
+	if code >= 400 {
+		s.rejected = true
+	}
+	s.transcript.server(line)
+}
+
+// storeRejectedTranscript keeps the transcript of a session that was
+// refused at some point and never delivered a message.
+func (s *Session) storeRejectedTranscript(started time.Time) {
+	if s.delivered > 0 || !s.rejected || s.server.processor == nil {
+		return
+	}
+
+	s.transcript.note("connection closed")
+	if err := s.server.processor.StoreRejectedTranscript(started, s.conn.RemoteAddr().String(), s.transcript.Bytes()); err != nil {
+		log.Printf("Failed to store rejected session transcript: %v", err)
+	}
+}
+
 func (s *Server) Stop() {
 	close(s.shutdown)
 	
@@ -446,9 +708,7 @@ func (s *Server) Stop() {
 		s.renewalCancel()
 	}
 	
-	for _, listener := range s.listeners {
-		listener.Close()
-	}
+	s.closeListeners()
 	
 	done := make(chan struct{})
 	go func() {
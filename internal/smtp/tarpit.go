@@ -0,0 +1,85 @@
+package smtp
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// detectEarlyTalker waits for the configured pre-greeting delay and reports
+// whether the client sent anything before it was greeted. RFC 5321 clients
+// must wait for the 220 banner, so buffered input at this point is a strong
+// sign of a spam bot pipelining blindly.
+func (s *Session) detectEarlyTalker() bool {
+	tarpit := s.server.config.Server.Tarpit
+	if !tarpit.Enabled || tarpit.PregreetDelayMs <= 0 {
+		return false
+	}
+
+	delay := time.Duration(tarpit.PregreetDelayMs) * time.Millisecond
+	s.conn.SetReadDeadline(time.Now().Add(delay))
+	defer s.conn.SetReadDeadline(time.Time{})
+
+	_, err := s.reader.Peek(1)
+	if err == nil {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+
+	// Any other error (usually EOF) will surface again on the first read
+	return false
+}
+
+// penalize adds points to the session error score.
+func (s *Session) penalize(points int) {
+	if !s.server.config.Server.Tarpit.Enabled {
+		return
+	}
+	s.errorScore += points
+}
+
+// sendError replies with an error code and counts it against the client.
+func (s *Session) sendError(code int, message string) {
+	s.penalize(1)
+	s.sendResponse(code, message)
+}
+
+// tarpitDelay returns how long to wait before the next response. The delay
+// grows by one step for every error point above the threshold.
+func (s *Session) tarpitDelay() time.Duration {
+	tarpit := s.server.config.Server.Tarpit
+	if !tarpit.Enabled || s.errorScore < tarpit.ErrorThreshold {
+		return 0
+	}
+
+	steps := s.errorScore - tarpit.ErrorThreshold + 1
+	delay := time.Duration(steps*tarpit.DelayStepMs) * time.Millisecond
+	if max := time.Duration(tarpit.MaxDelayMs) * time.Millisecond; delay > max {
+		delay = max
+	}
+
+	return delay
+}
+
+func (s *Session) tarpit() {
+	if delay := s.tarpitDelay(); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// overHardLimit reports whether the client has accumulated enough errors to
+// be disconnected.
+func (s *Session) overHardLimit() bool {
+	tarpit := s.server.config.Server.Tarpit
+	return tarpit.Enabled && s.errorScore >= tarpit.HardLimit
+}
+
+func (s *Session) disconnectAbusive() {
+	log.Printf("Disconnecting %s after %d errors", s.conn.RemoteAddr(), s.errorScore)
+	s.writeResponse(421, s.server.config.Server.Hostname+" Too many errors, closing connection")
+}
@@ -0,0 +1,72 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// transcript records an SMTP conversation with timestamps. All methods are
+// safe to call on a nil transcript, which records nothing.
+type transcript struct {
+	buf bytes.Buffer
+}
+
+func newTranscript() *transcript {
+	return &transcript{}
+}
+
+// client records a command sent by the client. Credentials passed to AUTH
+// are never written.
+func (t *transcript) client(line string) {
+	if t == nil {
+		return
+	}
+	t.write("C", redactAuth(line))
+}
+
+// server records a reply line sent by the server
+func (t *transcript) server(line string) {
+	if t == nil {
+		return
+	}
+	t.write("S", line)
+}
+
+// note records an event that is not part of the protocol exchange
+func (t *transcript) note(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.write("*", fmt.Sprintf(format, args...))
+}
+
+func (t *transcript) write(direction, line string) {
+	fmt.Fprintf(&t.buf, "%s %s: %s\n", time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"), direction, line)
+}
+
+// Bytes returns a copy of everything recorded so far
+func (t *transcript) Bytes() []byte {
+	if t == nil {
+		return nil
+	}
+	return append([]byte(nil), t.buf.Bytes()...)
+}
+
+// summarizeData describes message content without recording it
+func summarizeData(data []byte) string {
+	lines := bytes.Count(data, []byte("\n"))
+	return fmt.Sprintf("<message data: %d bytes, %d lines>", len(data), lines)
+}
+
+func redactAuth(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "AUTH") {
+		return line
+	}
+	if len(fields) <= 2 {
+		return line
+	}
+	return fields[0] + " " + fields[1] + " [redacted]"
+}
@@ -0,0 +1,172 @@
+// Package spamd checks messages with SpamAssassin's spamd over the SPAMC
+// protocol.
+package spamd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config describes a spamd daemon
+type Config struct {
+	// Address is "host:port", "tcp://host:port", a socket path or
+	// "unix:///path/to/spamd.sock"
+	Address string
+	// User is the spamd user whose preferences apply; empty uses spamd's
+	// default
+	User string
+	// Timeout bounds one check when the context has no deadline
+	Timeout time.Duration
+}
+
+// Result is the verdict of spamd on one message
+type Result struct {
+	Spam      bool
+	Score     float64
+	Threshold float64
+	// Rules lists the names of the rules that hit
+	Rules []string
+}
+
+// Client checks messages with one spamd daemon. spamd answers one request
+// per connection, so every check connects anew.
+type Client struct {
+	network string
+	address string
+	user    string
+	timeout time.Duration
+}
+
+func NewClient(cfg Config) (*Client, error) {
+	network, address, err := parseAddress(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(cfg.User, "\r\n") {
+		return nil, fmt.Errorf("invalid spamd user %q", cfg.User)
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30 * time.Second
+	}
+
+	return &Client{network: network, address: address, user: cfg.User, timeout: cfg.Timeout}, nil
+}
+
+func parseAddress(address string) (string, string, error) {
+	switch {
+	case address == "":
+		return "", "", fmt.Errorf("spamd address must be specified")
+	case strings.HasPrefix(address, "unix://"):
+		return "unix", strings.TrimPrefix(address, "unix://"), nil
+	case strings.HasPrefix(address, "tcp://"):
+		address = strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "/"):
+		return "unix", address, nil
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", fmt.Errorf("invalid spamd address %q: %w", address, err)
+	}
+	return "tcp", address, nil
+}
+
+// Check sends the message to spamd with the SYMBOLS command and returns the
+// score and the rules that hit
+func (c *Client) Check(ctx context.Context, message []byte) (Result, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to connect to spamd: %w", err)
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n", len(message))
+	if c.user != "" {
+		fmt.Fprintf(w, "User: %s\r\n", c.user)
+	}
+	w.WriteString("\r\n")
+	w.Write(message)
+	if err := w.Flush(); err != nil {
+		return Result{}, fmt.Errorf("failed to send to spamd: %w", err)
+	}
+
+	result, err := readResponse(bufio.NewReader(conn))
+	if err != nil && ctx.Err() != nil {
+		return Result{}, fmt.Errorf("spamd check timed out: %w", ctx.Err())
+	}
+	return result, err
+}
+
+// readResponse parses a reply such as
+//
+//	SPAMD/1.1 0 EX_OK
+//	Content-length: 27
+//	Spam: True ; 15.2 / 5.0
+//
+//	BAYES_99,URIBL_BLOCKED
+func readResponse(r *bufio.Reader) (Result, error) {
+	reader := textproto.NewReader(r)
+	status, err := reader.ReadLine()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to read spamd reply: %w", err)
+	}
+	fields := strings.Fields(status)
+	if len(fields) < 3 || !strings.HasPrefix(fields[0], "SPAMD/") {
+		return Result{}, fmt.Errorf("unexpected spamd reply %q", status)
+	}
+	if fields[1] != "0" {
+		return Result{}, fmt.Errorf("spamd error: %s", strings.Join(fields[1:], " "))
+	}
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return Result{}, fmt.Errorf("failed to read spamd reply: %w", err)
+	}
+
+	var result Result
+	spam, score, ok := strings.Cut(header.Get("Spam"), ";")
+	if !ok {
+		return Result{}, fmt.Errorf("spamd reply has no Spam header")
+	}
+	switch strings.ToLower(strings.TrimSpace(spam)) {
+	case "true", "yes":
+		result.Spam = true
+	}
+	score, threshold, _ := strings.Cut(score, "/")
+	if result.Score, err = strconv.ParseFloat(strings.TrimSpace(score), 64); err != nil {
+		return Result{}, fmt.Errorf("invalid spamd score %q", score)
+	}
+	if result.Threshold, err = strconv.ParseFloat(strings.TrimSpace(threshold), 64); err != nil {
+		return Result{}, fmt.Errorf("invalid spamd threshold %q", threshold)
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to read spamd reply: %w", err)
+	}
+	for _, rule := range strings.Split(string(body), ",") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			result.Rules = append(result.Rules, rule)
+		}
+	}
+	return result, nil
+}
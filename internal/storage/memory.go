@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryBackend keeps stored objects in memory. It is used by the embedded
+// test server, where touching the filesystem or S3 is not wanted. Local and
+// S3 writes land in the same namespace.
+type MemoryBackend struct {
+	mu      sync.RWMutex
+	objects map[string][]byte
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		objects: make(map[string][]byte),
+	}
+}
+
+func (b *MemoryBackend) StoreLocal(path string, data []byte) error {
+	b.put(path, data)
+	return nil
+}
+
+func (b *MemoryBackend) StoreS3(path string, data []byte) error {
+	b.put(path, data)
+	return nil
+}
+
+func (b *MemoryBackend) StoreS3WithContentType(path string, data []byte, contentType string) error {
+	b.put(path, data)
+	return nil
+}
+
+func (b *MemoryBackend) StoreS3WithOptions(path string, data []byte, contentType string, contentEncoding string) error {
+	b.put(path, data)
+	return nil
+}
+
+func (b *MemoryBackend) put(path string, data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[path] = append([]byte(nil), data...)
+}
+
+// Get returns a copy of the object stored at path
+func (b *MemoryBackend) Get(path string) ([]byte, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	data, ok := b.objects[path]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), data...), true
+}
+
+// Paths returns all stored paths in sorted order
+func (b *MemoryBackend) Paths() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	paths := make([]string, 0, len(b.objects))
+	for path := range b.objects {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,66 @@
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd (SD_LISTEN_FDS_START)
+const listenFdsStart = 3
+
+// ActivatedListener is a listening socket inherited from systemd together with
+// the name given to it by FileDescriptorName= in the socket unit.
+type ActivatedListener struct {
+	net.Listener
+	Name string
+}
+
+// Listeners returns the sockets passed in through systemd socket activation.
+// It returns nil when the process was not socket activated. The LISTEN_*
+// variables are cleared so child processes do not inherit them.
+func Listeners() ([]ActivatedListener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	listeners := make([]ActivatedListener, 0, count)
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+
+		name := fmt.Sprintf("fd%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to use socket %s (fd %d): %w", name, fd, err)
+		}
+
+		listeners = append(listeners, ActivatedListener{Listener: listener, Name: name})
+	}
+
+	return listeners, nil
+}
@@ -2,6 +2,7 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -13,25 +14,44 @@ type Client struct {
 }
 
 type EmailPayload struct {
-	From        string              `json:"from"`
-	To          []string            `json:"to"`
-	Subject     string              `json:"subject"`
-	Date        time.Time           `json:"date"`
-	MessageID   string              `json:"message_id"`
-	Body        string              `json:"body"`
-	HTMLBody    string              `json:"html_body"`
-	Markdown    string              `json:"markdown,omitempty"`
-	Headers     map[string][]string `json:"headers"`
-	Attachments []AttachmentInfo    `json:"attachments"`
-	Timestamp   time.Time           `json:"timestamp"`
-	EMLPath     string              `json:"eml_path,omitempty"`
+	ID            string              `json:"id,omitempty"`
+	Recipient     string              `json:"recipient,omitempty"`
+	From          string              `json:"from"`
+	To            []string            `json:"to"`
+	OriginalTo    []string            `json:"original_to,omitempty"`
+	Subject       string              `json:"subject"`
+	Date          time.Time           `json:"date"`
+	MessageID     string              `json:"message_id"`
+	Body          string              `json:"body"`
+	HTMLBody      string              `json:"html_body"`
+	Markdown      string              `json:"markdown,omitempty"`
+	Headers       map[string][]string `json:"headers"`
+	Attachments   []AttachmentInfo    `json:"attachments"`
+	Timestamp     time.Time           `json:"timestamp"`
+	EMLPath       string              `json:"eml_path,omitempty"`
+	MatchedRoutes []string            `json:"matched_routes,omitempty"`
+	// Recipients holds the recipients split into user, tag and domain
+	Recipients any `json:"recipients,omitempty"`
+	// AttachmentPolicy lists the decisions of the route's attachment policy
+	AttachmentPolicy any `json:"attachment_policy,omitempty"`
+	// VirusScan is the result of the route's virus scan
+	VirusScan any `json:"virus_scan,omitempty"`
+	// Spam is the spamd score and the rules that hit
+	Spam any `json:"spam,omitempty"`
+	// Classification is the category predicted by the classifier
+	Classification any `json:"classification,omitempty"`
+	// Duplicate describes the earlier copy when this message is a duplicate
+	Duplicate any `json:"duplicate,omitempty"`
+	// Processing is the processing result, included in stored payloads
+	Processing any `json:"processing,omitempty"`
 }
 
 type AttachmentInfo struct {
-	Filename    string `json:"filename"`
-	ContentType string `json:"content_type"`
-	Size        int64  `json:"size"`
-	S3Path      string `json:"s3_path,omitempty"`
+	Filename         string `json:"filename"`
+	OriginalFilename string `json:"original_filename,omitempty"`
+	ContentType      string `json:"content_type"`
+	Size             int64  `json:"size"`
+	S3Path           string `json:"s3_path,omitempty"`
 }
 
 func NewClient() *Client {
@@ -43,16 +63,23 @@ func NewClient() *Client {
 }
 
 func (c *Client) SendWebhook(url, method string, headers map[string]string, payload EmailPayload) error {
+	_, err := c.SendWebhookContext(context.Background(), url, method, headers, payload)
+	return err
+}
+
+// SendWebhookContext sends the payload, giving up when ctx is done. It returns
+// the response status, or 0 when no response was received.
+func (c *Client) SendWebhookContext(ctx context.Context, url, method string, headers map[string]string, payload EmailPayload) (int, error) {
 	payload.Timestamp = time.Now()
 
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %w", err)
+		return 0, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return 0, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -64,15 +91,15 @@ func (c *Client) SendWebhook(url, method string, headers map[string]string, payl
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send webhook: %w", err)
+		return 0, fmt.Errorf("failed to send webhook: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("webhook returned error status: %d", resp.StatusCode)
+		return resp.StatusCode, fmt.Errorf("webhook returned error status: %d", resp.StatusCode)
 	}
 
-	return nil
+	return resp.StatusCode, nil
 }
 
 func (c *Client) SendWebhookWithRetry(url, method string, headers map[string]string, payload EmailPayload, maxRetries int) error {
@@ -0,0 +1,49 @@
+// Package action describes what a route action is given when it is set up:
+// its configuration, the route it belongs to and the storage it can write
+// to. Programs outside this module use it to implement custom actions and
+// register them with email.RegisterAction.
+package action
+
+// Config is the configuration of one action of a route
+type Config struct {
+	Type    string            `yaml:"type"`
+	Config  map[string]string `yaml:"config"`
+	Enabled bool              `yaml:"enabled"`
+
+	// OnError decides what a failure of this action means for the message:
+	// "continue" (default) runs the remaining actions, "abort" stops the
+	// route and rejects the message permanently, "tempfail" stops the route
+	// and asks the client to retry later
+	OnError string `yaml:"on_error"`
+	// TimeoutMs bounds the action's run time; 0 means no limit
+	TimeoutMs int `yaml:"timeout_ms"`
+}
+
+const (
+	OnErrorContinue = "continue"
+	OnErrorAbort    = "abort"
+	OnErrorTempFail = "tempfail"
+)
+
+// ErrorPolicy returns the action's on_error setting with the default applied
+func (c Config) ErrorPolicy() string {
+	if c.OnError == "" {
+		return OnErrorContinue
+	}
+	return c.OnError
+}
+
+// Route describes the route an action belongs to
+type Route struct {
+	Name     string
+	Priority int
+	// Parallel is set when the route runs its actions concurrently
+	Parallel bool
+}
+
+// Storage writes objects to the storage backends of the server. Paths are
+// relative to the local storage directory or the S3 bucket.
+type Storage interface {
+	StoreLocal(path string, data []byte) error
+	StoreS3(path string, data []byte) error
+}
@@ -0,0 +1,344 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/pkg/action"
+)
+
+// Action is a step a route performs on a matched message. A new instance is
+// created for every configured action, so implementations can keep their
+// parsed configuration in fields.
+type Action interface {
+	// Init configures the action from its route configuration. It is called
+	// once, when the processor is created.
+	Init(env ActionEnv, cfg action.Config) error
+	// Execute runs the action for one message
+	Execute(ctx context.Context, email *Email) error
+}
+
+// Closer is implemented by actions that hold resources, such as connections
+// or retry queues, which are released when the processor is closed
+type Closer interface {
+	Close() error
+}
+
+// ActionEnv gives an action access to the route it belongs to and to the
+// storage shared by the processor
+type ActionEnv struct {
+	Route   action.Route
+	Storage action.Storage
+
+	// The built-in actions also use the full configuration and the processor
+	route     config.RouteConfig
+	config    *config.Config
+	processor *Processor
+}
+
+// ActionFactory creates an unconfigured action
+type ActionFactory func() Action
+
+var (
+	actionsMu sync.RWMutex
+	actions   = make(map[string]ActionFactory)
+)
+
+// RegisterAction makes an action type available to routes under the given
+// name. Custom actions are registered from a main package's init function,
+// before the configuration is loaded:
+//
+//	func init() {
+//		email.RegisterAction("crm_ticket", func() email.Action { return &crmTicket{} })
+//	}
+//
+// It panics if the name is empty or already registered.
+func RegisterAction(name string, factory ActionFactory) {
+	actionsMu.Lock()
+	defer actionsMu.Unlock()
+
+	if name == "" || factory == nil {
+		panic("email: RegisterAction requires a name and a factory")
+	}
+	if _, exists := actions[name]; exists {
+		panic(fmt.Sprintf("email: action %q registered twice", name))
+	}
+
+	actions[name] = factory
+	config.RegisterActionType(name)
+}
+
+// RegisteredActions returns the names of all registered action types
+func RegisteredActions() []string {
+	actionsMu.RLock()
+	defer actionsMu.RUnlock()
+
+	names := make([]string, 0, len(actions))
+	for name := range actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newAction(name string) (Action, bool) {
+	actionsMu.RLock()
+	defer actionsMu.RUnlock()
+
+	factory, ok := actions[name]
+	if !ok {
+		return nil, false
+	}
+	return factory(), true
+}
+
+// routeAction is a configured action instance of a route
+type routeAction struct {
+	config config.Action
+	action Action
+	// screens is set for actions that can refuse or divert the message
+	screens bool
+}
+
+// screener is implemented by the built-in actions that can refuse or divert
+// a message. They run for every matched route before any other action, so a
+// refused message has not been stored, forwarded or posted anywhere.
+type screener interface {
+	screens()
+}
+
+// actionOutcome records how one action fared for a message
+type actionOutcome struct {
+	config   config.Action
+	err      error
+	result   ActionResult
+	payloads []pendingPayload
+	verdict  *Verdict
+}
+
+// DeliveryError reports that a message could not be processed as configured.
+// The SMTP layer answers 451 when it is temporary and 554 otherwise.
+//
+// Actions may return a DeliveryError themselves to classify a failure. With
+// on_error "abort" or "tempfail" the classification then decides the reply.
+type DeliveryError struct {
+	Temporary bool
+	Err       error
+	// Code and Message replace the default reply when set
+	Code    int
+	Message string
+}
+
+func (e *DeliveryError) Error() string {
+	if e.Temporary {
+		return fmt.Sprintf("temporary delivery failure: %v", e.Err)
+	}
+	return fmt.Sprintf("permanent delivery failure: %v", e.Err)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// Verdict is returned from Execute by actions that decide the fate of the
+// message instead of handling it. It stops processing: the remaining actions
+// and routes are skipped. A 4xx or 5xx Code becomes the SMTP reply to the
+// DATA command; zero accepts the message.
+type Verdict struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Route is the route of the deciding action, filled in by the processor
+	Route string `json:"route"`
+}
+
+func (v *Verdict) Error() string {
+	if v.Code == 0 {
+		if v.Message != "" {
+			return v.Message
+		}
+		return "processing stopped"
+	}
+	return fmt.Sprintf("%d %s", v.Code, v.Message)
+}
+
+// deliveryError combines the action outcomes of a message. Failures of
+// actions with on_error "continue" are only reported when nothing succeeded,
+// so a message is never acknowledged without being handled somewhere.
+func deliveryError(outcomes []actionOutcome) error {
+	// A reject or tempfail decision wins over any failure
+	for _, outcome := range outcomes {
+		if verdict := outcome.verdict; verdict != nil && verdict.Code != 0 {
+			return &DeliveryError{
+				Temporary: verdict.Code < 500,
+				Err:       fmt.Errorf("route %s: %s: %w", verdict.Route, outcome.config.Type, verdict),
+				Code:      verdict.Code,
+				Message:   verdict.Message,
+			}
+		}
+	}
+
+	var failures []error
+	succeeded, temporary, permanent := false, false, false
+
+	for _, outcome := range outcomes {
+		if outcome.err == nil {
+			succeeded = true
+			continue
+		}
+
+		failures = append(failures, fmt.Errorf("route %s: %s: %w", outcome.result.Route, outcome.config.Type, outcome.err))
+
+		var classified *DeliveryError
+		if outcome.config.ErrorPolicy() != config.OnErrorContinue && errors.As(outcome.err, &classified) {
+			if classified.Temporary {
+				temporary = true
+			} else {
+				permanent = true
+			}
+			continue
+		}
+
+		switch outcome.config.ErrorPolicy() {
+		case config.OnErrorAbort:
+			permanent = true
+		case config.OnErrorTempFail:
+			temporary = true
+		}
+	}
+
+	switch {
+	case len(failures) == 0:
+		return nil
+	case permanent:
+		return &DeliveryError{Err: errors.Join(failures...)}
+	case temporary || !succeeded:
+		return &DeliveryError{Temporary: true, Err: errors.Join(failures...)}
+	}
+
+	return nil
+}
+
+// runAction executes a single action and records its result
+func runAction(ctx context.Context, route string, bound *routeAction, email *Email) actionOutcome {
+	recorder := &actionRecorder{}
+	started := time.Now()
+	err := executeAction(withRecorder(ctx, recorder), bound, email)
+
+	outcome := actionOutcome{
+		config: bound.config,
+		err:    err,
+		result: ActionResult{
+			Route:    route,
+			Type:     bound.config.Type,
+			Status:   ActionStatusOK,
+			Duration: time.Since(started),
+		},
+	}
+	var verdict *Verdict
+	if errors.As(err, &verdict) {
+		decided := *verdict
+		decided.Route = route
+		outcome.verdict = &decided
+		outcome.err = nil
+	} else if err != nil {
+		outcome.result.Status = ActionStatusFailed
+		outcome.result.Error = err.Error()
+	}
+	outcome.payloads = recorder.snapshot(&outcome.result)
+
+	return outcome
+}
+
+// executeAction runs an action, enforcing its timeout. Actions that ignore
+// their context are abandoned when the timeout passes. A timed action works
+// on its own copy of the message, which is kept only if it finishes in time.
+func executeAction(ctx context.Context, bound *routeAction, email *Email) error {
+	if bound.config.TimeoutMs <= 0 {
+		return bound.action.Execute(ctx, email)
+	}
+
+	timeout := time.Duration(bound.config.TimeoutMs) * time.Millisecond
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	work := email.clone()
+	done := make(chan error, 1)
+	go func() {
+		done <- bound.action.Execute(ctx, work)
+	}()
+
+	select {
+	case err := <-done:
+		*email = *work
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timed out after %v: %w", timeout, ctx.Err())
+	}
+}
+
+// brokenAction stands in for an action whose Init failed, so the failure is
+// reported every time the route runs
+type brokenAction struct {
+	err error
+}
+
+func (a *brokenAction) Init(env ActionEnv, cfg config.Action) error { return nil }
+
+func (a *brokenAction) Execute(ctx context.Context, email *Email) error {
+	return a.err
+}
+
+// bindActions creates and initializes the enabled actions of every route
+func (p *Processor) bindActions() {
+	p.actions = make(map[*config.CompiledRoute][]*routeAction)
+	p.policies = make(map[*config.CompiledRoute]*routeAction)
+
+	for _, route := range p.routes.Routes {
+		env := ActionEnv{
+			Route: action.Route{
+				Name:     route.Name,
+				Priority: route.Priority,
+				Parallel: route.Parallel,
+			},
+			Storage:   p.storageBackend,
+			route:     route.RouteConfig,
+			config:    p.config,
+			processor: p,
+		}
+
+		for _, cfg := range route.Actions {
+			if !cfg.Enabled {
+				continue
+			}
+
+			action, ok := newAction(cfg.Type)
+			if !ok {
+				// Only reachable for configurations built in code; LoadConfig
+				// rejects unknown types
+				action = &brokenAction{err: fmt.Errorf("unknown action type: %s", cfg.Type)}
+			} else if err := action.Init(env, cfg); err != nil {
+				log.Printf("Route %s: %s action is misconfigured and will fail: %v", route.Name, cfg.Type, err)
+				action = &brokenAction{err: fmt.Errorf("%s action is misconfigured: %w", cfg.Type, err)}
+			}
+
+			_, screens := action.(screener)
+			p.actions[route] = append(p.actions[route], &routeAction{config: cfg, action: action, screens: screens})
+		}
+
+		if route.Attachments != nil {
+			policy, err := newAttachmentPolicy(env, *route.Attachments)
+			if err != nil {
+				log.Printf("Route %s: attachment policy is misconfigured and will fail: %v", route.Name, err)
+				cfg := config.Action{Type: "attachment_policy", Enabled: true, OnError: config.OnErrorTempFail}
+				policy = &routeAction{config: cfg, action: &brokenAction{err: fmt.Errorf("attachment policy is misconfigured: %w", err)}, screens: true}
+			}
+			p.policies[route] = policy
+		}
+	}
+}
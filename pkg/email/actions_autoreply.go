@@ -0,0 +1,276 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/relay"
+)
+
+// autoreplyAction acknowledges a message to its sender. It follows RFC 3834:
+// replies go to the envelope sender from the null sender, are marked
+// Auto-Submitted, and are never sent to bounces, list mail or other automatic
+// messages. Each sender gets at most one reply per interval.
+type autoreplyAction struct {
+	processor *Processor
+	client    *relay.Client
+	from      string
+	subject   *texttemplate.Template
+	text      *texttemplate.Template
+	html      *htmltemplate.Template
+	interval  time.Duration
+	seen      *seenCache
+}
+
+// autoreplyData is available to the subject and body templates
+type autoreplyData struct {
+	// From is the address the reply is sent to
+	From      string
+	Subject   string
+	MessageID string
+	// ID identifies the received message, as used in storage paths
+	ID   string
+	To   []string
+	Date time.Time
+}
+
+func (a *autoreplyAction) Init(env ActionEnv, cfg config.Action) error {
+	c := cfg.Config
+
+	if c["from"] == "" {
+		return fmt.Errorf("autoreply from address not specified")
+	}
+	if _, err := mail.ParseAddress(c["from"]); err != nil {
+		return fmt.Errorf("invalid from address %q: %w", c["from"], err)
+	}
+	a.from = c["from"]
+	a.processor = env.processor
+
+	if c["body"] == "" && c["html"] == "" {
+		return fmt.Errorf("autoreply needs a body or html template")
+	}
+
+	subject := c["subject"]
+	if subject == "" {
+		subject = "Auto: {{.Subject}}"
+	}
+
+	var err error
+	if a.subject, err = texttemplate.New("subject").Parse(subject); err != nil {
+		return fmt.Errorf("invalid subject template: %w", err)
+	}
+	if c["body"] != "" {
+		if a.text, err = texttemplate.New("body").Parse(c["body"]); err != nil {
+			return fmt.Errorf("invalid body template: %w", err)
+		}
+	}
+	if c["html"] != "" {
+		if a.html, err = htmltemplate.New("html").Parse(c["html"]); err != nil {
+			return fmt.Errorf("invalid html template: %w", err)
+		}
+	}
+
+	hours, err := intOption(c, "interval_hours", 24)
+	if err != nil {
+		return err
+	}
+	a.interval = time.Duration(hours) * time.Hour
+
+	if a.seen, err = loadSeenCache(c["cache_file"]); err != nil {
+		return err
+	}
+	if c["cache_file"] == "" {
+		log.Printf("Autoreply on route %s keeps its rate limit in memory only; set cache_file to persist it", env.Route.Name)
+	}
+
+	if a.client, err = smarthostClient(env, c); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (a *autoreplyAction) Execute(ctx context.Context, email *Email) error {
+	recipient := email.Envelope.From
+	if reason := a.suppressed(email); reason != "" {
+		log.Printf("Not auto-replying to %q: %s", recipient, reason)
+		return nil
+	}
+
+	if !a.seen.reserve(recipient, a.interval, time.Now()) {
+		log.Printf("Not auto-replying to %s: already replied within %v", recipient, a.interval)
+		return nil
+	}
+
+	data := autoreplyData{
+		From:      recipient,
+		Subject:   email.Subject,
+		MessageID: email.MessageID,
+		ID:        a.processor.generateUniqueID(email),
+		To:        email.Envelope.To,
+		Date:      email.Date,
+	}
+
+	message, err := a.compose(email, data)
+	if err == nil {
+		// The null sender keeps replies to the reply from looping back to us
+		err = a.client.Send(ctx, &relay.Message{From: "", To: []string{recipient}, Data: message})
+	}
+	if err != nil {
+		a.seen.release(recipient)
+		return fmt.Errorf("autoreply action failed: %w", err)
+	}
+
+	if err := a.seen.save(); err != nil {
+		log.Printf("Failed to save autoreply cache: %v", err)
+	}
+	log.Printf("Sent autoreply to %s for message %s", recipient, email.MessageID)
+
+	return nil
+}
+
+// suppressed returns why no reply may be sent for a message, or ""
+func (a *autoreplyAction) suppressed(email *Email) string {
+	sender := strings.ToLower(email.Envelope.From)
+	if sender == "" {
+		return "null sender"
+	}
+
+	local := sender
+	if at := strings.LastIndex(sender, "@"); at >= 0 {
+		local = sender[:at]
+	}
+	switch {
+	case local == "mailer-daemon" || local == "postmaster" || local == "listserv" || local == "majordomo":
+		return "sender is a mail system address"
+	case strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") || strings.HasSuffix(local, "-bounces"):
+		return "sender is a list address"
+	}
+
+	if own, err := mail.ParseAddress(a.from); err == nil && strings.EqualFold(own.Address, sender) {
+		return "message comes from our own address"
+	}
+
+	header := func(name string) string {
+		if values := email.Headers[name]; len(values) > 0 {
+			return strings.ToLower(strings.TrimSpace(values[0]))
+		}
+		return ""
+	}
+
+	if value := header("Auto-Submitted"); value != "" && value != "no" {
+		return "message is Auto-Submitted: " + value
+	}
+	switch header("Precedence") {
+	case "bulk", "list", "junk":
+		return "message has bulk precedence"
+	}
+	for _, name := range []string{"List-Id", "List-Unsubscribe", "List-Post", "X-Auto-Response-Suppress", "X-Autoreply", "X-Autorespond"} {
+		if len(email.Headers[name]) > 0 {
+			return "message has a " + name + " header"
+		}
+	}
+	if strings.HasPrefix(header("Content-Type"), "multipart/report") {
+		return "message is a delivery report"
+	}
+
+	return ""
+}
+
+// compose renders the reply message
+func (a *autoreplyAction) compose(email *Email, data autoreplyData) ([]byte, error) {
+	var subject bytes.Buffer
+	if err := a.subject.Execute(&subject, data); err != nil {
+		return nil, fmt.Errorf("failed to render subject: %w", err)
+	}
+
+	var text, html bytes.Buffer
+	if a.text != nil {
+		if err := a.text.Execute(&text, data); err != nil {
+			return nil, fmt.Errorf("failed to render body: %w", err)
+		}
+	}
+	if a.html != nil {
+		if err := a.html.Execute(&html, data); err != nil {
+			return nil, fmt.Errorf("failed to render html: %w", err)
+		}
+	}
+
+	var msg bytes.Buffer
+	writeHeader := func(name, value string) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", name, value)
+	}
+
+	writeHeader("From", a.from)
+	writeHeader("To", data.From)
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	writeHeader("Date", time.Now().Format(time.RFC1123Z))
+	writeHeader("Message-ID", newMessageID(a.from))
+	if email.MessageID != "" {
+		writeHeader("In-Reply-To", email.MessageID)
+		writeHeader("References", email.MessageID)
+	}
+	writeHeader("Auto-Submitted", "auto-replied")
+	writeHeader("MIME-Version", "1.0")
+
+	switch {
+	case a.text != nil && a.html != nil:
+		boundary := randomToken()
+		writeHeader("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", boundary))
+		msg.WriteString("\r\n")
+		for _, part := range []struct {
+			contentType string
+			body        []byte
+		}{{"text/plain", text.Bytes()}, {"text/html", html.Bytes()}} {
+			fmt.Fprintf(&msg, "--%s\r\n", boundary)
+			writePart(&msg, part.contentType, part.body)
+		}
+		fmt.Fprintf(&msg, "--%s--\r\n", boundary)
+	case a.html != nil:
+		writePart(&msg, "text/html", html.Bytes())
+	default:
+		writePart(&msg, "text/plain", text.Bytes())
+	}
+
+	return msg.Bytes(), nil
+}
+
+// writePart writes the content headers and quoted-printable body of a part
+func writePart(msg *bytes.Buffer, contentType string, body []byte) {
+	fmt.Fprintf(msg, "Content-Type: %s; charset=utf-8\r\n", contentType)
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	w := quotedprintable.NewWriter(msg)
+	w.Write(body)
+	w.Close()
+	msg.WriteString("\r\n")
+}
+
+// newMessageID returns a Message-ID in the domain of the given address
+func newMessageID(from string) string {
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(addr.Address, "@"); at >= 0 {
+			domain = addr.Address[at+1:]
+		}
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), randomToken(), domain)
+}
+
+func randomToken() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,85 @@
+package email
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/slav123/email-catch/internal/config"
+)
+
+func init() {
+	RegisterAction("store_local", func() Action { return &localStorageAction{} })
+	RegisterAction("store_s3", func() Action { return &s3StorageAction{} })
+	RegisterAction("webhook", func() Action { return &webhookAction{} })
+	RegisterAction("forward", func() Action { return &forwardAction{} })
+	RegisterAction("autoreply", func() Action { return &autoreplyAction{} })
+	RegisterAction("exec", func() Action { return &execAction{} })
+	RegisterAction("modify", func() Action { return &modifyAction{} })
+	RegisterAction("reject", newRejectAction)
+	RegisterAction("tempfail", newTempFailAction)
+	RegisterAction("quarantine", func() Action { return &quarantineAction{} })
+	RegisterAction("scan_clamav", func() Action { return &clamavAction{} })
+}
+
+// localStorageAction stores the EML, attachments and JSON payload on disk
+type localStorageAction struct {
+	env ActionEnv
+	cfg config.Action
+}
+
+func (a *localStorageAction) Init(env ActionEnv, cfg config.Action) error {
+	if err := validatePathTemplate(cfg.Config["path_template"]); err != nil {
+		return err
+	}
+	a.env, a.cfg = env, cfg
+	return nil
+}
+
+func (a *localStorageAction) Execute(ctx context.Context, email *Email) error {
+	if err := a.env.processor.executeLocalStorage(ctx, email, a.env.route, a.cfg); err != nil {
+		return fmt.Errorf("local storage action failed: %w", err)
+	}
+	return nil
+}
+
+// s3StorageAction stores the EML, attachments and JSON payload in S3
+type s3StorageAction struct {
+	env ActionEnv
+	cfg config.Action
+}
+
+func (a *s3StorageAction) Init(env ActionEnv, cfg config.Action) error {
+	if err := validatePathTemplate(cfg.Config["path_template"]); err != nil {
+		return err
+	}
+	a.env, a.cfg = env, cfg
+	return nil
+}
+
+func (a *s3StorageAction) Execute(ctx context.Context, email *Email) error {
+	if err := a.env.processor.executeS3Storage(ctx, email, a.env.route, a.cfg); err != nil {
+		return fmt.Errorf("S3 storage action failed: %w", err)
+	}
+	return nil
+}
+
+// webhookAction posts the JSON payload to a URL
+type webhookAction struct {
+	env ActionEnv
+	cfg config.Action
+}
+
+func (a *webhookAction) Init(env ActionEnv, cfg config.Action) error {
+	if cfg.Config["url"] == "" {
+		return fmt.Errorf("webhook URL not specified")
+	}
+	a.env, a.cfg = env, cfg
+	return nil
+}
+
+func (a *webhookAction) Execute(ctx context.Context, email *Email) error {
+	if err := a.env.processor.executeWebhook(ctx, email, a.cfg); err != nil {
+		return fmt.Errorf("webhook action failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/slav123/email-catch/internal/clamav"
+	"github.com/slav123/email-catch/internal/config"
+)
+
+// Outcomes of a virus scan
+const (
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanError    = "error"
+)
+
+// VirusScan is the result of scanning a message for viruses
+type VirusScan struct {
+	Scanner string `json:"scanner"`
+	Status  string `json:"status"`
+	// Signature and Part name the virus found and where: "message" or an
+	// attachment filename
+	Signature string `json:"signature,omitempty"`
+	Part      string `json:"part,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// clamavAction scans the message and each attachment with clamd and acts on
+// infected messages. It screens the message, so it runs before the other
+// actions of every route.
+//
+// Options:
+//   - address: clamd as "host:port", "tcp://host:port" or "unix:///path"
+//   - on_infected: "reject" (default), "quarantine" or "tag"
+//   - fail: "closed" (default) answers 451 when clamd cannot scan the
+//     message, "open" lets the message through unscanned
+//   - pool_size: idle clamd connections kept for reuse, 4 by default
+//   - quarantine_folder: with on_infected quarantine, "quarantine" by default
+//   - subject_prefix: with on_infected tag, put in front of the subject of
+//     infected messages
+//
+// Tagging adds X-Virus-Scanned and X-Virus-Status headers.
+type clamavAction struct {
+	client        *clamav.Client
+	onInfected    string
+	failOpen      bool
+	subjectPrefix string
+	quarantine    *quarantineAction
+}
+
+func (a *clamavAction) Init(env ActionEnv, cfg config.Action) error {
+	if env.Route.Parallel {
+		return fmt.Errorf("scan_clamav actions cannot run in a parallel route")
+	}
+
+	poolSize := 0
+	if value := cfg.Config["pool_size"]; value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 {
+			return fmt.Errorf("invalid pool_size %q", value)
+		}
+		poolSize = size
+	}
+
+	client, err := clamav.NewClient(clamav.Config{
+		Address: cfg.Config["address"],
+		Timeout: time.Duration(cfg.TimeoutMs) * time.Millisecond,
+		MaxIdle: poolSize,
+	})
+	if err != nil {
+		return err
+	}
+	a.client = client
+
+	switch cfg.Config["fail"] {
+	case "", "closed":
+	case "open":
+		a.failOpen = true
+	default:
+		return fmt.Errorf("invalid fail %q, expected open or closed", cfg.Config["fail"])
+	}
+
+	a.onInfected = cfg.Config["on_infected"]
+	switch a.onInfected {
+	case "":
+		a.onInfected = "reject"
+	case "reject", "tag":
+	case "quarantine":
+		folder := cfg.Config["quarantine_folder"]
+		if folder == "" {
+			folder = "quarantine"
+		}
+		a.quarantine = &quarantineAction{}
+		if err := a.quarantine.Init(env, config.Action{Config: map[string]string{"folder": folder}}); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid on_infected %q, expected reject, quarantine or tag", a.onInfected)
+	}
+	a.subjectPrefix = cfg.Config["subject_prefix"]
+
+	return nil
+}
+
+func (a *clamavAction) Execute(ctx context.Context, email *Email) error {
+	scan := a.scan(ctx, email)
+	email.VirusScan = scan
+
+	if scan.Status == ScanError {
+		if !a.failOpen {
+			log.Printf("Virus scan of %s failed: %s", email.Envelope.ID, scan.Error)
+			return &Verdict{Code: 451, Message: "4.7.1 Unable to scan message for viruses, please try again later"}
+		}
+		log.Printf("Virus scan of %s failed, accepting it unscanned: %s", email.Envelope.ID, scan.Error)
+	}
+
+	if scan.Status == ScanInfected {
+		log.Printf("Virus %s found in %s of %s", scan.Signature, scan.Part, email.Envelope.ID)
+		switch a.onInfected {
+		case "reject":
+			return &Verdict{Code: 550, Message: "5.7.1 Message contains a virus"}
+		case "quarantine":
+			return a.quarantine.Execute(ctx, email)
+		}
+	}
+
+	if a.onInfected == "tag" {
+		return a.tag(email, scan)
+	}
+	return nil
+}
+
+func (a *clamavAction) screens() {}
+
+// Close ends the pooled clamd sessions
+func (a *clamavAction) Close() error {
+	return a.client.Close()
+}
+
+// scan checks the message as received, then each decoded attachment, and
+// stops at the first infection
+func (a *clamavAction) scan(ctx context.Context, email *Email) *VirusScan {
+	scan := &VirusScan{Scanner: "clamav", Status: ScanClean}
+
+	check := func(part string, data []byte) bool {
+		result, err := a.client.Scan(ctx, data)
+		switch {
+		case err != nil:
+			scan.Status, scan.Error = ScanError, err.Error()
+		case result.Infected:
+			scan.Status, scan.Signature, scan.Part = ScanInfected, result.Signature, part
+		default:
+			return true
+		}
+		return false
+	}
+
+	if !check("message", email.Raw) {
+		return scan
+	}
+	for _, attachment := range email.Attachments {
+		if !check(attachment.Filename, attachment.Content) {
+			return scan
+		}
+	}
+	return scan
+}
+
+func (a *clamavAction) tag(email *Email, scan *VirusScan) error {
+	msg := splitRawMessage(email.ToEML())
+
+	switch scan.Status {
+	case ScanInfected:
+		msg.set("X-Virus-Scanned", "ClamAV")
+		msg.set("X-Virus-Status", headerValue(fmt.Sprintf("Infected (%s in %s)", scan.Signature, scan.Part)))
+		prefixSubject(msg, email, a.subjectPrefix)
+	case ScanError:
+		msg.set("X-Virus-Status", "Unscanned")
+	default:
+		msg.set("X-Virus-Scanned", "ClamAV")
+		msg.set("X-Virus-Status", "Clean")
+	}
+
+	return email.setModified(msg.bytes())
+}
@@ -0,0 +1,183 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+)
+
+// exitTempFail is EX_TEMPFAIL from sysexits.h, used by MDAs and filters to
+// ask for the message to be retried later
+const exitTempFail = 75
+
+// execAction pipes the message to a local program, like a procmail or
+// .forward pipe. The program gets the raw message or the JSON payload on
+// stdin and the message details in EMAILCATCH_* environment variables.
+type execAction struct {
+	processor *Processor
+	route     string
+	command   []string
+	dir       string
+	stdin     string
+	timeout   time.Duration
+	maxOutput int
+}
+
+func (a *execAction) Init(env ActionEnv, cfg config.Action) error {
+	c := cfg.Config
+
+	a.command = strings.Fields(c["command"])
+	if len(a.command) == 0 {
+		return fmt.Errorf("exec command not specified")
+	}
+
+	a.stdin = c["stdin"]
+	switch a.stdin {
+	case "":
+		a.stdin = "eml"
+	case "eml", "json":
+	default:
+		return fmt.Errorf("invalid stdin %q, expected eml or json", a.stdin)
+	}
+
+	maxOutput, err := intOption(c, "max_output_bytes", 64*1024)
+	if err != nil {
+		return err
+	}
+
+	// The action-level timeout_ms already applies; this keeps a runaway
+	// program from blocking delivery when none is set
+	a.timeout = 60 * time.Second
+	if cfg.TimeoutMs > 0 {
+		a.timeout = time.Duration(cfg.TimeoutMs) * time.Millisecond
+	}
+
+	a.processor = env.processor
+	a.route = env.Route.Name
+	a.dir = c["dir"]
+	a.maxOutput = maxOutput
+
+	return nil
+}
+
+func (a *execAction) Execute(ctx context.Context, email *Email) error {
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	stdin := email.ToEML()
+	if a.stdin == "json" {
+		data, err := json.Marshal(a.processor.buildPayload(email, a.processor.defaultFolderPath(email)))
+		if err != nil {
+			return fmt.Errorf("failed to marshal payload: %w", err)
+		}
+		stdin = data
+	}
+
+	output := &cappedBuffer{max: a.maxOutput}
+	cmd := exec.CommandContext(ctx, a.command[0], a.command[1:]...)
+	cmd.Dir = a.dir
+	cmd.Env = append(os.Environ(), a.environment(email)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// Do not wait forever on children that inherited the output pipe
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if output.Len() > 0 {
+		log.Printf("exec %s output: %s", a.command[0], output.String())
+	}
+	if err == nil {
+		return nil
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return &DeliveryError{Temporary: true, Err: fmt.Errorf("exec %s timed out after %v", a.command[0], a.timeout)}
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return &DeliveryError{Temporary: true, Err: fmt.Errorf("failed to run %s: %w", a.command[0], err)}
+	}
+
+	failure := fmt.Errorf("exec %s exited with status %d: %s", a.command[0], exitErr.ExitCode(), output.Summary())
+	return &DeliveryError{Temporary: exitErr.ExitCode() == exitTempFail, Err: failure}
+}
+
+// environment returns the EMAILCATCH_* variables describing the message
+func (a *execAction) environment(email *Email) []string {
+	env := email.Envelope
+	vars := map[string]string{
+		"FROM":        env.From,
+		"TO":          strings.Join(env.To, ","),
+		"HELO":        env.Helo,
+		"REMOTE_ADDR": env.RemoteAddr,
+		"LISTENER":    env.Listener,
+		"TLS":         strconv.FormatBool(env.TLS),
+		"HEADER_FROM": email.From,
+		"HEADER_TO":   strings.Join(email.To, ","),
+		"SUBJECT":     email.Subject,
+		"MESSAGE_ID":  email.MessageID,
+		"DATE":        email.Date.Format(time.RFC3339),
+		"SIZE":        strconv.Itoa(len(email.Raw)),
+		"ATTACHMENTS": strconv.Itoa(len(email.Attachments)),
+		"ID":          a.processor.generateUniqueID(email),
+		"ROUTE":       a.route,
+		"ROUTES":      strings.Join(email.MatchedRoutes, ","),
+	}
+
+	result := make([]string, 0, len(vars))
+	for name, value := range vars {
+		// Header values may contain newlines, which do not belong in the environment
+		value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+		result = append(result, "EMAILCATCH_"+name+"="+value)
+	}
+	return result
+}
+
+// cappedBuffer keeps at most max bytes of a program's output. It wraps
+// bytes.Buffer rather than embedding it, so io.Copy cannot bypass the cap
+// through ReadFrom.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *cappedBuffer) Len() int {
+	return b.buf.Len()
+}
+
+func (b *cappedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + " [output truncated]"
+	}
+	return b.buf.String()
+}
+
+// Summary returns the last line of output, which usually explains a failure
+func (b *cappedBuffer) Summary() string {
+	lines := strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+	return lines[len(lines)-1]
+}
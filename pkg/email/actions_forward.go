@@ -0,0 +1,153 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/relay"
+)
+
+// forwardAction re-sends the message through an upstream SMTP server.
+// Temporary failures are retried in the background, so capturing a message
+// never waits on the upstream being available.
+type forwardAction struct {
+	client *relay.Client
+	queue  *relay.Queue
+	srs    *relay.SRS
+	from   string
+	to     []string
+}
+
+func (a *forwardAction) Init(env ActionEnv, cfg config.Action) error {
+	c := cfg.Config
+
+	retries, err := intOption(c, "max_retries", 5)
+	if err != nil {
+		return err
+	}
+	retryDelay, err := intOption(c, "retry_delay_ms", 60000)
+	if err != nil {
+		return err
+	}
+
+	if a.client, err = smarthostClient(env, c); err != nil {
+		return err
+	}
+
+	if c["srs_domain"] != "" {
+		if a.srs, err = relay.NewSRS(c["srs_domain"], c["srs_secret"]); err != nil {
+			return err
+		}
+	}
+
+	a.from = c["from"]
+	for _, rcpt := range strings.Split(c["to"], ",") {
+		if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+			a.to = append(a.to, rcpt)
+		}
+	}
+
+	a.queue = relay.NewQueue(a.client.Send, retries, time.Duration(retryDelay)*time.Millisecond)
+
+	return nil
+}
+
+func (a *forwardAction) Execute(ctx context.Context, email *Email) error {
+	msg := &relay.Message{
+		From: a.sender(email),
+		To:   a.recipients(email),
+		Data: email.ToEML(),
+	}
+
+	err := a.client.Send(ctx, msg)
+	if err == nil {
+		log.Printf("Forwarded message %s to %v via %s", email.MessageID, msg.To, a.client.Addr())
+		return nil
+	}
+
+	if !relay.IsPermanent(err) && ctx.Err() == nil && a.queue.Enqueue(msg) {
+		log.Printf("Forwarding message %s via %s failed, queued for retry: %v", email.MessageID, a.client.Addr(), err)
+		return nil
+	}
+
+	return &DeliveryError{
+		Temporary: !relay.IsPermanent(err),
+		Err:       fmt.Errorf("forward action failed: %w", err),
+	}
+}
+
+// Close stops retrying queued messages
+func (a *forwardAction) Close() error {
+	a.queue.Close()
+	return nil
+}
+
+// sender returns the envelope sender: the configured one, or the original
+// sender rewritten with SRS when enabled
+func (a *forwardAction) sender(email *Email) string {
+	if a.from != "" {
+		return a.from
+	}
+
+	from := email.Envelope.From
+	if a.srs != nil {
+		from = a.srs.Rewrite(from)
+	}
+	return from
+}
+
+// recipients returns the configured recipients, or the original envelope
+// recipients when the action does not rewrite them
+func (a *forwardAction) recipients(email *Email) []string {
+	if len(a.to) > 0 {
+		return a.to
+	}
+	if len(email.Envelope.To) > 0 {
+		return email.Envelope.To
+	}
+	return email.To
+}
+
+// smarthostClient creates a relay client from the smarthost options shared
+// by actions that send mail: host, port, tls, insecure_skip_verify,
+// username, password and helo
+func smarthostClient(env ActionEnv, options map[string]string) (*relay.Client, error) {
+	port, err := intOption(options, "port", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	helo := options["helo"]
+	if helo == "" && env.config != nil {
+		helo = env.config.Server.Hostname
+	}
+
+	return relay.NewClient(relay.Config{
+		Host:               options["host"],
+		Port:               port,
+		TLS:                options["tls"],
+		InsecureSkipVerify: options["insecure_skip_verify"] == "true",
+		Username:           options["username"],
+		Password:           options["password"],
+		Helo:               helo,
+	})
+}
+
+// intOption parses an integer action option, returning def when it is unset
+func intOption(options map[string]string, key string, def int) (int, error) {
+	value := options[key]
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,150 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/mail"
+	"sort"
+	"strings"
+
+	"github.com/slav123/email-catch/internal/config"
+)
+
+// modifyAction edits the headers of the message for the actions after it in
+// the same route, e.g. to tag the subject before storing or forwarding.
+// Email.Raw keeps the message as received.
+//
+// Options:
+//   - remove_headers: comma-separated header names to delete
+//   - set.<Header>: replace the header, adding it if missing
+//   - add.<Header>: add the header at the top, keeping existing ones
+//   - subject_prefix: put text in front of the subject, unless it is there
+//
+// Header values may use the path_template variables, e.g. {{route}}.
+type modifyAction struct {
+	env           ActionEnv
+	remove        []string
+	set           []headerEdit
+	add           []headerEdit
+	subjectPrefix string
+}
+
+type headerEdit struct {
+	name  string
+	value string
+}
+
+func (a *modifyAction) Init(env ActionEnv, cfg config.Action) error {
+	if env.Route.Parallel {
+		return fmt.Errorf("modify actions cannot run in a parallel route")
+	}
+	a.env = env
+
+	for _, name := range strings.Split(cfg.Config["remove_headers"], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			a.remove = append(a.remove, name)
+		}
+	}
+	a.subjectPrefix = cfg.Config["subject_prefix"]
+
+	// Map order is random; apply edits in a stable order
+	keys := make([]string, 0, len(cfg.Config))
+	for key := range cfg.Config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		kind, name, ok := strings.Cut(key, ".")
+		if !ok || (kind != "set" && kind != "add") {
+			continue
+		}
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name in %s", key)
+		}
+		value := cfg.Config[key]
+		if err := validateVariables(value, key); err != nil {
+			return err
+		}
+
+		if kind == "set" {
+			a.set = append(a.set, headerEdit{name, value})
+		} else {
+			a.add = append(a.add, headerEdit{name, value})
+		}
+	}
+
+	if len(a.remove) == 0 && len(a.set) == 0 && len(a.add) == 0 && a.subjectPrefix == "" {
+		return fmt.Errorf("modify action has nothing to change")
+	}
+	return nil
+}
+
+func (a *modifyAction) Execute(ctx context.Context, email *Email) error {
+	msg := splitRawMessage(email.ToEML())
+	values := a.env.processor.pathValues(email, a.env.Route.Name, "")
+
+	for _, name := range a.remove {
+		msg.remove(name)
+	}
+	for _, edit := range a.set {
+		msg.set(edit.name, headerValue(expandVariables(edit.value, values, stripNewlines)))
+	}
+	for _, edit := range a.add {
+		msg.add(edit.name, headerValue(expandVariables(edit.value, values, stripNewlines)))
+	}
+
+	prefixSubject(msg, email, a.subjectPrefix)
+
+	return email.setModified(msg.bytes())
+}
+
+// prefixSubject puts prefix in front of the subject, unless it is there
+func prefixSubject(msg *rawMessage, email *Email, prefix string) {
+	if prefix == "" || strings.HasPrefix(email.Subject, prefix) {
+		return
+	}
+	subject, _ := msg.get("Subject")
+	if encoded := headerValue(prefix); encoded != prefix {
+		prefix = encoded + " "
+	}
+	msg.set("Subject", prefix+subject)
+}
+
+// setModified replaces the message with modified and updates the headers
+// and subject to match
+func (e *Email) setModified(modified []byte) error {
+	parsed, err := mail.ReadMessage(bytes.NewReader(modified))
+	if err != nil {
+		return fmt.Errorf("modified message is invalid: %w", err)
+	}
+
+	e.Modified = modified
+	e.Headers = decodeHeaders(parsed.Header)
+	e.Subject = decodeMIMEHeader(parsed.Header.Get("Subject"))
+	return nil
+}
+
+// headerValue encodes non-ASCII text as an RFC 2047 encoded word and keeps
+// values on one line
+func headerValue(value string) string {
+	return mime.QEncoding.Encode("utf-8", stripNewlines(value))
+}
+
+func stripNewlines(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || r == ':' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/slav123/email-catch/internal/config"
+)
+
+// replyAction answers the DATA command with a configured reply instead of
+// accepting the message. It backs both reject (5xx) and tempfail (4xx).
+//
+// Options:
+//   - code: the reply code, 550 for reject and 451 for tempfail by default
+//   - message: the reply text
+type replyAction struct {
+	class   int
+	verdict Verdict
+}
+
+func newRejectAction() Action {
+	return &replyAction{class: 5, verdict: Verdict{Code: 550, Message: "Message rejected"}}
+}
+
+func newTempFailAction() Action {
+	return &replyAction{class: 4, verdict: Verdict{Code: 451, Message: "Temporary failure, please try again later"}}
+}
+
+func (a *replyAction) Init(env ActionEnv, cfg config.Action) error {
+	if value := cfg.Config["code"]; value != "" {
+		code, err := strconv.Atoi(value)
+		if err != nil || code/100 != a.class {
+			return fmt.Errorf("invalid code %q, expected %dxx", value, a.class)
+		}
+		a.verdict.Code = code
+	}
+
+	if message := cfg.Config["message"]; message != "" {
+		if strings.ContainsAny(message, "\r\n") {
+			return fmt.Errorf("message must be a single line")
+		}
+		a.verdict.Message = message
+	}
+	return nil
+}
+
+func (a *replyAction) Execute(ctx context.Context, email *Email) error {
+	verdict := a.verdict
+	return &verdict
+}
+
+func (a *replyAction) screens() {}
+
+// quarantineAction stores the message in a quarantine folder and stops
+// processing, so no other route sees it. The message is still accepted.
+//
+// Options:
+//   - folder: defaults to "quarantine"
+//   - storage: "local" or "s3"; defaults to local storage when enabled
+//   - path_template: as for the storage actions
+type quarantineAction struct {
+	env ActionEnv
+	cfg config.Action
+	s3  bool
+}
+
+func (a *quarantineAction) Init(env ActionEnv, cfg config.Action) error {
+	if err := validatePathTemplate(cfg.Config["path_template"]); err != nil {
+		return err
+	}
+
+	switch cfg.Config["storage"] {
+	case "":
+		a.s3 = !env.config.Storage.Local.Enabled
+	case "local":
+	case "s3":
+		a.s3 = true
+	default:
+		return fmt.Errorf("invalid storage %q, expected local or s3", cfg.Config["storage"])
+	}
+
+	options := make(map[string]string, len(cfg.Config)+1)
+	for key, value := range cfg.Config {
+		options[key] = value
+	}
+	if options["folder"] == "" {
+		options["folder"] = "quarantine"
+	}
+	cfg.Config = options
+
+	a.env, a.cfg = env, cfg
+	return nil
+}
+
+func (a *quarantineAction) screens() {}
+
+func (a *quarantineAction) Execute(ctx context.Context, email *Email) error {
+	var err error
+	if a.s3 {
+		err = a.env.processor.executeS3Storage(ctx, email, a.env.route, a.cfg)
+	} else {
+		err = a.env.processor.executeLocalStorage(ctx, email, a.env.route, a.cfg)
+	}
+	if err != nil {
+		return fmt.Errorf("quarantine failed: %w", err)
+	}
+	return &Verdict{Message: "quarantined"}
+}
@@ -0,0 +1,47 @@
+package email
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Address is a recipient split into user, subaddress tag and domain, e.g.
+// capture+order123@example.com is {capture, order123, example.com}
+type Address struct {
+	User   string `json:"user"`
+	Tag    string `json:"tag,omitempty"`
+	Domain string `json:"domain"`
+}
+
+// ParseAddress splits address at its last '@' and the local part at the
+// first of the separator characters. The domain is lowercased.
+func ParseAddress(address, separators string) Address {
+	local := localPart(address)
+	addr := Address{User: local, Domain: domainPart(address)}
+
+	// A leading separator is part of the user, not an empty user with a tag
+	if i := strings.IndexAny(local, separators); i > 0 {
+		_, size := utf8.DecodeRuneInString(local[i:])
+		addr.User = local[:i]
+		addr.Tag = local[i+size:]
+	}
+	return addr
+}
+
+// recipientAddresses returns the parsed envelope recipients. Messages built
+// in code without going through the processor are parsed with the default
+// separator.
+func (e *Email) recipientAddresses() []Address {
+	if len(e.Recipients) == len(e.To) {
+		return e.Recipients
+	}
+	return parseAddresses(e.To, "+")
+}
+
+func parseAddresses(addresses []string, separators string) []Address {
+	parsed := make([]Address, len(addresses))
+	for i, address := range addresses {
+		parsed[i] = ParseAddress(address, separators)
+	}
+	return parsed
+}
@@ -0,0 +1,149 @@
+package email
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// maxAliasDepth bounds alias chains, so a loop cannot expand forever
+const maxAliasDepth = 10
+
+// aliasTable rewrites recipients before routing. The file has one alias per
+// line, a source address followed by its targets separated by commas or
+// spaces; "@domain" as the source catches every address of that domain.
+// The file is read again whenever its size or modification time changes.
+type aliasTable struct {
+	separators string
+
+	mu      sync.Mutex
+	file    watchedFile
+	entries map[string][]string
+}
+
+func newAliasTable(path, separators string) (*aliasTable, error) {
+	table := &aliasTable{separators: separators}
+	table.file = watchedFile{path: path, load: table.load}
+
+	if _, err := os.Stat(path); err != nil {
+		return table, fmt.Errorf("failed to read alias file: %w", err)
+	}
+	return table, table.file.refresh()
+}
+
+func (t *aliasTable) load(path string) error {
+	entries, err := readAliases(path)
+	if err != nil {
+		return err
+	}
+	t.entries = entries
+	log.Printf("Loaded %d aliases from %s", len(entries), path)
+	return nil
+}
+
+// refresh reloads the file if it changed. A file that cannot be read keeps
+// the previous aliases in place.
+func (t *aliasTable) refresh() {
+	if err := t.file.refresh(); err != nil {
+		log.Printf("Keeping previous aliases: %v", err)
+	}
+}
+
+func readAliases(path string) (map[string][]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alias file: %w", err)
+	}
+	defer file.Close()
+
+	entries := make(map[string][]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(text, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: alias %q has no target", path, line, fields[0])
+		}
+		entries[strings.ToLower(fields[0])] = fields[1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read alias file: %w", err)
+	}
+
+	return entries, nil
+}
+
+// expand returns the recipients with aliases applied, without duplicates
+func (t *aliasTable) expand(recipients []string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refresh()
+
+	var expanded []string
+	seen := make(map[string]bool)
+	for _, recipient := range recipients {
+		for _, target := range t.resolve(recipient, 0) {
+			if key := strings.ToLower(target); !seen[key] {
+				seen[key] = true
+				expanded = append(expanded, target)
+			}
+		}
+	}
+	return expanded
+}
+
+func (t *aliasTable) resolve(address string, depth int) []string {
+	targets, suffix := t.lookup(address)
+	if targets == nil {
+		return []string{address}
+	}
+	if depth >= maxAliasDepth {
+		log.Printf("Alias chain for %s is too deep, stopping", address)
+		return []string{address}
+	}
+
+	var resolved []string
+	for _, target := range targets {
+		if suffix != "" {
+			target = localPart(target) + suffix + "@" + domainPart(target)
+		}
+		// An alias may keep the original address among its targets
+		if strings.EqualFold(target, address) {
+			resolved = append(resolved, target)
+			continue
+		}
+		resolved = append(resolved, t.resolve(target, depth+1)...)
+	}
+	return resolved
+}
+
+// lookup finds the targets for an address: the exact address first, then
+// the address without its tag, which carries the tag over to the targets,
+// then the domain catch-all. The returned suffix is the separator and tag
+// to add to the targets.
+func (t *aliasTable) lookup(address string) ([]string, string) {
+	if targets, ok := t.entries[strings.ToLower(address)]; ok {
+		return targets, ""
+	}
+
+	addr := ParseAddress(address, t.separators)
+	if addr.Tag != "" {
+		if targets, ok := t.entries[strings.ToLower(addr.User+"@"+addr.Domain)]; ok {
+			return targets, localPart(address)[len(addr.User):]
+		}
+	}
+	if targets, ok := t.entries["@"+addr.Domain]; ok {
+		return targets, ""
+	}
+
+	return nil, ""
+}
@@ -0,0 +1,145 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/slav123/email-catch/internal/config"
+)
+
+// AttachmentDecision records how a route's attachment policy treated one
+// attachment. Action is "allow" or the policy action that was applied.
+type AttachmentDecision struct {
+	Filename     string `json:"filename"`
+	DetectedType string `json:"detected_type"`
+	Size         int64  `json:"size"`
+	Action       string `json:"action"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// attachmentPolicyAction enforces a route's attachment policy before its
+// actions run. It is not a registered action type; routes get it through
+// their attachments setting.
+type attachmentPolicyAction struct {
+	policy     config.AttachmentPolicy
+	quarantine *quarantineAction
+}
+
+func newAttachmentPolicy(env ActionEnv, policy config.AttachmentPolicy) (*routeAction, error) {
+	action := &attachmentPolicyAction{policy: policy}
+
+	if policy.PolicyAction() == config.AttachmentQuarantine {
+		folder := policy.QuarantineFolder
+		if folder == "" {
+			folder = "quarantine"
+		}
+		action.quarantine = &quarantineAction{}
+		if err := action.quarantine.Init(env, config.Action{Config: map[string]string{"folder": folder}}); err != nil {
+			return nil, err
+		}
+	}
+
+	// A policy that cannot be enforced must not let the message through
+	cfg := config.Action{Type: "attachment_policy", Enabled: true, OnError: config.OnErrorTempFail}
+	return &routeAction{config: cfg, action: action, screens: true}, nil
+}
+
+func (a *attachmentPolicyAction) Init(env ActionEnv, cfg config.Action) error { return nil }
+
+func (a *attachmentPolicyAction) Execute(ctx context.Context, email *Email) error {
+	decisions := make([]AttachmentDecision, 0, len(email.Attachments))
+	notes := make(map[int]string)
+
+	for i, attachment := range email.Attachments {
+		decision := AttachmentDecision{
+			Filename:     attachment.Filename,
+			DetectedType: detectType(attachment.Content),
+			Size:         attachment.Size,
+			Action:       "allow",
+		}
+		if reason := a.violation(attachment, decision.DetectedType); reason != "" {
+			decision.Action = a.policy.PolicyAction()
+			decision.Reason = reason
+			notes[i] = fmt.Sprintf("The attachment %q was removed: %s.", attachment.Filename, reason)
+		}
+		decisions = append(decisions, decision)
+	}
+	email.AttachmentDecisions = decisions
+
+	if len(notes) == 0 {
+		return nil
+	}
+
+	switch a.policy.PolicyAction() {
+	case config.AttachmentReject:
+		return &Verdict{Code: 550, Message: "5.7.1 Message contains a disallowed attachment"}
+	case config.AttachmentQuarantine:
+		return a.quarantine.Execute(ctx, email)
+	}
+
+	kept := make([]Attachment, 0, len(email.Attachments)-len(notes))
+	for i, attachment := range email.Attachments {
+		if _, stripped := notes[i]; !stripped {
+			kept = append(kept, attachment)
+		}
+	}
+	email.Modified = stripAttachments(email.ToEML(), notes)
+	email.Attachments = kept
+	return nil
+}
+
+// violation returns why an attachment breaks the policy, or ""
+func (a *attachmentPolicyAction) violation(attachment Attachment, detected string) string {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(attachment.Filename), "."))
+
+	switch {
+	case containsExtension(a.policy.DenyExtensions, ext):
+		return fmt.Sprintf("extension .%s is not allowed", ext)
+	case matchesType(a.policy.DenyTypes, detected):
+		return fmt.Sprintf("type %s is not allowed", detected)
+	case len(a.policy.AllowExtensions) > 0 && !containsExtension(a.policy.AllowExtensions, ext):
+		return fmt.Sprintf("extension .%s is not allowed", ext)
+	case len(a.policy.AllowTypes) > 0 && !matchesType(a.policy.AllowTypes, detected):
+		return fmt.Sprintf("type %s is not allowed", detected)
+	case a.policy.MaxSize > 0 && attachment.Size > a.policy.MaxSize:
+		return fmt.Sprintf("larger than %d bytes", a.policy.MaxSize)
+	}
+	return ""
+}
+
+// detectType sniffs the media type of content, ignoring what the sender
+// declared
+func detectType(content []byte) string {
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(content))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mediaType
+}
+
+func containsExtension(list []string, ext string) bool {
+	for _, entry := range list {
+		if strings.ToLower(strings.TrimPrefix(entry, ".")) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesType(list []string, mediaType string) bool {
+	for _, entry := range list {
+		entry = strings.ToLower(entry)
+		if family, ok := strings.CutSuffix(entry, "/*"); ok {
+			if strings.HasPrefix(mediaType, family+"/") {
+				return true
+			}
+		} else if entry == mediaType {
+			return true
+		}
+	}
+	return false
+}
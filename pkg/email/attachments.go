@@ -0,0 +1,157 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxFilenameLength bounds attachment filenames in bytes
+const maxFilenameLength = 200
+
+// assignFilenames makes the attachment filenames safe to use in storage
+// paths and unique within the message, keeping the declared names in
+// OriginalFilename
+func (e *Email) assignFilenames() {
+	seen := make(map[string]bool)
+	for i := range e.Attachments {
+		attachment := &e.Attachments[i]
+		attachment.OriginalFilename = attachment.Filename
+
+		name := sanitizeFilename(attachment.Filename)
+		if name == "" {
+			mediaType, _, _ := mime.ParseMediaType(attachment.ContentType)
+			name = fmt.Sprintf("attachment_%d%s", i+1, getFileExtension(mediaType))
+		}
+
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for n := 2; seen[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s-%d%s", base, n, ext)
+		}
+		seen[strings.ToLower(name)] = true
+
+		attachment.Filename = name
+	}
+}
+
+// sanitizeFilename reduces a sender-supplied filename to a single safe path
+// segment. It returns "" when nothing usable is left.
+func sanitizeFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == utf8.RuneError || strings.ContainsRune(`/:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+
+	// No hidden files, and never "." or ".."
+	name = strings.TrimLeft(strings.TrimSpace(name), ".")
+
+	if len(name) > maxFilenameLength {
+		ext := path.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		base := name[:maxFilenameLength-len(ext)]
+		for !utf8.ValidString(base) {
+			base = base[:len(base)-1]
+		}
+		name = base + ext
+	}
+
+	return name
+}
+
+// stripAttachments returns raw with the attachments whose index (in the
+// order of Email.Attachments) is a key of notes replaced by a short text
+// part carrying the note. Everything else is kept byte for byte.
+func stripAttachments(raw []byte, notes map[int]string) []byte {
+	msg := splitRawMessage(raw)
+	index := 0
+	msg.body = stripParts(msg, notes, &index)
+	return msg.bytes()
+}
+
+// stripParts walks the parts of a multipart entity the same way the parser
+// does and returns its rewritten body
+func stripParts(entity *rawMessage, notes map[int]string, index *int) []byte {
+	contentType, _ := entity.get("Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return entity.body
+	}
+
+	delimiter := []byte("--" + params["boundary"])
+	var out bytes.Buffer
+	var part []byte
+	inPart, closed := false, false
+
+	flush := func() {
+		if inPart {
+			out.Write(stripPart(part, notes, index, entity.newline))
+		}
+		part = part[:0]
+	}
+
+	rest := entity.body
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		line := rest[:end]
+		rest = rest[end:]
+
+		if closed {
+			out.Write(line)
+			continue
+		}
+
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		switch {
+		case bytes.Equal(trimmed, delimiter):
+			flush()
+			out.Write(line)
+			inPart = true
+		case bytes.Equal(trimmed, append(delimiter, '-', '-')):
+			flush()
+			out.Write(line)
+			inPart, closed = false, true
+		case inPart:
+			part = append(part, line...)
+		default:
+			// Preamble
+			out.Write(line)
+		}
+	}
+	flush()
+
+	return out.Bytes()
+}
+
+func stripPart(raw []byte, notes map[int]string, index *int, newline string) []byte {
+	part := splitRawMessage(raw)
+	contentType, _ := part.get("Content-Type")
+	disposition, _ := part.get("Content-Disposition")
+
+	if _, isAttachment := attachmentPart(contentType, disposition); isAttachment {
+		note, strip := notes[*index]
+		*index++
+		if !strip {
+			return raw
+		}
+		replacement := "Content-Type: text/plain; charset=utf-8" + newline +
+			"Content-Transfer-Encoding: 8bit" + newline + newline +
+			stripNewlines(note) + newline
+		return []byte(replacement)
+	}
+
+	part.body = stripParts(part, notes, index)
+	return part.bytes()
+}
@@ -0,0 +1,95 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// seenCache remembers when each sender last got an automatic reply. With a
+// path it is loaded from and saved to a JSON file, so restarts do not reset
+// the rate limit.
+type seenCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]time.Time
+}
+
+func loadSeenCache(path string) (*seenCache, error) {
+	cache := &seenCache{path: path, entries: make(map[string]time.Time)}
+	if path == "" {
+		return cache, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read autoreply cache: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &cache.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse autoreply cache %s: %w", path, err)
+	}
+
+	return cache, nil
+}
+
+// reserve records a reply to sender unless one was sent within interval
+func (c *seenCache) reserve(sender string, interval time.Duration, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := strings.ToLower(sender)
+	if last, ok := c.entries[key]; ok && now.Sub(last) < interval {
+		return false
+	}
+
+	// Forget senders whose interval has passed, so the file stays small
+	for sender, last := range c.entries {
+		if now.Sub(last) >= interval {
+			delete(c.entries, sender)
+		}
+	}
+
+	c.entries[key] = now
+	return true
+}
+
+// release forgets a reservation whose reply could not be sent
+func (c *seenCache) release(sender string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, strings.ToLower(sender))
+}
+
+// save writes the cache to its file, replacing it atomically
+func (c *seenCache) save() error {
+	if c.path == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,85 @@
+package email
+
+import (
+	"html"
+	"log"
+	"regexp"
+	"sync"
+
+	"github.com/slav123/email-catch/internal/classifier"
+)
+
+// Classification is the category the classifier predicted for a message
+type Classification struct {
+	Category string `json:"category"`
+	// Confidence is the probability of the category under the model, 0-1
+	Confidence float64 `json:"confidence"`
+}
+
+var (
+	htmlHiddenContent = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)>`)
+	htmlTag           = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// ClassificationTokens returns the words the classifier looks at: those of
+// the subject and of the text body, or of the HTML body without markup
+func (e *Email) ClassificationTokens() []string {
+	body := e.Body
+	if body == "" && e.HTMLBody != "" {
+		body = htmlHiddenContent.ReplaceAllString(e.HTMLBody, " ")
+		body = html.UnescapeString(htmlTag.ReplaceAllString(body, " "))
+	}
+	return classifier.Tokenize(e.Subject, body)
+}
+
+// classifierModel is the model file written by the classifier command. It is
+// read again whenever its size or modification time changes, so training
+// takes effect without a restart.
+type classifierModel struct {
+	mu    sync.Mutex
+	file  watchedFile
+	model *classifier.Model
+}
+
+func newClassifierModel(path string) *classifierModel {
+	model := &classifierModel{}
+	model.file = watchedFile{path: path, load: model.load}
+	model.refresh()
+	if model.model == nil {
+		log.Printf("Classifier model %s unavailable, messages stay unclassified until it can be read", path)
+	}
+	return model
+}
+
+func (m *classifierModel) load(path string) error {
+	model, err := classifier.Load(path)
+	if err != nil {
+		return err
+	}
+	m.model = model
+	log.Printf("Loaded classifier model with categories %v from %s", model.Names(), path)
+	return nil
+}
+
+// refresh reloads the model if it changed. A model that cannot be read
+// keeps the previous one in place.
+func (m *classifierModel) refresh() {
+	if err := m.file.refresh(); err != nil {
+		log.Printf("Keeping previous classifier model: %v", err)
+	}
+}
+
+// classify sets the message's predicted category, if the model has any
+func (m *classifierModel) classify(email *Email) {
+	m.mu.Lock()
+	m.refresh()
+	model := m.model
+	m.mu.Unlock()
+
+	if model == nil {
+		return
+	}
+	if category, confidence, ok := model.Classify(email.ClassificationTokens()); ok {
+		email.Classification = &Classification{Category: category, Confidence: confidence}
+	}
+}
@@ -0,0 +1,196 @@
+package email
+
+import (
+	"regexp"
+
+	"github.com/slav123/email-catch/internal/config"
+)
+
+// conditionMatches evaluates a compiled route condition tree against an email
+func conditionMatches(email *Email, cond *config.CompiledCondition) bool {
+	if !recipientsMatch(email, cond) {
+		return false
+	}
+
+	fields := []struct {
+		pattern *regexp.Regexp
+		value   string
+	}{
+		{cond.Sender, email.From},
+		{cond.Subject, email.Subject},
+		{cond.EnvelopeFrom, email.Envelope.From},
+		{cond.Helo, email.Envelope.Helo},
+		{cond.RemoteAddr, email.Envelope.RemoteAddr},
+		{cond.Listener, email.Envelope.Listener},
+		{cond.Body, email.Body},
+		{cond.HTML, email.HTMLBody},
+	}
+	for _, field := range fields {
+		if field.pattern != nil && !field.pattern.MatchString(field.value) {
+			return false
+		}
+	}
+
+	if cond.TLS != nil && *cond.TLS != email.Envelope.TLS {
+		return false
+	}
+
+	for name, pattern := range cond.Headers {
+		values := email.Headers[name]
+		if len(values) == 0 || !matchesAny(pattern, values) {
+			return false
+		}
+	}
+
+	if len(cond.AuthResults) > 0 {
+		results := email.AuthResults()
+		for method, pattern := range cond.AuthResults {
+			result, ok := results[method]
+			if !ok || !pattern.MatchString(result) {
+				return false
+			}
+		}
+	}
+
+	if !attachmentsMatch(email, cond) {
+		return false
+	}
+
+	size := email.GetTotalSize()
+	if cond.MinSize > 0 && size < cond.MinSize {
+		return false
+	}
+	if cond.MaxSize > 0 && size > cond.MaxSize {
+		return false
+	}
+
+	if !spamMatches(email, cond) || !categoryMatches(email, cond) {
+		return false
+	}
+
+	for _, sub := range cond.All {
+		if !conditionMatches(email, sub) {
+			return false
+		}
+	}
+
+	if len(cond.Any) > 0 {
+		matched := false
+		for _, sub := range cond.Any {
+			if conditionMatches(email, sub) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if cond.Not != nil && conditionMatches(email, cond.Not) {
+		return false
+	}
+
+	return true
+}
+
+// matchesAny reports whether pattern matches one of values; a nil pattern
+// matches everything
+func matchesAny(pattern *regexp.Regexp, values []string) bool {
+	if pattern == nil {
+		return true
+	}
+	for _, value := range values {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// recipientsMatch reports whether one recipient satisfies all recipient
+// patterns of the condition
+func recipientsMatch(email *Email, cond *config.CompiledCondition) bool {
+	if cond.RecipientUser == nil && cond.RecipientTag == nil && cond.RecipientDomain == nil {
+		return matchesAny(cond.Recipient, email.To)
+	}
+
+	for i, addr := range email.recipientAddresses() {
+		if (cond.Recipient == nil || cond.Recipient.MatchString(email.To[i])) &&
+			(cond.RecipientUser == nil || cond.RecipientUser.MatchString(addr.User)) &&
+			(cond.RecipientTag == nil || cond.RecipientTag.MatchString(addr.Tag)) &&
+			(cond.RecipientDomain == nil || cond.RecipientDomain.MatchString(addr.Domain)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func attachmentsMatch(email *Email, cond *config.CompiledCondition) bool {
+	count := len(email.Attachments)
+
+	if cond.HasAttachments != nil && *cond.HasAttachments != (count > 0) {
+		return false
+	}
+	if cond.MinAttachments != nil && count < *cond.MinAttachments {
+		return false
+	}
+	if cond.MaxAttachments != nil && count > *cond.MaxAttachments {
+		return false
+	}
+
+	if cond.AttachmentType == nil && cond.AttachmentName == nil {
+		return true
+	}
+
+	// Type and name must hold for the same attachment
+	for _, attachment := range email.Attachments {
+		if (cond.AttachmentType == nil || cond.AttachmentType.MatchString(attachment.ContentType)) &&
+			(cond.AttachmentName == nil || cond.AttachmentName.MatchString(attachment.Filename)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// spamMatches checks the spam conditions; a message spamd did not score
+// matches none of them
+func spamMatches(email *Email, cond *config.CompiledCondition) bool {
+	if cond.MinSpamScore == nil && cond.MaxSpamScore == nil && cond.IsSpam == nil && cond.SpamRule == nil {
+		return true
+	}
+
+	spam := email.Spam
+	if spam == nil {
+		return false
+	}
+	if cond.MinSpamScore != nil && spam.Score < *cond.MinSpamScore {
+		return false
+	}
+	if cond.MaxSpamScore != nil && spam.Score > *cond.MaxSpamScore {
+		return false
+	}
+	if cond.IsSpam != nil && *cond.IsSpam != spam.IsSpam {
+		return false
+	}
+	return cond.SpamRule == nil || matchesAny(cond.SpamRule, spam.Rules)
+}
+
+// categoryMatches checks the classifier conditions; an unclassified message
+// matches none of them
+func categoryMatches(email *Email, cond *config.CompiledCondition) bool {
+	if cond.Category == nil && cond.MinCategoryConfidence == nil {
+		return true
+	}
+
+	classification := email.Classification
+	if classification == nil {
+		return false
+	}
+	if cond.MinCategoryConfidence != nil && classification.Confidence < *cond.MinCategoryConfidence {
+		return false
+	}
+	return cond.Category == nil || cond.Category.MatchString(classification.Category)
+}
@@ -0,0 +1,155 @@
+package email
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+)
+
+// Duplicate describes the earlier copy of a message that was seen before
+type Duplicate struct {
+	OriginalID string    `json:"original_id"`
+	FirstSeen  time.Time `json:"first_seen"`
+	// OriginalPaths are the EML files stored for the earlier copy
+	OriginalPaths []string `json:"original_paths,omitempty"`
+}
+
+type dedupEntry struct {
+	ID        string    `json:"id"`
+	FirstSeen time.Time `json:"first_seen"`
+	Paths     []string  `json:"paths,omitempty"`
+}
+
+// dedupStore remembers the messages seen within the dedup window. With a
+// store file it survives restarts.
+type dedupStore struct {
+	mu      sync.Mutex
+	path    string
+	window  time.Duration
+	entries map[string]*dedupEntry
+}
+
+func newDedupStore(cfg config.DedupConfig) (*dedupStore, error) {
+	store := &dedupStore{
+		path:    cfg.StoreFile,
+		window:  time.Duration(cfg.WindowMinutes) * time.Minute,
+		entries: make(map[string]*dedupEntry),
+	}
+	if store.path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(store.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dedup store: %w", err)
+	}
+	if err := json.Unmarshal(data, &store.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse dedup store %s: %w", store.path, err)
+	}
+
+	return store, nil
+}
+
+// dedupKey identifies a message by its Message-ID and body. Headers are left
+// out because every delivery path adds its own. Messages without a
+// Message-ID are never considered duplicates.
+func dedupKey(email *Email) string {
+	if email.MessageID == "" {
+		return ""
+	}
+
+	body := email.Raw
+	if i := bytes.Index(body, []byte("\r\n\r\n")); i >= 0 {
+		body = body[i+4:]
+	} else if i := bytes.Index(body, []byte("\n\n")); i >= 0 {
+		body = body[i+2:]
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(strings.TrimSpace(email.MessageID)))
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// check returns the earlier copy of the message with this key, or registers
+// the message as the first copy and returns nil. Processing a message again
+// under its own ID is not a duplicate.
+func (s *dedupStore) check(key, id string, now time.Time) *Duplicate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.entries[key]; ok && now.Sub(entry.FirstSeen) < s.window {
+		if entry.ID == id {
+			return nil
+		}
+		return &Duplicate{
+			OriginalID:    entry.ID,
+			FirstSeen:     entry.FirstSeen,
+			OriginalPaths: append([]string(nil), entry.Paths...),
+		}
+	}
+
+	s.entries[key] = &dedupEntry{ID: id, FirstSeen: now}
+	return nil
+}
+
+// complete records where the first copy was stored and saves the store
+func (s *dedupStore) complete(key string, paths []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.entries[key]; ok {
+		entry.Paths = paths
+	}
+	return s.save()
+}
+
+// forget drops a first copy that could not be processed, so the sender's
+// retry is not taken for a duplicate
+func (s *dedupStore) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+// save prunes expired entries and writes the store file. Callers hold mu.
+func (s *dedupStore) save() error {
+	now := time.Now()
+	for key, entry := range s.entries {
+		if now.Sub(entry.FirstSeen) >= s.window {
+			delete(s.entries, key)
+		}
+	}
+
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
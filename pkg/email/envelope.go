@@ -0,0 +1,28 @@
+package email
+
+import "time"
+
+// Envelope holds the SMTP session details a message arrived with. Unlike the
+// header fields parsed into Email, these come from the protocol exchange.
+type Envelope struct {
+	// ID is assigned by the server when the message is received (a ULID,
+	// see NewID). Storage keys, JSON payloads and webhooks all use it, so
+	// processing a message again with the same ID is idempotent.
+	ID string
+
+	From string
+	To   []string
+	// OriginalTo holds the recipients as received when aliases rewrote them
+	OriginalTo []string
+	Helo       string
+	RemoteAddr string
+	Listener   string
+	TLS        bool
+	// Received is when the server accepted the message. Unlike the Date
+	// header it cannot be set by the sender.
+	Received time.Time
+
+	// Transcript is the recorded SMTP conversation up to the end of DATA,
+	// or nil when recording is off for this session
+	Transcript []byte
+}
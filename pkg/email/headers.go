@@ -0,0 +1,126 @@
+package email
+
+import (
+	"bytes"
+	"net/textproto"
+	"strings"
+)
+
+// headerField is one header of a raw message, including its folded
+// continuation lines and line endings, exactly as received
+type headerField struct {
+	name string
+	raw  []byte
+}
+
+// rawMessage is a message split into editable header fields and an
+// untouched body. Fields that are not edited are written back unchanged.
+type rawMessage struct {
+	fields  []headerField
+	body    []byte
+	newline string
+}
+
+func splitRawMessage(raw []byte) *rawMessage {
+	msg := &rawMessage{newline: "\n"}
+
+	rest := raw
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		line := rest[:end]
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			if bytes.HasSuffix(line, []byte("\r\n")) {
+				msg.newline = "\r\n"
+			}
+			msg.body = rest[end:]
+			return msg
+		}
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			msg.newline = "\r\n"
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(msg.fields) > 0 {
+			last := &msg.fields[len(msg.fields)-1]
+			last.raw = append(last.raw, line...)
+		} else {
+			name, _, _ := strings.Cut(string(line), ":")
+			msg.fields = append(msg.fields, headerField{
+				name: textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)),
+				raw:  append([]byte(nil), line...),
+			})
+		}
+		rest = rest[end:]
+	}
+
+	// Header only, possibly without a final line ending
+	if n := len(msg.fields); n > 0 && !bytes.HasSuffix(msg.fields[n-1].raw, []byte("\n")) {
+		msg.fields[n-1].raw = append(msg.fields[n-1].raw, msg.newline...)
+	}
+	return msg
+}
+
+// field builds a new header, written with the name as given
+func (m *rawMessage) field(name, value string) headerField {
+	return headerField{
+		name: textproto.CanonicalMIMEHeaderKey(name),
+		raw:  []byte(name + ": " + value + m.newline),
+	}
+}
+
+// get returns the unfolded value of the first field with the given name
+func (m *rawMessage) get(name string) (string, bool) {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	for _, f := range m.fields {
+		if f.name == name {
+			_, value, _ := strings.Cut(string(f.raw), ":")
+			value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
+
+func (m *rawMessage) remove(name string) {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	kept := m.fields[:0]
+	for _, f := range m.fields {
+		if f.name != name {
+			kept = append(kept, f)
+		}
+	}
+	m.fields = kept
+}
+
+// set replaces the first field with the given name and removes the others,
+// or adds the field when the message has none
+func (m *rawMessage) set(name, value string) {
+	field := m.field(name, value)
+	for i, f := range m.fields {
+		if f.name == field.name {
+			m.remove(name)
+			m.fields = append(m.fields[:i], append([]headerField{field}, m.fields[i:]...)...)
+			return
+		}
+	}
+	m.add(name, value)
+}
+
+// add puts a field at the top of the header, where trace and annotation
+// headers conventionally go
+func (m *rawMessage) add(name, value string) {
+	m.fields = append([]headerField{m.field(name, value)}, m.fields...)
+}
+
+func (m *rawMessage) bytes() []byte {
+	var buf bytes.Buffer
+	for _, f := range m.fields {
+		buf.Write(f.raw)
+	}
+	buf.WriteString(m.newline)
+	buf.Write(m.body)
+	return buf.Bytes()
+}
@@ -0,0 +1,66 @@
+package email
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// crockford is the Crockford base32 alphabet used by ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var (
+	idMu       sync.Mutex
+	idLastMs   uint64
+	idLastRand [10]byte
+)
+
+// NewID returns a ULID for a message received at t: 26 characters that sort
+// by time, with 80 random bits so IDs never collide. IDs created in the same
+// millisecond increase monotonically.
+func NewID(t time.Time) string {
+	idMu.Lock()
+	defer idMu.Unlock()
+
+	ms := uint64(t.UnixMilli())
+	if ms <= idLastMs {
+		// Same millisecond, or the clock went back: keep IDs increasing
+		ms = idLastMs
+		for i := len(idLastRand) - 1; i >= 0; i-- {
+			idLastRand[i]++
+			if idLastRand[i] != 0 {
+				break
+			}
+		}
+	} else {
+		rand.Read(idLastRand[:])
+	}
+	idLastMs = ms
+
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (40 - 8*i))
+	}
+	copy(id[6:], idLastRand[:])
+
+	return encodeULID(id)
+}
+
+// encodeULID writes 128 bits as 26 base32 characters, most significant first
+func encodeULID(id [16]byte) string {
+	out := make([]byte, 26)
+	for i := range out {
+		// Character i covers bits [5*i-2, 5*i+3) of the value, counting the
+		// two padding bits that make 130
+		var value byte
+		for bit := 0; bit < 5; bit++ {
+			pos := 5*i + bit - 2
+			value <<= 1
+			if pos >= 0 && id[pos/8]&(0x80>>(pos%8)) != 0 {
+				value |= 1
+			}
+		}
+		out[i] = crockford[value]
+	}
+	return string(out)
+}
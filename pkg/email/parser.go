@@ -9,6 +9,7 @@ import (
 	"mime"
 	"mime/multipart"
 	"net/mail"
+	"slices"
 	"strings"
 	"time"
 )
@@ -24,13 +25,44 @@ type Email struct {
 	HTMLBody    string
 	Attachments []Attachment
 	Raw         []byte
+	Envelope    Envelope
+
+	// Modified is the message with the changes of modify actions, or nil.
+	// Raw always keeps the message as received.
+	Modified []byte
+
+	// MatchedRoutes lists the routes that ran for this message
+	MatchedRoutes []string
+	// Duplicate is set when deduplication found an earlier copy
+	Duplicate *Duplicate
+	// Recipient is the envelope recipient this copy is routed for when
+	// routing per recipient, and empty otherwise
+	Recipient string
+	// Recipients are the envelope recipients split into user, tag and
+	// domain with the configured subaddress separators
+	Recipients []Address
+	// AttachmentDecisions are set by the attachment policy of the route
+	// that is processing this copy
+	AttachmentDecisions []AttachmentDecision
+	// VirusScan is set by a scan_clamav action of the route that is
+	// processing this copy
+	VirusScan *VirusScan
+	// Spam is the spamd verdict, when spam checks are enabled and the
+	// message was scored
+	Spam *SpamResult
+	// Classification is the predicted category, when the classifier is
+	// enabled and its model has categories
+	Classification *Classification
 }
 
 type Attachment struct {
-	Filename    string
-	ContentType string
-	Content     []byte
-	Size        int64
+	// Filename is safe to use in storage paths and unique within the
+	// message; OriginalFilename is the name the sender declared
+	Filename         string
+	OriginalFilename string
+	ContentType      string
+	Content          []byte
+	Size             int64
 }
 
 func ParseEmail(rawData []byte, from string, to []string) (*Email, error) {
@@ -42,18 +74,12 @@ func ParseEmail(rawData []byte, from string, to []string) (*Email, error) {
 	email := &Email{
 		From:        from,
 		To:          to,
-		Headers:     make(map[string][]string),
 		Raw:         rawData,
 		Attachments: make([]Attachment, 0),
+		Envelope:    Envelope{From: from, To: to},
 	}
 
-	for key, values := range msg.Header {
-		decodedValues := make([]string, len(values))
-		for i, value := range values {
-			decodedValues[i] = decodeMIMEHeader(value)
-		}
-		email.Headers[key] = decodedValues
-	}
+	email.Headers = decodeHeaders(msg.Header)
 
 	email.Subject = decodeMIMEHeader(msg.Header.Get("Subject"))
 	email.MessageID = decodeMIMEHeader(msg.Header.Get("Message-Id"))
@@ -111,9 +137,52 @@ func ParseEmail(rawData []byte, from string, to []string) (*Email, error) {
 		}
 	}
 
+	email.assignFilenames()
+
 	return email, nil
 }
 
+// attachmentPart decides from its headers whether a MIME part is an
+// attachment, and returns the filename it declares
+func attachmentPart(contentType, contentDisposition string) (string, bool) {
+	isAttachment := false
+	filename := ""
+
+	// Standard attachment detection
+	disposition, params, _ := mime.ParseMediaType(contentDisposition)
+	if disposition == "attachment" || (disposition == "" && params["filename"] != "") {
+		isAttachment = true
+		filename = params["filename"]
+	}
+
+	// Check for application/* content types that are likely attachments
+	mediaType, mediaParams, _ := mime.ParseMediaType(contentType)
+	if strings.HasPrefix(mediaType, "application/") && !strings.HasPrefix(mediaType, "application/text") {
+		isAttachment = true
+		if filename == "" {
+			filename = mediaParams["name"]
+		}
+	}
+
+	// Check for image attachments
+	if strings.HasPrefix(mediaType, "image/") {
+		isAttachment = true
+		if filename == "" {
+			filename = mediaParams["name"]
+		}
+	}
+
+	// Handle message/rfc822 as forwarded email attachment
+	if strings.HasPrefix(contentType, "message/rfc822") || strings.Contains(contentType, "forwarded-message") {
+		isAttachment = true
+		if filename == "" {
+			filename = "forwarded_email.eml"
+		}
+	}
+
+	return filename, isAttachment
+}
+
 func (e *Email) parseMultipart(body io.Reader, boundary string) error {
 	reader := multipart.NewReader(body, boundary)
 
@@ -140,47 +209,15 @@ func (e *Email) parseMultipart(body io.Reader, boundary string) error {
 			return fmt.Errorf("failed to decode part content: %w", err)
 		}
 
-		disposition, params, _ := mime.ParseMediaType(contentDisposition)
+		disposition, _, _ := mime.ParseMediaType(contentDisposition)
 		
 		// Debug: log part information
 		log.Printf("DEBUG: Part - ContentType: %s, ContentDisposition: %s, Size: %d, Disposition: %s", 
 			contentType, contentDisposition, len(decoded), disposition)
 
-		// Check if this is an attachment based on various indicators
-		isAttachment := false
-		filename := ""
-		
-		// Standard attachment detection
-		if disposition == "attachment" || (disposition == "" && params["filename"] != "") {
-			isAttachment = true
-			filename = params["filename"]
-		}
-		
-		// Check for application/* content types that are likely attachments
-		mediaType, mediaParams, _ := mime.ParseMediaType(contentType)
-		if strings.HasPrefix(mediaType, "application/") && !strings.HasPrefix(mediaType, "application/text") {
-			isAttachment = true
-			if filename == "" {
-				filename = mediaParams["name"]
-			}
-		}
-		
-		// Check for image attachments
-		if strings.HasPrefix(mediaType, "image/") {
-			isAttachment = true
-			if filename == "" {
-				filename = mediaParams["name"]
-			}
-		}
-		
-		// Handle message/rfc822 as forwarded email attachment
-		if strings.HasPrefix(contentType, "message/rfc822") || strings.Contains(contentType, "forwarded-message") {
-			isAttachment = true
-			if filename == "" {
-				filename = "forwarded_email.eml"
-			}
-		}
-		
+		filename, isAttachment := attachmentPart(contentType, contentDisposition)
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+
 		if isAttachment {
 			if filename == "" {
 				// Generate filename based on content type
@@ -250,10 +287,39 @@ func decodeContent(data []byte, encoding string) ([]byte, error) {
 	}
 }
 
+// ToEML returns the message as it should be stored or passed on: with the
+// changes of modify actions applied, or as received when there are none
 func (e *Email) ToEML() []byte {
+	if e.Modified != nil {
+		return e.Modified
+	}
 	return e.Raw
 }
 
+func decodeHeaders(header mail.Header) map[string][]string {
+	headers := make(map[string][]string, len(header))
+	for key, values := range header {
+		decodedValues := make([]string, len(values))
+		for i, value := range values {
+			decodedValues[i] = decodeMIMEHeader(value)
+		}
+		headers[key] = decodedValues
+	}
+	return headers
+}
+
+// clone copies the message so that changes to the copy, including to its
+// headers and attachment list, leave the original alone
+func (e *Email) clone() *Email {
+	c := *e
+	c.Headers = make(map[string][]string, len(e.Headers))
+	for key, values := range e.Headers {
+		c.Headers[key] = slices.Clone(values)
+	}
+	c.Attachments = slices.Clone(e.Attachments)
+	return &c
+}
+
 func (e *Email) GetAttachmentByName(filename string) *Attachment {
 	for i, attachment := range e.Attachments {
 		if attachment.Filename == filename {
@@ -279,6 +345,32 @@ func (e *Email) GetAttachmentsSize() int64 {
 	return total
 }
 
+// AuthResults returns the method results from the Authentication-Results
+// headers, keyed by lowercase method name, e.g. {"spf": "pass", "dkim": "fail"}.
+// When a method appears more than once the first result wins.
+func (e *Email) AuthResults() map[string]string {
+	results := make(map[string]string)
+
+	for _, header := range e.Headers["Authentication-Results"] {
+		// The first element is the authserv-id, the rest are method=result
+		for _, clause := range strings.Split(header, ";") {
+			for _, field := range strings.Fields(clause) {
+				method, result, ok := strings.Cut(field, "=")
+				if !ok || strings.Contains(method, ".") {
+					continue
+				}
+				method = strings.ToLower(method)
+				if _, seen := results[method]; !seen {
+					results[method] = strings.ToLower(strings.Trim(result, "();"))
+				}
+				break
+			}
+		}
+	}
+
+	return results
+}
+
 func (e *Email) Summary() string {
 	return fmt.Sprintf("From: %s, To: %v, Subject: %s, Attachments: %d, Size: %d bytes",
 		e.From, e.To, e.Subject, len(e.Attachments), len(e.Raw))
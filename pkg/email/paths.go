@@ -0,0 +1,167 @@
+package email
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/slav123/email-catch/internal/config"
+)
+
+var pathVariable = regexp.MustCompile(`\{\{\s*([a-z_]+)\s*\}\}`)
+
+// pathVariables lists the variables a path_template may use
+var pathVariables = map[string]func(v pathValues) string{
+	"folder":           func(v pathValues) string { return v.folder },
+	"route":            func(v pathValues) string { return v.route },
+	"recipient":        func(v pathValues) string { return v.recipient },
+	"recipient_local":  func(v pathValues) string { return localPart(v.recipient) },
+	"recipient_domain": func(v pathValues) string { return domainPart(v.recipient) },
+	"recipient_user":   func(v pathValues) string { return v.address.User },
+	"recipient_tag":    func(v pathValues) string { return v.address.Tag },
+	"plus_tag":         func(v pathValues) string { return v.address.Tag },
+	"sender":           func(v pathValues) string { return v.sender },
+	"sender_local":     func(v pathValues) string { return localPart(v.sender) },
+	"sender_domain":    func(v pathValues) string { return domainPart(v.sender) },
+	"yyyy":             func(v pathValues) string { return v.email.Envelope.Received.Format("2006") },
+	"mm":               func(v pathValues) string { return v.email.Envelope.Received.Format("01") },
+	"dd":               func(v pathValues) string { return v.email.Envelope.Received.Format("02") },
+	"hh":               func(v pathValues) string { return v.email.Envelope.Received.Format("15") },
+	"message_id_hash":  func(v pathValues) string { return messageIDHash(v.email.MessageID) },
+	"unique_id":        func(v pathValues) string { return v.uniqueID },
+}
+
+type pathValues struct {
+	email     *Email
+	folder    string
+	route     string
+	recipient string
+	address   Address
+	sender    string
+	uniqueID  string
+}
+
+// validatePathTemplate checks that a path_template only uses known variables
+func validatePathTemplate(template string) error {
+	return validateVariables(template, "path_template")
+}
+
+// validateVariables checks that the option named field only uses known
+// variables
+func validateVariables(template, field string) error {
+	for _, match := range pathVariable.FindAllStringSubmatch(template, -1) {
+		if _, ok := pathVariables[match[1]]; !ok {
+			return fmt.Errorf("unknown variable {{%s}} in %s", match[1], field)
+		}
+	}
+	return nil
+}
+
+// storagePath returns the folder a storage action writes a message to. The
+// default layout is folder/YYYY/MM/uniqueID based on the time of receipt. With a
+// path_template the expanded template is used instead, followed by the
+// unique ID unless the template places {{unique_id}} itself, so messages
+// never share a folder.
+func (p *Processor) storagePath(email *Email, route config.RouteConfig, action config.Action) string {
+	folder := action.Config["folder"]
+	if folder == "" {
+		folder = "default"
+	}
+	uniqueID := p.generateUniqueID(email)
+
+	template := action.Config["path_template"]
+	if template == "" {
+		// Not the Date header, which the sender controls
+		year := email.Envelope.Received.Format("2006")
+		month := email.Envelope.Received.Format("01")
+		return fmt.Sprintf("%s/%s/%s/%s", folder, year, month, uniqueID)
+	}
+
+	values := p.pathValues(email, route.Name, folder)
+	expanded := expandVariables(template, values, sanitizePathSegment)
+	if !usesVariable(template, "unique_id") {
+		expanded += "/" + uniqueID
+	}
+
+	// Empty variables leave empty segments behind; never escape the root
+	return strings.TrimPrefix(path.Clean("/"+expanded), "/")
+}
+
+func (p *Processor) pathValues(email *Email, route, folder string) pathValues {
+	values := pathValues{
+		email:    email,
+		folder:   folder,
+		route:    route,
+		sender:   email.Envelope.From,
+		uniqueID: p.generateUniqueID(email),
+	}
+	if len(email.Envelope.To) > 0 {
+		values.recipient = email.Envelope.To[0]
+	} else if len(email.To) > 0 {
+		values.recipient = email.To[0]
+	}
+	values.address = ParseAddress(values.recipient, p.config.Routing.Separators())
+	return values
+}
+
+// expandVariables replaces the {{var}} placeholders in template, passing
+// every value through escape
+func expandVariables(template string, values pathValues, escape func(string) string) string {
+	return pathVariable.ReplaceAllStringFunc(template, func(match string) string {
+		name := pathVariable.FindStringSubmatch(match)[1]
+		if value, ok := pathVariables[name]; ok {
+			return escape(value(values))
+		}
+		return ""
+	})
+}
+
+func usesVariable(template, name string) bool {
+	for _, match := range pathVariable.FindAllStringSubmatch(template, -1) {
+		if match[1] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizePathSegment makes a variable value safe to use as part of a path
+func sanitizePathSegment(value string) string {
+	value = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.' || r == '-' || r == '_' || r == '+' || r == '@' || r == '=':
+			return r
+		}
+		return '_'
+	}, value)
+
+	if strings.Trim(value, ".") == "" {
+		return strings.Repeat("_", len(value))
+	}
+	return value
+}
+
+func localPart(address string) string {
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		return address[:at]
+	}
+	return address
+}
+
+func domainPart(address string) string {
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		return strings.ToLower(address[at+1:])
+	}
+	return ""
+}
+
+// messageIDHash returns a short stable hash of a Message-ID
+func messageIDHash(messageID string) string {
+	sum := sha256.Sum256([]byte(strings.Trim(messageID, "<> ")))
+	return hex.EncodeToString(sum[:8])
+}
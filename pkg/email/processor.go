@@ -1,11 +1,16 @@
 package email
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/slav123/email-catch/internal/config"
 	"github.com/slav123/email-catch/internal/storage"
@@ -16,150 +21,467 @@ type Processor struct {
 	config         *config.Config
 	storageBackend storage.Backend
 	webhookClient  *webhook.Client
+	routes         *config.RouteTable
+	dedup          *dedupStore
+	aliases        *aliasTable
+	actions        map[*config.CompiledRoute][]*routeAction
+	policies       map[*config.CompiledRoute]*routeAction
+	spam           *spamChecker
+	classifier     *classifierModel
+	hooks          []func(*Email)
 }
 
 func NewProcessor(cfg *config.Config, storageBackend storage.Backend, webhookClient *webhook.Client) *Processor {
-	return &Processor{
+	processor := &Processor{
 		config:         cfg,
 		storageBackend: storageBackend,
 		webhookClient:  webhookClient,
+		routes:         cfg.RouteTable(),
 	}
+	processor.bindActions()
+
+	if cfg.Dedup.Enabled {
+		dedup, err := newDedupStore(cfg.Dedup)
+		if err != nil {
+			log.Printf("Deduplication store unavailable, starting empty: %v", err)
+			dedup, _ = newDedupStore(config.DedupConfig{WindowMinutes: cfg.Dedup.WindowMinutes})
+		}
+		processor.dedup = dedup
+	}
+
+	if cfg.Routing.AliasFile != "" {
+		aliases, err := newAliasTable(cfg.Routing.AliasFile, cfg.Routing.Separators())
+		if err != nil {
+			log.Printf("Aliases unavailable until the file can be read: %v", err)
+		}
+		processor.aliases = aliases
+	}
+
+	if cfg.Spam.Enabled {
+		processor.spam = newSpamChecker(cfg.Spam)
+	}
+
+	if cfg.Classifier.Enabled {
+		processor.classifier = newClassifierModel(cfg.Classifier.ModelFile)
+	}
+
+	return processor
+}
+
+// Close releases what the actions of every route hold, such as relay retry
+// queues and pooled clamd connections. Messages still waiting for a retry
+// are dropped.
+func (p *Processor) Close() error {
+	var errs []error
+	for _, bound := range p.actions {
+		for _, ra := range bound {
+			if closer, ok := ra.action.(Closer); ok {
+				if err := closer.Close(); err != nil {
+					errs = append(errs, fmt.Errorf("failed to close %s action: %w", ra.config.Type, err))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// OnProcessed registers a function that is called with every parsed message
+// after its routes have run, whether or not any route matched. Messages that
+// are refused with a delivery error are not passed to it.
+func (p *Processor) OnProcessed(hook func(*Email)) {
+	p.hooks = append(p.hooks, hook)
+}
+
+func (p *Processor) ProcessEmail(from string, to []string, rawData []byte) (*ProcessingResult, error) {
+	return p.ProcessEnvelope(Envelope{From: from, To: to}, rawData)
 }
 
-func (p *Processor) ProcessEmail(from string, to []string, rawData []byte) error {
+// ProcessEnvelope processes a message together with the SMTP session details
+// it was received with. The result is returned even when an error is, so the
+// caller can see which actions failed.
+func (p *Processor) ProcessEnvelope(envelope Envelope, rawData []byte) (result *ProcessingResult, err error) {
+	if p.aliases != nil {
+		if expanded := p.aliases.expand(envelope.To); !slices.Equal(expanded, envelope.To) {
+			log.Printf("Aliases rewrote recipients %v to %v", envelope.To, expanded)
+			envelope.OriginalTo = envelope.To
+			envelope.To = expanded
+		}
+	}
+	from, to := envelope.From, envelope.To
+
 	email, err := ParseEmail(rawData, from, to)
 	if err != nil {
-		return fmt.Errorf("failed to parse email: %w", err)
+		return nil, fmt.Errorf("failed to parse email: %w", err)
+	}
+	if envelope.Received.IsZero() {
+		envelope.Received = time.Now()
+	}
+	// Processing a message again under the same ID writes the same keys
+	if envelope.ID == "" {
+		envelope.ID = NewID(envelope.Received)
 	}
+	email.Envelope = envelope
+	email.Recipients = parseAddresses(envelope.To, p.config.Routing.Separators())
+	result = &ProcessingResult{ID: envelope.ID, MessageID: email.MessageID}
 
 	log.Printf("Processing email: %s", email.Summary())
 
-	routes := p.config.GetEnabledRoutes()
-	matchedRoutes := p.findMatchingRoutes(email, routes)
+	defer func() {
+		// The client was told to go away or retry, so nothing was received
+		var refused *DeliveryError
+		if errors.As(err, &refused) {
+			return
+		}
+		for _, hook := range p.hooks {
+			hook(email)
+		}
+	}()
 
-	if len(matchedRoutes) == 0 {
+	ctx := context.Background()
+	if p.spam != nil {
+		if err := p.spam.check(ctx, email); err != nil {
+			return result, err
+		}
+	}
+	if p.classifier != nil {
+		p.classifier.classify(email)
+	}
+
+	dedupKey := p.checkDuplicate(email)
+	result.Duplicate = email.Duplicate
+
+	var runs []*routeRun
+	for _, target := range p.fanOut(email) {
+		runs = append(runs, p.routeRuns(target, result)...)
+	}
+
+	// Every route screens the message before any of them stores, forwards or
+	// posts it, so a refused message leaves no trace
+	outcomes := p.runRoutes(ctx, runs, true, result)
+	if result.Verdict == nil {
+		outcomes = append(outcomes, p.runRoutes(ctx, runs, false, result)...)
+		for _, run := range runs {
+			if !run.failed {
+				log.Printf("Successfully executed route: %s", run.route.Name)
+			}
+		}
+	}
+	email.MatchedRoutes = result.MatchedRoutes
+
+	if len(result.MatchedRoutes) == 0 {
 		log.Printf("No matching routes for email from %s to %v", from, to)
-		return nil
+		p.finishDuplicate(dedupKey, result, nil)
+		return result, nil
 	}
 
-	for _, route := range matchedRoutes {
-		if err := p.executeRoute(email, route); err != nil {
-			log.Printf("Failed to execute route %s: %v", route.Name, err)
-			continue
+	// JSON payloads are written last so they include the complete result
+	for _, outcome := range outcomes {
+		for _, pending := range outcome.payloads {
+			if err := p.writePayload(pending, result); err != nil {
+				log.Printf("Failed to store webhook payload: %v", err)
+			}
 		}
-		log.Printf("Successfully executed route: %s", route.Name)
 	}
 
-	return nil
+	err = deliveryError(outcomes)
+	p.finishDuplicate(dedupKey, result, err)
+
+	return result, err
 }
 
-func (p *Processor) findMatchingRoutes(email *Email, routes []config.RouteConfig) []config.RouteConfig {
-	var matched []config.RouteConfig
+// fanOut returns the messages to route: the message itself, or with
+// per-recipient routing one copy per envelope recipient. Copies get their
+// own IDs, derived from the message ID so reprocessing stays idempotent.
+func (p *Processor) fanOut(email *Email) []*Email {
+	if !p.config.Routing.PerRecipient || len(email.Envelope.To) == 0 {
+		return []*Email{email}
+	}
 
-	for _, route := range routes {
-		if p.routeMatches(email, route) {
-			matched = append(matched, route)
-		}
+	if len(email.Envelope.To) == 1 {
+		email.Recipient = email.Envelope.To[0]
+		return []*Email{email}
 	}
 
-	return matched
+	copies := make([]*Email, len(email.Envelope.To))
+	for i, recipient := range email.Envelope.To {
+		recipientEmail := *email
+		recipientEmail.To = []string{recipient}
+		recipientEmail.Envelope.To = []string{recipient}
+		recipientEmail.Envelope.ID = fmt.Sprintf("%s-%d", email.Envelope.ID, i+1)
+		recipientEmail.Recipient = recipient
+		recipientEmail.Recipients = []Address{email.Recipients[i]}
+		recipientEmail.MatchedRoutes = nil
+		copies[i] = &recipientEmail
+	}
+	return copies
 }
 
-func (p *Processor) routeMatches(email *Email, route config.RouteConfig) bool {
-	if route.Condition.RecipientPattern != "" {
-		matched := false
-		pattern, err := regexp.Compile(route.Condition.RecipientPattern)
-		if err != nil {
-			log.Printf("Invalid recipient pattern in route %s: %v", route.Name, err)
-			return false
-		}
+// routeRun is a matched route and its own copy of the message, as modify
+// actions change the message for the rest of their route only
+type routeRun struct {
+	route *config.CompiledRoute
+	email *Email
+	// stopped is set once an action ended the route
+	stopped bool
+	failed  bool
+}
 
-		for _, recipient := range email.To {
-			if pattern.MatchString(recipient) {
-				matched = true
-				break
+// routeRuns matches the routes for one message or recipient copy and adds
+// them to the result
+func (p *Processor) routeRuns(email *Email, result *ProcessingResult) []*routeRun {
+	matchedRoutes := p.findMatchingRoutes(email)
+	if email.Duplicate != nil {
+		matchedRoutes = p.dropDuplicate(email, matchedRoutes, result)
+	}
+	if len(matchedRoutes) == 0 {
+		return nil
+	}
+
+	for _, route := range matchedRoutes {
+		email.MatchedRoutes = append(email.MatchedRoutes, route.Name)
+		result.MatchedRoutes = appendUnique(result.MatchedRoutes, route.Name)
+	}
+	if email.Recipient != "" {
+		log.Printf("Matched routes for %s: %v", email.Recipient, email.MatchedRoutes)
+	} else {
+		log.Printf("Matched routes: %v", email.MatchedRoutes)
+	}
+
+	runs := make([]*routeRun, len(matchedRoutes))
+	for i, route := range matchedRoutes {
+		routeEmail := *email
+		runs[i] = &routeRun{route: route, email: &routeEmail}
+	}
+	return runs
+}
+
+// runRoutes runs either the screening actions or the remaining actions of
+// every route, and stops at the first verdict
+func (p *Processor) runRoutes(ctx context.Context, runs []*routeRun, screening bool, result *ProcessingResult) []actionOutcome {
+	var outcomes []actionOutcome
+	for _, run := range runs {
+		routeOutcomes := p.executeRoute(ctx, run, screening)
+		outcomes = append(outcomes, routeOutcomes...)
+
+		for _, outcome := range routeOutcomes {
+			outcome.result.Recipient = run.email.Recipient
+			result.Actions = append(result.Actions, outcome.result)
+			if outcome.err != nil {
+				run.failed = true
+				log.Printf("Action %s of route %s failed: %v", outcome.config.Type, run.route.Name, outcome.err)
+			}
+			if outcome.verdict != nil && result.Verdict == nil {
+				result.Verdict = outcome.verdict
 			}
 		}
-
-		if !matched {
-			return false
+		if result.Verdict != nil {
+			log.Printf("Route %s stopped processing: %v", run.route.Name, result.Verdict)
+			break
 		}
 	}
 
-	if route.Condition.SenderPattern != "" {
-		pattern, err := regexp.Compile(route.Condition.SenderPattern)
-		if err != nil {
-			log.Printf("Invalid sender pattern in route %s: %v", route.Name, err)
-			return false
+	return outcomes
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, existing := range values {
+		if existing == value {
+			return values
 		}
+	}
+	return append(values, value)
+}
+
+// checkDuplicate marks the message as a duplicate when an earlier copy was
+// seen within the dedup window. It returns the dedup key of a first copy, or
+// "" when there is nothing to record.
+func (p *Processor) checkDuplicate(email *Email) string {
+	if p.dedup == nil {
+		return ""
+	}
 
-		if !pattern.MatchString(email.From) {
-			return false
+	key := dedupKey(email)
+	if key == "" {
+		return ""
+	}
+
+	email.Duplicate = p.dedup.check(key, email.Envelope.ID, email.Envelope.Received)
+	if email.Duplicate != nil {
+		log.Printf("Message %s is a duplicate of %s", email.Envelope.ID, email.Duplicate.OriginalID)
+		return ""
+	}
+	return key
+}
+
+// dropDuplicate removes the routes that drop duplicate messages
+func (p *Processor) dropDuplicate(email *Email, routes []*config.CompiledRoute, result *ProcessingResult) []*config.CompiledRoute {
+	kept := routes[:0:0]
+	for _, route := range routes {
+		if route.DedupMode() == config.DedupDrop {
+			log.Printf("Route %s dropped duplicate message %s", route.Name, email.Envelope.ID)
+			result.DroppedRoutes = appendUnique(result.DroppedRoutes, route.Name)
+			continue
 		}
+		kept = append(kept, route)
 	}
 
-	if route.Condition.SubjectPattern != "" {
-		pattern, err := regexp.Compile(route.Condition.SubjectPattern)
-		if err != nil {
-			log.Printf("Invalid subject pattern in route %s: %v", route.Name, err)
-			return false
+	return kept
+}
+
+// finishDuplicate records where the first copy of a message was stored, or
+// forgets it when processing failed so the retry is handled normally
+func (p *Processor) finishDuplicate(key string, result *ProcessingResult, err error) {
+	if key == "" {
+		return
+	}
+
+	if err != nil {
+		p.dedup.forget(key)
+		return
+	}
+
+	var emls []string
+	for _, path := range result.Paths() {
+		// Link to the stored copy, not the original kept by modify actions
+		if strings.HasSuffix(path, ".eml") && !strings.HasSuffix(path, ".orig.eml") {
+			emls = append(emls, path)
 		}
+	}
+	if err := p.dedup.complete(key, emls); err != nil {
+		log.Printf("Failed to save dedup store: %v", err)
+	}
+}
 
-		if !pattern.MatchString(email.Subject) {
-			return false
+// AcceptsRecipient reports whether any enabled route could match the given
+// recipient. The SMTP layer uses it to score clients probing unknown addresses.
+func (p *Processor) AcceptsRecipient(recipient string) bool {
+	// Routes see the recipients after alias expansion
+	recipients := []string{recipient}
+	if p.aliases != nil {
+		recipients = p.aliases.expand(recipients)
+	}
+
+	for _, route := range p.routes.Routes {
+		if matchesAny(route.Matcher.Recipient, recipients) {
+			return true
 		}
 	}
 
-	return true
+	return false
 }
 
-func (p *Processor) executeRoute(email *Email, route config.RouteConfig) error {
-	for _, action := range route.Actions {
-		if !action.Enabled {
+// findMatchingRoutes returns the routes to run, in evaluation order. A final
+// route stops evaluation, and fallback routes are only considered when no
+// normal route matched.
+func (p *Processor) findMatchingRoutes(email *Email) []*config.CompiledRoute {
+	matched := p.matchRoutes(email, false)
+	if len(matched) == 0 {
+		matched = p.matchRoutes(email, true)
+	}
+	return matched
+}
+
+func (p *Processor) matchRoutes(email *Email, fallback bool) []*config.CompiledRoute {
+	var matched []*config.CompiledRoute
+
+	for _, route := range p.routes.Routes {
+		if route.IsFallback() != fallback {
 			continue
 		}
-
-		switch action.Type {
-		case "store_local":
-			if err := p.executeLocalStorage(email, action); err != nil {
-				return fmt.Errorf("local storage action failed: %w", err)
-			}
-		case "store_s3":
-			if err := p.executeS3Storage(email, action); err != nil {
-				return fmt.Errorf("S3 storage action failed: %w", err)
-			}
-		case "webhook":
-			if err := p.executeWebhook(email, action); err != nil {
-				return fmt.Errorf("webhook action failed: %w", err)
+		if p.routeMatches(email, route) {
+			matched = append(matched, route)
+			if route.Final {
+				break
 			}
-		default:
-			log.Printf("Unknown action type: %s", action.Type)
 		}
 	}
 
-	return nil
+	return matched
 }
 
-func (p *Processor) executeLocalStorage(email *Email, action config.Action) error {
-	folder := action.Config["folder"]
-	if folder == "" {
-		folder = "default"
+func (p *Processor) routeMatches(email *Email, route *config.CompiledRoute) bool {
+	return conditionMatches(email, route.Matcher)
+}
+
+// executeRoute runs one pass over the actions of a route and reports how each
+// one fared. The screening pass runs the attachment policy and the actions
+// that can refuse the message, the second pass everything else. Sequential
+// routes stop at the first failure whose on_error is not "continue";
+// parallel routes always run every action of the second pass.
+func (p *Processor) executeRoute(ctx context.Context, run *routeRun, screening bool) []actionOutcome {
+	if run.stopped {
+		return nil
+	}
+	route, email := run.route, run.email
+
+	var bound []*routeAction
+	if policy := p.policies[route]; policy != nil && screening {
+		bound = append(bound, policy)
+	}
+	for _, action := range p.actions[route] {
+		if action.screens == screening {
+			bound = append(bound, action)
+		}
 	}
+	outcomes := make([]actionOutcome, 0, len(bound))
+
+	if route.Parallel && !screening {
+		results := make([]actionOutcome, len(bound))
+		var wg sync.WaitGroup
+		for i, action := range bound {
+			wg.Add(1)
+			go func(i int, action *routeAction) {
+				defer wg.Done()
+				// Each action gets its own copy, so none sees the changes of another
+				results[i] = runAction(ctx, route.Name, action, email.clone())
+			}(i, action)
+		}
+		wg.Wait()
+		return append(outcomes, results...)
+	}
+
+	for _, action := range bound {
+		outcome := runAction(ctx, route.Name, action, email)
+		outcomes = append(outcomes, outcome)
+		if outcome.verdict != nil || (outcome.err != nil && action.config.ErrorPolicy() != config.OnErrorContinue) {
+			run.stopped = true
+			break
+		}
+	}
+
+	return outcomes
+}
 
+func (p *Processor) executeLocalStorage(ctx context.Context, email *Email, route config.RouteConfig, action config.Action) error {
 	filename := p.generateFilename(email)
-	uniqueID := p.generateUniqueID(email)
-	// Add year and month to the path
-	year := email.Date.Format("2006")
-	month := email.Date.Format("01")
-	
-	// Create folder path using timestamp-based unique ID
-	folderPath := fmt.Sprintf("%s/%s/%s/%s", folder, year, month, uniqueID)
+	folderPath := p.storagePath(email, route, action)
+
+	if p.linksDuplicate(email, route) {
+		return p.storeWebhookPayload(ctx, email, folderPath)
+	}
 	
 	// Store the EML file
 	emlPath := fmt.Sprintf("%s/%s", folderPath, filename)
 	if err := p.storageBackend.StoreLocal(emlPath, email.ToEML()); err != nil {
 		return fmt.Errorf("failed to store EML file: %w", err)
 	}
+	RecordStoredPath(ctx, emlPath)
+
+	if email.Modified != nil {
+		originalPath := strings.TrimSuffix(emlPath, ".eml") + ".orig.eml"
+		if err := p.storageBackend.StoreLocal(originalPath, email.Raw); err != nil {
+			return fmt.Errorf("failed to store original EML file: %w", err)
+		}
+		RecordStoredPath(ctx, originalPath)
+	}
+	
+	if p.wantsTranscript(email, route) {
+		if err := p.storageBackend.StoreLocal(folderPath+"/transcript.log", email.Envelope.Transcript); err != nil {
+			log.Printf("Failed to store transcript: %v", err)
+		} else {
+			RecordStoredPath(ctx, folderPath+"/transcript.log")
+		}
+	}
 	
 	// Store attachments as separate files
 	for _, attachment := range email.Attachments {
@@ -168,36 +490,47 @@ func (p *Processor) executeLocalStorage(email *Email, action config.Action) erro
 			log.Printf("Failed to store attachment %s: %v", attachment.Filename, err)
 			continue
 		}
+		RecordStoredPath(ctx, attachmentPath)
 	}
 	
 	// Store webhook payload as JSON file
-	if err := p.storeWebhookPayload(email, folderPath); err != nil {
+	if err := p.storeWebhookPayload(ctx, email, folderPath); err != nil {
 		log.Printf("Failed to store webhook payload: %v", err)
 	}
 	
 	return nil
 }
 
-func (p *Processor) executeS3Storage(email *Email, action config.Action) error {
-	folder := action.Config["folder"]
-	if folder == "" {
-		folder = "default"
-	}
-
+func (p *Processor) executeS3Storage(ctx context.Context, email *Email, route config.RouteConfig, action config.Action) error {
 	filename := p.generateFilename(email)
-	uniqueID := p.generateUniqueID(email)
-	// Add year and month to the path
-	year := email.Date.Format("2006")
-	month := email.Date.Format("01")
-	
-	// Create folder path using timestamp-based unique ID
-	folderPath := fmt.Sprintf("%s/%s/%s/%s", folder, year, month, uniqueID)
+	folderPath := p.storagePath(email, route, action)
+
+	if p.linksDuplicate(email, route) {
+		return p.storeWebhookPayload(ctx, email, folderPath)
+	}
 	
 	// Store the EML file
 	emlPath := fmt.Sprintf("%s/%s", folderPath, filename)
 	if err := p.storageBackend.StoreS3(emlPath, email.ToEML()); err != nil {
 		return fmt.Errorf("failed to store EML file: %w", err)
 	}
+	RecordStoredPath(ctx, emlPath)
+
+	if email.Modified != nil {
+		originalPath := strings.TrimSuffix(emlPath, ".eml") + ".orig.eml"
+		if err := p.storageBackend.StoreS3(originalPath, email.Raw); err != nil {
+			return fmt.Errorf("failed to store original EML file: %w", err)
+		}
+		RecordStoredPath(ctx, originalPath)
+	}
+	
+	if p.wantsTranscript(email, route) {
+		if err := p.storageBackend.StoreS3WithContentType(folderPath+"/transcript.log", email.Envelope.Transcript, "text/plain"); err != nil {
+			log.Printf("Failed to store transcript: %v", err)
+		} else {
+			RecordStoredPath(ctx, folderPath+"/transcript.log")
+		}
+	}
 	
 	// Store attachments as separate files
 	for _, attachment := range email.Attachments {
@@ -206,17 +539,18 @@ func (p *Processor) executeS3Storage(email *Email, action config.Action) error {
 			log.Printf("Failed to store attachment %s: %v", attachment.Filename, err)
 			continue
 		}
+		RecordStoredPath(ctx, attachmentPath)
 	}
 	
 	// Store webhook payload as JSON file
-	if err := p.storeWebhookPayload(email, folderPath); err != nil {
+	if err := p.storeWebhookPayload(ctx, email, folderPath); err != nil {
 		log.Printf("Failed to store webhook payload: %v", err)
 	}
 	
 	return nil
 }
 
-func (p *Processor) executeWebhook(email *Email, action config.Action) error {
+func (p *Processor) executeWebhook(ctx context.Context, email *Email, action config.Action) error {
 	url := action.Config["url"]
 	if url == "" {
 		return fmt.Errorf("webhook URL not specified")
@@ -237,60 +571,31 @@ func (p *Processor) executeWebhook(email *Email, action config.Action) error {
 		}
 	}
 
-	// Generate folder structure for paths - use current route's folder or find S3 folder
-	folder := p.getRouteFolder(email)
-	
-	filename := p.generateFilename(email)
-	uniqueID := p.generateUniqueID(email)
-	year := email.Date.Format("2006")
-	month := email.Date.Format("01")
-	folderPath := fmt.Sprintf("%s/%s/%s/%s", folder, year, month, uniqueID)
-	
-	// Generate markdown version of the email
-	markdownConverter := NewMarkdownConverter("https://img.example.com", folderPath)
-	markdownContent := markdownConverter.ConvertToMarkdown(email)
-	
-	payload := webhook.EmailPayload{
-		From:        email.From,
-		To:          email.To,
-		Subject:     email.Subject,
-		Date:        email.Date,
-		MessageID:   email.MessageID,
-		Body:        email.Body,
-		HTMLBody:    email.HTMLBody,
-		Markdown:    markdownContent,
-		Headers:     email.Headers,
-		Attachments: make([]webhook.AttachmentInfo, len(email.Attachments)),
-		EMLPath:     fmt.Sprintf("%s/%s", folderPath, filename),
-	}
+	payload := p.buildPayload(email, p.defaultFolderPath(email))
 
-	for i, att := range email.Attachments {
-		payload.Attachments[i] = webhook.AttachmentInfo{
-			Filename:    att.Filename,
-			ContentType: att.ContentType,
-			Size:        att.Size,
-			S3Path:      fmt.Sprintf("%s/%s", folderPath, att.Filename),
-		}
+	// Lets receivers drop deliveries they already handled
+	if _, ok := headers["Idempotency-Key"]; !ok && email.Envelope.ID != "" {
+		headers["Idempotency-Key"] = email.Envelope.ID
 	}
 
-	return p.webhookClient.SendWebhook(url, method, headers, payload)
+	status, err := p.webhookClient.SendWebhookContext(ctx, url, method, headers, payload)
+	if status != 0 {
+		RecordWebhookStatus(ctx, status)
+	}
+	return err
 }
 
+// generateUniqueID returns the ID the message was assigned at receipt.
+// Messages built in code without one get an ID derived from their content,
+// so repeated calls agree.
 func (p *Processor) generateUniqueID(email *Email) string {
-	// Use microseconds for better uniqueness to avoid collisions
-	timestamp := email.Date.Format("20060102_150405.000000")
-	
-	// If there's a MessageID, include a short hash for extra uniqueness
-	if email.MessageID != "" {
-		// Create a short hash from MessageID to ensure uniqueness
-		hash := fmt.Sprintf("%x", []byte(email.MessageID))
-		if len(hash) > 8 {
-			hash = hash[:8]
-		}
-		return fmt.Sprintf("%s_%s", timestamp, hash)
+	if email.Envelope.ID != "" {
+		return email.Envelope.ID
 	}
-	
-	return timestamp
+
+	timestamp := email.Date.Format("20060102_150405.000000")
+	sum := sha256.Sum256(append([]byte(email.MessageID+"\n"), email.Raw...))
+	return fmt.Sprintf("%s_%x", timestamp, sum[:4])
 }
 
 func (p *Processor) generateFilename(email *Email) string {
@@ -318,6 +623,16 @@ func (p *Processor) GenerateFilename(email *Email) string {
 	return p.generateFilename(email)
 }
 
+// MatchingRoutes returns the names of the enabled routes that match an email
+// (public method for testing)
+func (p *Processor) MatchingRoutes(email *Email) []string {
+	var names []string
+	for _, route := range p.findMatchingRoutes(email) {
+		names = append(names, route.Name)
+	}
+	return names
+}
+
 // GetRouteFolder gets the folder name from the current route actions (public method for testing)
 func (p *Processor) GetRouteFolder(email *Email) string {
 	return p.getRouteFolder(email)
@@ -325,8 +640,7 @@ func (p *Processor) GetRouteFolder(email *Email) string {
 
 // findS3StorageAction looks for an S3 storage action in the current routes
 func (p *Processor) findS3StorageAction(email *Email) *config.Action {
-	routes := p.config.GetEnabledRoutes()
-	matchedRoutes := p.findMatchingRoutes(email, routes)
+	matchedRoutes := p.findMatchingRoutes(email)
 	
 	for _, route := range matchedRoutes {
 		for _, action := range route.Actions {
@@ -340,8 +654,7 @@ func (p *Processor) findS3StorageAction(email *Email) *config.Action {
 
 // getRouteFolder gets the folder name from the current route actions
 func (p *Processor) getRouteFolder(email *Email) string {
-	routes := p.config.GetEnabledRoutes()
-	matchedRoutes := p.findMatchingRoutes(email, routes)
+	matchedRoutes := p.findMatchingRoutes(email)
 	
 	for _, route := range matchedRoutes {
 		for _, action := range route.Actions {
@@ -354,28 +667,50 @@ func (p *Processor) getRouteFolder(email *Email) string {
 	return "default"
 }
 
-// storeWebhookPayload creates and stores the webhook payload as a JSON file
-func (p *Processor) storeWebhookPayload(email *Email, folderPath string) error {
-	// Use the folderPath that was passed in - it's already correctly constructed
+// defaultFolderPath returns the storage folder of a message for actions that
+// do not store it themselves: where the first storage action of the matched
+// routes puts it, or else the folder of the first route that sets one
+func (p *Processor) defaultFolderPath(email *Email) string {
+	for _, route := range p.findMatchingRoutes(email) {
+		for _, action := range route.Actions {
+			if action.Enabled && (action.Type == "store_local" || action.Type == "store_s3") {
+				return p.storagePath(email, route.RouteConfig, action)
+			}
+		}
+	}
+
+	folder := p.getRouteFolder(email)
+	uniqueID := p.generateUniqueID(email)
+	year := email.Envelope.Received.Format("2006")
+	month := email.Envelope.Received.Format("01")
+	return fmt.Sprintf("%s/%s/%s/%s", folder, year, month, uniqueID)
+}
+
+// buildPayload creates the JSON payload describing a message stored under
+// folderPath
+func (p *Processor) buildPayload(email *Email, folderPath string) webhook.EmailPayload {
 	filename := p.generateFilename(email)
-	baseFilename := strings.TrimSuffix(filename, ".eml")
-	
+
 	// Generate markdown version of the email
 	markdownConverter := NewMarkdownConverter("https://img.example.com", folderPath)
 	markdownContent := markdownConverter.ConvertToMarkdown(email)
 	
 	payload := webhook.EmailPayload{
-		From:        email.From,
-		To:          email.To,
-		Subject:     email.Subject,
-		Date:        email.Date,
-		MessageID:   email.MessageID,
-		Body:        email.Body,
-		HTMLBody:    email.HTMLBody,
-		Markdown:    markdownContent,
-		Headers:     email.Headers,
-		Attachments: make([]webhook.AttachmentInfo, len(email.Attachments)),
-		EMLPath:     fmt.Sprintf("%s/%s", folderPath, filename),
+		ID:            email.Envelope.ID,
+		Recipient:     email.Recipient,
+		From:          email.From,
+		To:            email.To,
+		OriginalTo:    email.Envelope.OriginalTo,
+		Subject:       email.Subject,
+		Date:          email.Date,
+		MessageID:     email.MessageID,
+		Body:          email.Body,
+		HTMLBody:      email.HTMLBody,
+		Markdown:      markdownContent,
+		Headers:       email.Headers,
+		Attachments:   make([]webhook.AttachmentInfo, len(email.Attachments)),
+		EMLPath:       fmt.Sprintf("%s/%s", folderPath, filename),
+		MatchedRoutes: email.MatchedRoutes,
 	}
 
 	for i, att := range email.Attachments {
@@ -385,30 +720,125 @@ func (p *Processor) storeWebhookPayload(email *Email, folderPath string) error {
 			Size:        att.Size,
 			S3Path:      fmt.Sprintf("%s/%s", folderPath, att.Filename),
 		}
+		if att.OriginalFilename != att.Filename {
+			payload.Attachments[i].OriginalFilename = att.OriginalFilename
+		}
+	}
+
+	if len(email.AttachmentDecisions) > 0 {
+		payload.AttachmentPolicy = email.AttachmentDecisions
+	}
+	if email.VirusScan != nil {
+		payload.VirusScan = email.VirusScan
 	}
+	if email.Spam != nil {
+		payload.Spam = email.Spam
+	}
+	if email.Classification != nil {
+		payload.Classification = email.Classification
+	}
+
+	if len(email.Recipients) > 0 {
+		payload.Recipients = email.Recipients
+	}
+	if email.Duplicate != nil {
+		payload.Duplicate = email.Duplicate
+	}
+
+	return payload
+}
+
+// storeWebhookPayload creates the webhook payload and stores it as a JSON
+// file. During processing the write is deferred until the processing result
+// is known.
+func (p *Processor) storeWebhookPayload(ctx context.Context, email *Email, folderPath string) error {
+	// Use the folderPath that was passed in - it's already correctly constructed
+	filename := p.generateFilename(email)
+	baseFilename := strings.TrimSuffix(filename, ".eml")
+	
+	payload := p.buildPayload(email, folderPath)
 	
+	jsonPath := fmt.Sprintf("%s/%s.json", folderPath, baseFilename)
+	if recordPayload(ctx, jsonPath, payload) {
+		return nil
+	}
+
+	return p.writePayload(pendingPayload{path: jsonPath, payload: payload}, nil)
+}
+
+// writePayload stores a JSON payload, including the processing result when
+// one is given
+func (p *Processor) writePayload(pending pendingPayload, result *ProcessingResult) error {
+	payload := pending.payload
+	if result != nil {
+		payload.Processing = result
+	}
+
 	// Marshal payload to JSON
 	jsonData, err := json.MarshalIndent(payload, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal webhook payload: %w", err)
 	}
 	
-	// Store JSON file
-	jsonPath := fmt.Sprintf("%s/%s.json", folderPath, baseFilename)
-	
 	// Try S3 storage first if enabled
 	if p.config.Storage.S3Compatible.Enabled {
-		if err := p.storageBackend.StoreS3WithContentType(jsonPath, jsonData, "application/json"); err != nil {
+		if err := p.storageBackend.StoreS3WithContentType(pending.path, jsonData, "application/json"); err != nil {
 			return fmt.Errorf("failed to store JSON to S3: %w", err)
 		}
 	}
 	
 	// Store locally if enabled
 	if p.config.Storage.Local.Enabled {
-		if err := p.storageBackend.StoreLocal(jsonPath, jsonData); err != nil {
+		if err := p.storageBackend.StoreLocal(pending.path, jsonData); err != nil {
 			return fmt.Errorf("failed to store JSON locally: %w", err)
 		}
 	}
 	
 	return nil
-}
\ No newline at end of file
+}
+
+// linksDuplicate reports whether a storage action only writes the JSON
+// payload, which points at the stored original, instead of another copy
+func (p *Processor) linksDuplicate(email *Email, route config.RouteConfig) bool {
+	return email.Duplicate != nil && route.DedupMode() == config.DedupLink
+}
+
+// wantsTranscript reports whether the session transcript is stored with the
+// message for this route
+func (p *Processor) wantsTranscript(email *Email, route config.RouteConfig) bool {
+	if email.Envelope.Transcript == nil {
+		return false
+	}
+	return route.Transcript || p.config.Server.Transcript.RecordsListener(email.Envelope.Listener)
+}
+
+// StoreRejectedTranscript keeps the transcript of a session that did not
+// deliver any message, so failed integrations can be debugged.
+func (p *Processor) StoreRejectedTranscript(started time.Time, remoteAddr string, transcript []byte) error {
+	folder := p.config.Server.Transcript.RejectedFolder
+	if folder == "" {
+		folder = "rejected"
+	}
+
+	remote := strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(remoteAddr)
+	if remote == "" {
+		remote = "local"
+	}
+
+	path := fmt.Sprintf("%s/%s/%s/%s_%s/transcript.log", folder,
+		started.Format("2006"), started.Format("01"), started.Format("20060102_150405.000000"), remote)
+
+	if p.config.Storage.S3Compatible.Enabled {
+		if err := p.storageBackend.StoreS3WithContentType(path, transcript, "text/plain"); err != nil {
+			return fmt.Errorf("failed to store transcript to S3: %w", err)
+		}
+	}
+
+	if p.config.Storage.Local.Enabled {
+		if err := p.storageBackend.StoreLocal(path, transcript); err != nil {
+			return fmt.Errorf("failed to store transcript locally: %w", err)
+		}
+	}
+
+	return nil
+}
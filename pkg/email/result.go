@@ -0,0 +1,175 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slav123/email-catch/internal/webhook"
+)
+
+const (
+	ActionStatusOK     = "ok"
+	ActionStatusFailed = "failed"
+)
+
+// ProcessingResult describes what happened to a message: which routes it
+// matched and how each of their actions fared.
+type ProcessingResult struct {
+	// ID is the server-assigned message ID, see Envelope.ID
+	ID            string         `json:"id"`
+	MessageID     string         `json:"message_id"`
+	MatchedRoutes []string       `json:"matched_routes"`
+	Actions       []ActionResult `json:"actions"`
+	// Duplicate is set when an earlier copy of the message was seen
+	Duplicate *Duplicate `json:"duplicate,omitempty"`
+	// DroppedRoutes matched but skipped the message as a duplicate
+	DroppedRoutes []string `json:"dropped_routes,omitempty"`
+	// Verdict is set when an action such as reject or quarantine stopped
+	// processing
+	Verdict *Verdict `json:"verdict,omitempty"`
+}
+
+// ActionResult is the outcome of one action for one message
+type ActionResult struct {
+	Route string `json:"route"`
+	// Recipient is set when routing per recipient
+	Recipient string        `json:"recipient,omitempty"`
+	Type      string        `json:"type"`
+	Status    string        `json:"status"`
+	Duration  time.Duration `json:"-"`
+	Error     string        `json:"error,omitempty"`
+	// Paths are the storage keys the action wrote
+	Paths []string `json:"paths,omitempty"`
+	// WebhookStatus is the HTTP status the webhook answered with, if any
+	WebhookStatus int `json:"webhook_status,omitempty"`
+}
+
+// MarshalJSON adds the duration in milliseconds
+func (r ActionResult) MarshalJSON() ([]byte, error) {
+	type plain ActionResult
+	return json.Marshal(struct {
+		plain
+		DurationMs float64 `json:"duration_ms"`
+	}{plain(r), float64(r.Duration.Microseconds()) / 1000})
+}
+
+// Paths returns every storage key written for the message
+func (r *ProcessingResult) Paths() []string {
+	var paths []string
+	for _, action := range r.Actions {
+		paths = append(paths, action.Paths...)
+	}
+	return paths
+}
+
+// Failed returns the actions that did not succeed
+func (r *ProcessingResult) Failed() []ActionResult {
+	var failed []ActionResult
+	for _, action := range r.Actions {
+		if action.Status != ActionStatusOK {
+			failed = append(failed, action)
+		}
+	}
+	return failed
+}
+
+// Summary returns a one-line description for logging
+func (r *ProcessingResult) Summary() string {
+	if len(r.MatchedRoutes) == 0 {
+		return "no matching routes"
+	}
+
+	parts := make([]string, 0, len(r.Actions))
+	for _, action := range r.Actions {
+		part := fmt.Sprintf("%s/%s=%s (%v", action.Route, action.Type, action.Status, action.Duration.Round(time.Millisecond))
+		if len(action.Paths) > 0 {
+			part += fmt.Sprintf(", %d objects", len(action.Paths))
+		}
+		if action.WebhookStatus != 0 {
+			part += fmt.Sprintf(", HTTP %d", action.WebhookStatus)
+		}
+		if action.Error != "" {
+			part += ", " + action.Error
+		}
+		parts = append(parts, part+")")
+	}
+
+	summary := fmt.Sprintf("routes %v, actions: %s", r.MatchedRoutes, strings.Join(parts, "; "))
+	if r.Verdict != nil {
+		summary += fmt.Sprintf(", stopped by %s: %v", r.Verdict.Route, r.Verdict)
+	}
+	return summary
+}
+
+// actionRecorder collects what an action reports while it runs. Actions
+// that outlive their timeout may still report, hence the lock.
+type actionRecorder struct {
+	mu            sync.Mutex
+	paths         []string
+	webhookStatus int
+	payloads      []pendingPayload
+}
+
+// pendingPayload is a JSON payload written once the message is fully
+// processed, so it can include the processing result
+type pendingPayload struct {
+	path    string
+	payload webhook.EmailPayload
+}
+
+type recorderKey struct{}
+
+func withRecorder(ctx context.Context, recorder *actionRecorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, recorder)
+}
+
+func recorderFrom(ctx context.Context) *actionRecorder {
+	recorder, _ := ctx.Value(recorderKey{}).(*actionRecorder)
+	return recorder
+}
+
+// RecordStoredPath adds a storage key to the result of the running action.
+// Custom actions call it with the context passed to Execute.
+func RecordStoredPath(ctx context.Context, path string) {
+	if recorder := recorderFrom(ctx); recorder != nil {
+		recorder.mu.Lock()
+		recorder.paths = append(recorder.paths, path)
+		recorder.mu.Unlock()
+	}
+}
+
+// RecordWebhookStatus sets the HTTP status reported for the running action
+func RecordWebhookStatus(ctx context.Context, status int) {
+	if recorder := recorderFrom(ctx); recorder != nil {
+		recorder.mu.Lock()
+		recorder.webhookStatus = status
+		recorder.mu.Unlock()
+	}
+}
+
+func recordPayload(ctx context.Context, path string, payload webhook.EmailPayload) bool {
+	recorder := recorderFrom(ctx)
+	if recorder == nil {
+		return false
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	recorder.paths = append(recorder.paths, path)
+	recorder.payloads = append(recorder.payloads, pendingPayload{path: path, payload: payload})
+	return true
+}
+
+// snapshot copies what was reported so far into the action result
+func (r *actionRecorder) snapshot(result *ActionResult) []pendingPayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result.Paths = append([]string(nil), r.paths...)
+	result.WebhookStatus = r.webhookStatus
+	return append([]pendingPayload(nil), r.payloads...)
+}
@@ -0,0 +1,107 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/spamd"
+)
+
+// SpamResult is the verdict of spamd on a message
+type SpamResult struct {
+	Score     float64 `json:"score"`
+	Threshold float64 `json:"threshold"`
+	IsSpam    bool    `json:"is_spam"`
+	// Rules lists the names of the SpamAssassin rules that hit
+	Rules []string `json:"rules,omitempty"`
+}
+
+// spamChecker scores messages with spamd before routing
+type spamChecker struct {
+	config config.SpamConfig
+	client *spamd.Client
+	err    error
+}
+
+func newSpamChecker(cfg config.SpamConfig) *spamChecker {
+	client, err := spamd.NewClient(spamd.Config{
+		Address: cfg.Address,
+		User:    cfg.User,
+		Timeout: time.Duration(cfg.TimeoutMs) * time.Millisecond,
+	})
+	if err != nil {
+		log.Printf("Spam checks will fail: %v", err)
+	}
+	return &spamChecker{config: cfg, client: client, err: err}
+}
+
+// check scores the message and records the result on it. A failed check
+// is an error only when the checker fails closed.
+func (c *spamChecker) check(ctx context.Context, email *Email) error {
+	if c.config.MaxSize > 0 && int64(len(email.Raw)) > c.config.MaxSize {
+		log.Printf("Not checking %s for spam: larger than %d bytes", email.Envelope.ID, c.config.MaxSize)
+		return nil
+	}
+
+	err := c.err
+	var result spamd.Result
+	if err == nil {
+		result, err = c.client.Check(ctx, email.Raw)
+	}
+	if err != nil {
+		if c.config.Fail == config.SpamFailClosed {
+			return &DeliveryError{
+				Temporary: true,
+				Err:       fmt.Errorf("spam check failed: %w", err),
+				Code:      451,
+				Message:   "4.7.1 Unable to check message for spam, please try again later",
+			}
+		}
+		log.Printf("Spam check of %s failed, routing it unscored: %v", email.Envelope.ID, err)
+		return nil
+	}
+
+	email.Spam = &SpamResult{
+		Score:     result.Score,
+		Threshold: result.Threshold,
+		IsSpam:    result.Spam,
+		Rules:     result.Rules,
+	}
+	log.Printf("Spam score of %s: %.1f/%.1f", email.Envelope.ID, result.Score, result.Threshold)
+
+	if c.config.AddHeaders {
+		if err := email.addSpamHeaders(); err != nil {
+			log.Printf("Failed to add spam headers to %s: %v", email.Envelope.ID, err)
+		}
+	}
+	return nil
+}
+
+// addSpamHeaders records the spam verdict in SpamAssassin's headers
+func (e *Email) addSpamHeaders() error {
+	spam := e.Spam
+	flag, status := "NO", "No"
+	if spam.IsSpam {
+		flag, status = "YES", "Yes"
+	}
+	score := strconv.FormatFloat(spam.Score, 'f', 1, 64)
+	tests := strings.Join(spam.Rules, ",")
+	if tests == "" {
+		tests = "none"
+	}
+
+	msg := splitRawMessage(e.ToEML())
+	msg.set("X-Spam-Flag", flag)
+	msg.set("X-Spam-Score", score)
+	msg.set("X-Spam-Status", fmt.Sprintf("%s, score=%s required=%.1f tests=%s", status, score, spam.Threshold, tests))
+
+	if err := e.setModified(msg.bytes()); err != nil {
+		return fmt.Errorf("failed to add spam headers: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package email
+
+import (
+	"os"
+	"time"
+)
+
+// watchedFile loads a file again whenever its size or modification time
+// changes, so edits take effect without a restart
+type watchedFile struct {
+	path string
+	load func(path string) error
+
+	modTime time.Time
+	size    int64
+}
+
+// refresh calls load if the file changed since it was last seen and returns
+// its error. A file that cannot be read or loaded leaves the caller's
+// previous version in place; a missing file is not reported.
+func (w *watchedFile) refresh() error {
+	info, err := os.Stat(w.path)
+	if err != nil || (info.ModTime().Equal(w.modTime) && info.Size() == w.size) {
+		return nil
+	}
+	// Remember the version even when it is broken, so it is reported once
+	w.modTime, w.size = info.ModTime(), info.Size()
+	return w.load(w.path)
+}
@@ -0,0 +1,49 @@
+package emailcatch
+
+import (
+	"strings"
+
+	"github.com/slav123/email-catch/pkg/email"
+)
+
+// Matcher selects messages in WaitFor
+type Matcher func(msg *email.Email) bool
+
+// To matches messages with the given envelope recipient (case-insensitive)
+func To(address string) Matcher {
+	return func(msg *email.Email) bool {
+		for _, recipient := range msg.To {
+			if strings.EqualFold(recipient, address) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// From matches messages whose sender contains the given address
+func From(address string) Matcher {
+	return func(msg *email.Email) bool {
+		return strings.Contains(strings.ToLower(msg.From), strings.ToLower(address)) ||
+			strings.EqualFold(msg.Envelope.From, address)
+	}
+}
+
+// SubjectContains matches messages whose subject contains text
+func SubjectContains(text string) Matcher {
+	return func(msg *email.Email) bool {
+		return strings.Contains(msg.Subject, text)
+	}
+}
+
+// All matches messages that satisfy every matcher
+func All(matchers ...Matcher) Matcher {
+	return func(msg *email.Email) bool {
+		for _, match := range matchers {
+			if !match(msg) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,241 @@
+// Package emailcatch runs an email-catch SMTP server inside the current
+// process, for use in Go tests in the same way as net/http/httptest:
+//
+//	srv := emailcatch.NewTestServer(t)
+//	sendSignupMail(srv.Addr)
+//	msg, err := srv.WaitFor(emailcatch.To("new-user@example.com"), 5*time.Second)
+//
+// The server listens on a random loopback port and keeps everything it
+// stores in memory.
+package emailcatch
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/smtp"
+	"github.com/slav123/email-catch/internal/storage"
+	"github.com/slav123/email-catch/internal/webhook"
+	"github.com/slav123/email-catch/pkg/email"
+)
+
+// Server is a running in-process SMTP server
+type Server struct {
+	// Addr is the host:port the server listens on
+	Addr string
+
+	server    *smtp.Server
+	processor *email.Processor
+	storage   *storage.MemoryBackend
+	messages  chan *email.Email
+
+	mu      sync.Mutex
+	emails  []*email.Email
+	arrived chan struct{}
+	closed  bool
+	// resets counts calls to Reset, so WaitFor knows to start over
+	resets int
+}
+
+// Option customizes the configuration of the embedded server
+type Option func(cfg *config.Config)
+
+// WithConfig lets a test adjust the generated configuration, for example to
+// add routes, fault rules or tarpit settings.
+func WithConfig(fn func(cfg *config.Config)) Option {
+	return Option(fn)
+}
+
+// TB is the subset of testing.TB used by NewTestServer
+type TB interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+	Cleanup(func())
+}
+
+// NewTestServer starts a server and stops it when the test finishes. It fails
+// the test if the server cannot be started.
+func NewTestServer(t TB, opts ...Option) *Server {
+	t.Helper()
+
+	srv, err := NewServer(opts...)
+	if err != nil {
+		t.Fatalf("emailcatch: %v", err)
+	}
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// NewServer starts a server on a random loopback port. By default every
+// message is accepted and stored in memory under the "emails" folder.
+func NewServer(opts ...Option) (*Server, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if err := config.Prepare(cfg); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	backend := storage.NewMemoryBackend()
+	processor := email.NewProcessor(cfg, backend, webhook.NewClient())
+
+	srv := &Server{
+		processor: processor,
+		storage:   backend,
+		messages:  make(chan *email.Email, 1000),
+		arrived:   make(chan struct{}),
+	}
+	processor.OnProcessed(srv.receive)
+
+	srv.server = smtp.NewServer(cfg, processor)
+	if err := srv.server.Start(); err != nil {
+		processor.Close()
+		return nil, fmt.Errorf("failed to start server: %w", err)
+	}
+
+	addrs := srv.server.Addrs()
+	if len(addrs) == 0 {
+		srv.server.Stop()
+		processor.Close()
+		return nil, fmt.Errorf("server has no listeners")
+	}
+	srv.Addr = addrs[0].String()
+
+	return srv, nil
+}
+
+func defaultConfig() *config.Config {
+	return &config.Config{
+		Server: config.ServerConfig{
+			Ports:    []int{0},
+			Hostname: "127.0.0.1",
+		},
+		Storage: config.StorageConfig{
+			Local: config.LocalConfig{
+				Enabled: true,
+			},
+		},
+		Routes: []config.RouteConfig{
+			{
+				Name:    "emailcatch",
+				Enabled: true,
+				Condition: config.Condition{
+					RecipientPattern: ".*",
+				},
+				Actions: []config.Action{
+					{
+						Type:    "store_local",
+						Enabled: true,
+						Config: map[string]string{
+							"folder": "emails",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (s *Server) receive(msg *email.Email) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.emails = append(s.emails, msg)
+
+	// Wake up everyone waiting for a new message
+	close(s.arrived)
+	s.arrived = make(chan struct{})
+
+	select {
+	case s.messages <- msg:
+	default:
+		// Nobody is draining the channel; Emails and WaitFor still see it
+	}
+}
+
+// Messages returns a channel that receives every parsed message. It is
+// buffered; messages that do not fit are still available through Emails.
+func (s *Server) Messages() <-chan *email.Email {
+	return s.messages
+}
+
+// Emails returns all messages received so far, oldest first
+func (s *Server) Emails() []*email.Email {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*email.Email(nil), s.emails...)
+}
+
+// Stored returns an object written by a storage action, such as the EML or
+// JSON payload, and all stored paths can be listed with StoredPaths.
+func (s *Server) Stored(path string) ([]byte, bool) {
+	return s.storage.Get(path)
+}
+
+// StoredPaths lists everything written by storage actions
+func (s *Server) StoredPaths() []string {
+	return s.storage.Paths()
+}
+
+// Reset forgets all received messages
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.emails = nil
+	s.resets++
+}
+
+// WaitFor returns the first received message that satisfies match, waiting
+// up to timeout for it to arrive. Messages received before the call count.
+func (s *Server) WaitFor(match Matcher, timeout time.Duration) (*email.Email, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	seen, resets := 0, 0
+	for {
+		s.mu.Lock()
+		if s.resets != resets {
+			seen, resets = 0, s.resets
+		}
+		pending := s.emails[seen:]
+		arrived := s.arrived
+		seen = len(s.emails)
+		s.mu.Unlock()
+
+		for _, msg := range pending {
+			if match == nil || match(msg) {
+				return msg, nil
+			}
+		}
+
+		select {
+		case <-arrived:
+		case <-deadline.C:
+			return nil, fmt.Errorf("no matching email received within %s", timeout)
+		}
+	}
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	s.server.Stop()
+	s.processor.Close()
+}
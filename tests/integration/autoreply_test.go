@@ -0,0 +1,92 @@
+package integration
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/storage"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/slav123/email-catch/pkg/emailcatch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func autoreplyProcessor(t *testing.T, upstream, cacheFile string) *email.Processor {
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(upstream)
+	require.NoError(t, err)
+
+	cfg := &config.Config{
+		Server:  config.ServerConfig{Hostname: "catch.example"},
+		Storage: config.StorageConfig{Local: config.LocalConfig{Enabled: true}},
+		Routes: []config.RouteConfig{{
+			Name:      "support",
+			Enabled:   true,
+			Condition: config.Condition{RecipientPattern: "^support@"},
+			Actions: []config.Action{{
+				Type:    "autoreply",
+				Enabled: true,
+				Config: map[string]string{
+					"host":       host,
+					"port":       port,
+					"tls":        "none",
+					"from":       "Support <support@catch.example>",
+					"subject":    "Re: {{.Subject}} [#{{.ID}}]",
+					"body":       "Hello {{.From}},\nwe received your message \"{{.Subject}}\".",
+					"html":       "<p>Hello {{.From}}</p>",
+					"cache_file": cacheFile,
+				},
+			}},
+		}},
+	}
+
+	return email.NewProcessor(cfg, storage.NewMemoryBackend(), nil)
+}
+
+func sendToSupport(t *testing.T, processor *email.Processor, from, headers string) {
+	t.Helper()
+
+	raw := []byte("From: " + from + "\r\nTo: support@catch.example\r\nSubject: Broken login\r\nMessage-ID: <q1@customer.test>\r\n" + headers + "\r\nIt does not work.\r\n")
+	_, err := processor.ProcessEmail(from, []string{"support@catch.example"}, raw)
+	require.NoError(t, err)
+}
+
+func TestAutoreply(t *testing.T) {
+	upstream := emailcatch.NewTestServer(t)
+	cacheFile := filepath.Join(t.TempDir(), "autoreply.json")
+	processor := autoreplyProcessor(t, upstream.Addr, cacheFile)
+
+	sendToSupport(t, processor, "alice@customer.test", "")
+
+	reply, err := upstream.WaitFor(emailcatch.To("alice@customer.test"), 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "", reply.Envelope.From, "replies use the null sender")
+	assert.Contains(t, reply.Subject, "Re: Broken login [#")
+	assert.Contains(t, reply.Body, "we received your message \"Broken login\"")
+	assert.Contains(t, reply.HTMLBody, "<p>Hello alice@customer.test</p>")
+	assert.Equal(t, []string{"auto-replied"}, reply.Headers["Auto-Submitted"])
+	assert.Equal(t, []string{"<q1@customer.test>"}, reply.Headers["In-Reply-To"])
+
+	// Automatic mail, list mail and bounces never get a reply
+	sendToSupport(t, processor, "bob@customer.test", "Auto-Submitted: auto-generated\r\n")
+	sendToSupport(t, processor, "carol@customer.test", "List-Id: <users.lists.test>\r\n")
+	sendToSupport(t, processor, "MAILER-DAEMON@customer.test", "")
+	sendToSupport(t, processor, "", "")
+
+	// A second message from the same sender is rate limited, even after a
+	// restart thanks to the cache file
+	sendToSupport(t, processor, "alice@customer.test", "")
+	sendToSupport(t, autoreplyProcessor(t, upstream.Addr, cacheFile), "alice@customer.test", "")
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Len(t, upstream.Emails(), 1)
+
+	data, err := os.ReadFile(cacheFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "alice@customer.test")
+}
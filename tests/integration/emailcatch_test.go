@@ -0,0 +1,112 @@
+package integration
+
+import (
+	netsmtp "net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/pkg/emailcatch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedServerWaitFor(t *testing.T) {
+	srv := emailcatch.NewTestServer(t)
+	require.NotEmpty(t, srv.Addr)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		netsmtp.SendMail(srv.Addr, nil, "app@example.com", []string{"other@example.com"},
+			[]byte("Subject: Unrelated\r\n\r\nIgnore me.\r\n"))
+		netsmtp.SendMail(srv.Addr, nil, "app@example.com", []string{"new-user@example.com"},
+			[]byte("Subject: Welcome aboard\r\n\r\nClick the link.\r\n"))
+	}()
+
+	msg, err := srv.WaitFor(emailcatch.All(
+		emailcatch.To("new-user@example.com"),
+		emailcatch.SubjectContains("Welcome"),
+	), 5*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, "app@example.com", msg.Envelope.From)
+	assert.Contains(t, msg.Body, "Click the link.")
+	assert.Len(t, srv.Emails(), 2)
+
+	var emlStored bool
+	for _, path := range srv.StoredPaths() {
+		if strings.HasPrefix(path, "emails/") && strings.HasSuffix(path, ".eml") {
+			emlStored = true
+		}
+	}
+	assert.True(t, emlStored, "expected an EML in memory storage, got %v", srv.StoredPaths())
+}
+
+func TestEmbeddedServerWaitForTimeout(t *testing.T) {
+	srv := emailcatch.NewTestServer(t)
+
+	_, err := srv.WaitFor(emailcatch.To("nobody@example.com"), 100*time.Millisecond)
+	assert.Error(t, err)
+}
+
+func TestEmbeddedServerMessagesChannel(t *testing.T) {
+	srv := emailcatch.NewTestServer(t)
+
+	err := netsmtp.SendMail(srv.Addr, nil, "app@example.com", []string{"a@example.com"},
+		[]byte("Subject: Via channel\r\n\r\nHi.\r\n"))
+	require.NoError(t, err)
+
+	select {
+	case msg := <-srv.Messages():
+		assert.Equal(t, "Via channel", msg.Subject)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+	}
+}
+
+func TestEmbeddedServerResetDuringWaitFor(t *testing.T) {
+	srv := emailcatch.NewTestServer(t)
+
+	for _, rcpt := range []string{"first@example.com", "second@example.com"} {
+		require.NoError(t, netsmtp.SendMail(srv.Addr, nil, "app@example.com", []string{rcpt},
+			[]byte("Subject: Early\r\n\r\nHi.\r\n")))
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		srv.Reset()
+		netsmtp.SendMail(srv.Addr, nil, "app@example.com", []string{"late@example.com"},
+			[]byte("Subject: Late\r\n\r\nHi.\r\n"))
+	}()
+
+	msg, err := srv.WaitFor(emailcatch.To("late@example.com"), 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "Late", msg.Subject)
+}
+
+func TestEmbeddedServerAppliesConfigDefaults(t *testing.T) {
+	srv := emailcatch.NewTestServer(t, emailcatch.WithConfig(func(cfg *config.Config) {
+		// The dedup window is left to its default
+		cfg.Dedup.Enabled = true
+		cfg.Routes[0].Dedup = config.DedupDrop
+	}))
+
+	message := []byte("Message-ID: <once@example.com>\r\nSubject: Twice\r\n\r\nHi.\r\n")
+	for i := 0; i < 2; i++ {
+		require.NoError(t, netsmtp.SendMail(srv.Addr, nil, "app@example.com", []string{"a@example.com"}, message))
+	}
+
+	var stored int
+	for _, path := range srv.StoredPaths() {
+		if strings.HasSuffix(path, ".eml") {
+			stored++
+		}
+	}
+	assert.Equal(t, 1, stored, "expected the copy to be dropped, got %v", srv.StoredPaths())
+
+	_, err := emailcatch.NewServer(emailcatch.WithConfig(func(cfg *config.Config) {
+		cfg.Routes[0].Actions[0].Type = "store_nowhere"
+	}))
+	assert.Error(t, err)
+}
@@ -0,0 +1,110 @@
+package integration
+
+import (
+	"errors"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"os"
+	"testing"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/smtp"
+	"github.com/slav123/email-catch/internal/storage"
+	"github.com/slav123/email-catch/internal/webhook"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startFaultServer(t *testing.T, port int, rules []config.FaultRule) {
+	tempDir, err := os.MkdirTemp("", "email-faults-test-*")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	cfg := createTestConfig(tempDir)
+	cfg.Server.Ports = []int{port}
+	cfg.Faults = config.FaultConfig{
+		Enabled: true,
+		Header:  "X-EmailCatch-Fault",
+		Rules:   rules,
+	}
+
+	storageBackend, err := storage.NewStorageBackend(cfg)
+	require.NoError(t, err)
+
+	processor := email.NewProcessor(cfg, storageBackend, webhook.NewClient())
+	server := smtp.NewServer(cfg, processor)
+	require.NoError(t, server.Start())
+	t.Cleanup(server.Stop)
+}
+
+func sendRaw(addr, from, to, message string) error {
+	client, err := netsmtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write([]byte(message)); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+func TestFaultInjectionRecipientCode(t *testing.T) {
+	startFaultServer(t, 2544, []config.FaultRule{
+		{Name: "mailbox-full", Stage: "rcpt", RecipientPattern: "^full@", Code: 552, Message: "Mailbox full"},
+	})
+
+	err := sendRaw("localhost:2544", "a@example.com", "full@test.com", "Subject: x\r\n\r\nbody\r\n")
+	require.Error(t, err)
+
+	var protoErr *textproto.Error
+	require.ErrorAs(t, err, &protoErr)
+	assert.Equal(t, 552, protoErr.Code)
+	assert.Equal(t, "Mailbox full", protoErr.Msg)
+
+	// Other recipients are unaffected
+	assert.NoError(t, sendRaw("localhost:2544", "a@example.com", "capture@test.com", "Subject: x\r\n\r\nbody\r\n"))
+}
+
+func TestFaultInjectionHeaderTempfail(t *testing.T) {
+	startFaultServer(t, 2545, []config.FaultRule{
+		{Name: "tempfail", Stage: "data", HeaderPattern: "^data-451$", Code: 451},
+	})
+
+	err := sendRaw("localhost:2545", "a@example.com", "capture@test.com",
+		"X-EmailCatch-Fault: data-451\r\nSubject: x\r\n\r\nbody\r\n")
+	require.Error(t, err)
+
+	var protoErr *textproto.Error
+	require.ErrorAs(t, err, &protoErr)
+	assert.Equal(t, 451, protoErr.Code)
+
+	assert.NoError(t, sendRaw("localhost:2545", "a@example.com", "capture@test.com", "Subject: x\r\n\r\nbody\r\n"))
+}
+
+func TestFaultInjectionDropMidData(t *testing.T) {
+	startFaultServer(t, 2546, []config.FaultRule{
+		{Name: "drop", Stage: "data", HeaderPattern: "drop", Drop: true},
+	})
+
+	err := sendRaw("localhost:2546", "a@example.com", "capture@test.com",
+		"X-EmailCatch-Fault: drop\r\nSubject: x\r\n\r\nbody\r\n")
+	require.Error(t, err)
+
+	// The connection is cut rather than answered with an SMTP error
+	var protoErr *textproto.Error
+	assert.False(t, errors.As(err, &protoErr), "expected a connection error, got %v", err)
+}
@@ -0,0 +1,135 @@
+package integration
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/storage"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/slav123/email-catch/pkg/emailcatch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func forwardingProcessor(t *testing.T, upstream string, options map[string]string, onError string) *email.Processor {
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(upstream)
+	require.NoError(t, err)
+
+	actionConfig := map[string]string{"host": host, "port": port, "tls": "none"}
+	for key, value := range options {
+		actionConfig[key] = value
+	}
+
+	cfg := &config.Config{
+		Server:  config.ServerConfig{Hostname: "catch.example"},
+		Storage: config.StorageConfig{Local: config.LocalConfig{Enabled: true}},
+		Routes: []config.RouteConfig{{
+			Name:    "forward",
+			Enabled: true,
+			Actions: []config.Action{
+				{Type: "store_local", Enabled: true},
+				{Type: "forward", Enabled: true, OnError: onError, Config: actionConfig},
+			},
+		}},
+	}
+
+	processor := email.NewProcessor(cfg, storage.NewMemoryBackend(), nil)
+	t.Cleanup(func() { processor.Close() })
+	return processor
+}
+
+const forwardedMessage = "From: alice@sender.test\r\nTo: capture@catch.example\r\nSubject: Forward me\r\n\r\nDeliver a copy.\r\n"
+
+func TestForwardThroughSmarthost(t *testing.T) {
+	upstream := emailcatch.NewTestServer(t)
+
+	processor := forwardingProcessor(t, upstream.Addr, map[string]string{
+		"to":         "real@mailbox.test",
+		"srs_domain": "catch.example",
+		"srs_secret": "s3cret",
+	}, "")
+
+	result, err := processor.ProcessEmail("alice@sender.test", []string{"capture@catch.example"}, []byte(forwardedMessage))
+	require.NoError(t, err)
+	require.Len(t, result.Actions, 2)
+	assert.Equal(t, email.ActionStatusOK, result.Actions[1].Status)
+
+	msg, err := upstream.WaitFor(emailcatch.To("real@mailbox.test"), 5*time.Second)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Forward me", msg.Subject)
+	assert.Contains(t, msg.Body, "Deliver a copy.")
+	assert.True(t, strings.HasPrefix(msg.Envelope.From, "SRS0="), msg.Envelope.From)
+	assert.True(t, strings.HasSuffix(msg.Envelope.From, "=sender.test=alice@catch.example"), msg.Envelope.From)
+}
+
+func TestForwardRetriesWhenSmarthostIsDown(t *testing.T) {
+	// Reserve a port, then release it so the first attempt is refused
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	processor := forwardingProcessor(t, addr, map[string]string{"retry_delay_ms": "200"}, "")
+
+	_, err = processor.ProcessEmail("alice@sender.test", []string{"capture@catch.example"}, []byte(forwardedMessage))
+	require.NoError(t, err, "a temporary relay failure should be queued, not reported")
+
+	upstream := emailcatch.NewTestServer(t, emailcatch.WithConfig(func(cfg *config.Config) {
+		cfg.Server.Ports = []int{port}
+	}))
+
+	msg, err := upstream.WaitFor(emailcatch.To("capture@catch.example"), 5*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "alice@sender.test", msg.Envelope.From)
+}
+
+func TestForwardRetriesStopWhenProcessorCloses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	processor := forwardingProcessor(t, addr, map[string]string{"retry_delay_ms": "200"}, "")
+
+	_, err = processor.ProcessEmail("alice@sender.test", []string{"capture@catch.example"}, []byte(forwardedMessage))
+	require.NoError(t, err)
+	require.NoError(t, processor.Close())
+
+	upstream := emailcatch.NewTestServer(t, emailcatch.WithConfig(func(cfg *config.Config) {
+		cfg.Server.Ports = []int{port}
+	}))
+
+	_, err = upstream.WaitFor(emailcatch.To("capture@catch.example"), time.Second)
+	assert.Error(t, err, "a closed processor should not retry")
+}
+
+func TestForwardPermanentRejection(t *testing.T) {
+	upstream := emailcatch.NewTestServer(t, emailcatch.WithConfig(func(cfg *config.Config) {
+		cfg.Faults = config.FaultConfig{
+			Enabled: true,
+			Rules: []config.FaultRule{{
+				Name:             "unknown-user",
+				Stage:            "rcpt",
+				RecipientPattern: "^nobody@",
+				Code:             550,
+				Message:          "No such user",
+			}},
+		}
+	}))
+
+	processor := forwardingProcessor(t, upstream.Addr, map[string]string{"to": "nobody@mailbox.test"}, "abort")
+
+	_, err := processor.ProcessEmail("alice@sender.test", []string{"capture@catch.example"}, []byte(forwardedMessage))
+	var deliveryErr *email.DeliveryError
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.False(t, deliveryErr.Temporary)
+	assert.Contains(t, err.Error(), "No such user")
+}
@@ -0,0 +1,64 @@
+package integration
+
+import (
+	"net"
+	netsmtp "net/smtp"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slav123/email-catch/internal/smtp"
+	"github.com/slav123/email-catch/internal/storage"
+	"github.com/slav123/email-catch/internal/webhook"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnixSocketListener(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "email-unix-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	socketPath := filepath.Join(tempDir, "smtp.sock")
+
+	cfg := createTestConfig(tempDir)
+	cfg.Server.Ports = nil
+	cfg.Server.UnixSockets = []string{socketPath}
+
+	storageBackend, err := storage.NewStorageBackend(cfg)
+	require.NoError(t, err)
+
+	server := smtp.NewServer(cfg, nil)
+	require.NoError(t, server.Listen())
+	defer server.Stop()
+
+	// Serving without a processor is refused
+	assert.Error(t, server.Serve())
+
+	server.SetProcessor(email.NewProcessor(cfg, storageBackend, webhook.NewClient()))
+	require.NoError(t, server.Serve())
+	assert.Equal(t, []string{"unix:" + socketPath}, server.Listeners())
+
+	conn, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+
+	client, err := netsmtp.NewClient(conn, "localhost")
+	require.NoError(t, err)
+	require.NoError(t, client.Mail("local@example.com"))
+	require.NoError(t, client.Rcpt("capture@test.com"))
+
+	writer, err := client.Data()
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("Subject: Over a unix socket\r\n\r\nHello.\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.NoError(t, client.Quit())
+
+	time.Sleep(200 * time.Millisecond)
+
+	files, err := filepath.Glob(filepath.Join(tempDir, "capture", "*", "*", "*", "*.eml"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
@@ -0,0 +1,113 @@
+package integration
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slav123/email-catch/internal/smtp"
+	"github.com/slav123/email-catch/internal/storage"
+	"github.com/slav123/email-catch/internal/webhook"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarpitRejectsEarlyTalkers(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "email-tarpit-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	cfg.Server.Ports = []int{2540}
+	cfg.Server.Tarpit.Enabled = true
+	cfg.Server.Tarpit.PregreetDelayMs = 300
+	cfg.Server.Tarpit.RejectEarlyTalkers = true
+	cfg.Server.Tarpit.ErrorThreshold = 3
+	cfg.Server.Tarpit.HardLimit = 10
+
+	storageBackend, err := storage.NewStorageBackend(cfg)
+	require.NoError(t, err)
+
+	processor := email.NewProcessor(cfg, storageBackend, webhook.NewClient())
+	server := smtp.NewServer(cfg, processor)
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", "localhost:2540")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Talk before the banner arrives
+	_, err = conn.Write([]byte("EHLO spammer\r\n"))
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "554 "), "unexpected reply: %q", line)
+}
+
+func TestTarpitDisconnectsAfterHardLimit(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "email-tarpit-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	cfg.Server.Ports = []int{2541}
+	cfg.Server.Tarpit.Enabled = true
+	cfg.Server.Tarpit.ErrorThreshold = 2
+	cfg.Server.Tarpit.DelayStepMs = 100
+	cfg.Server.Tarpit.MaxDelayMs = 200
+	cfg.Server.Tarpit.HardLimit = 4
+
+	storageBackend, err := storage.NewStorageBackend(cfg)
+	require.NoError(t, err)
+
+	processor := email.NewProcessor(cfg, storageBackend, webhook.NewClient())
+	server := smtp.NewServer(cfg, processor)
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", "localhost:2541")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	banner, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(banner, "220 "))
+
+	// The first error is answered immediately
+	conn.Write([]byte("BOGUS\r\n"))
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "500 "))
+
+	// Once the threshold is reached responses are delayed
+	conn.Write([]byte("BOGUS\r\n"))
+	start := time.Now()
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "500 "))
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	conn.Write([]byte("BOGUS\r\n"))
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+
+	// The fourth error crosses the hard limit
+	conn.Write([]byte("BOGUS\r\n"))
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "500 "))
+
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "421 "), "unexpected reply: %q", line)
+}
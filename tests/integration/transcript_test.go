@@ -0,0 +1,109 @@
+package integration
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slav123/email-catch/internal/smtp"
+	"github.com/slav123/email-catch/internal/storage"
+	"github.com/slav123/email-catch/internal/webhook"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/slav123/email-catch/tests/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTranscriptStoredWithEmail(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "email-transcript-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	cfg.Server.Ports = []int{2542}
+	cfg.Routes[0].Transcript = true
+
+	storageBackend, err := storage.NewStorageBackend(cfg)
+	require.NoError(t, err)
+
+	processor := email.NewProcessor(cfg, storageBackend, webhook.NewClient())
+	server := smtp.NewServer(cfg, processor)
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	smtpClient := client.NewSMTPClient("localhost", 2542)
+	err = smtpClient.SendEmail(client.EmailMessage{
+		From:    "test@example.com",
+		To:      []string{"capture@test.com"},
+		Subject: "Transcript Test",
+		Body:    "Secret body that must not appear in the transcript.",
+	})
+	require.NoError(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+
+	files, err := filepath.Glob(filepath.Join(tempDir, "capture", "*", "*", "*", "transcript.log"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+
+	transcript := string(data)
+	assert.Contains(t, transcript, "C: MAIL FROM:<test@example.com>")
+	assert.Contains(t, transcript, "C: RCPT TO:<capture@test.com>")
+	assert.Contains(t, transcript, "S: 354 ")
+	assert.Contains(t, transcript, "<message data:")
+	assert.NotContains(t, transcript, "Secret body")
+}
+
+func TestTranscriptKeptForRejectedSession(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "email-transcript-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	cfg := createTestConfig(tempDir)
+	cfg.Server.Ports = []int{2543}
+	cfg.Server.Transcript.Enabled = true
+	cfg.Server.Transcript.RejectedFolder = "rejected"
+
+	storageBackend, err := storage.NewStorageBackend(cfg)
+	require.NoError(t, err)
+
+	processor := email.NewProcessor(cfg, storageBackend, webhook.NewClient())
+	server := smtp.NewServer(cfg, processor)
+	require.NoError(t, server.Start())
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", "localhost:2543")
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+
+	for _, command := range []string{"AUTH PLAIN c2VjcmV0cGFzc3dvcmQ=", "MAIL FROM:<x@example.com>", "QUIT"} {
+		_, err = conn.Write([]byte(command + "\r\n"))
+		require.NoError(t, err)
+		_, err = reader.ReadString('\n')
+		require.NoError(t, err)
+	}
+	conn.Close()
+
+	time.Sleep(200 * time.Millisecond)
+
+	files, err := filepath.Glob(filepath.Join(tempDir, "rejected", "*", "*", "*", "transcript.log"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+
+	transcript := string(data)
+	assert.Contains(t, transcript, "C: AUTH PLAIN [redacted]")
+	assert.NotContains(t, transcript, "c2VjcmV0cGFzc3dvcmQ=")
+	assert.Contains(t, transcript, "S: 503 Need HELO first")
+}
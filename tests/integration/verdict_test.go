@@ -0,0 +1,86 @@
+package integration
+
+import (
+	netsmtp "net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/pkg/emailcatch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRejectTempfailAndQuarantine(t *testing.T) {
+	srv := emailcatch.NewTestServer(t, emailcatch.WithConfig(func(cfg *config.Config) {
+		verdict := func(name, pattern string, action config.Action) config.RouteConfig {
+			action.Enabled = true
+			return config.RouteConfig{
+				Name:      name,
+				Enabled:   true,
+				Priority:  10,
+				Condition: config.Condition{RecipientPattern: pattern},
+				Actions:   []config.Action{action},
+			}
+		}
+		cfg.Routes = append(cfg.Routes,
+			verdict("blocked", "^blocked@", config.Action{Type: "reject", Config: map[string]string{
+				"code": "550", "message": "5.7.1 Recipient does not accept mail",
+			}}),
+			verdict("busy", "^busy@", config.Action{Type: "tempfail"}),
+			verdict("suspicious", "^suspicious@", config.Action{Type: "quarantine"}),
+		)
+	}))
+
+	message := "Subject: hello\r\n\r\nbody\r\n"
+
+	err := sendRaw(srv.Addr, "a@example.com", "blocked@test.com", message)
+	var protoErr *textproto.Error
+	require.ErrorAs(t, err, &protoErr)
+	assert.Equal(t, 550, protoErr.Code)
+	assert.Equal(t, "5.7.1 Recipient does not accept mail", protoErr.Msg)
+
+	err = sendRaw(srv.Addr, "a@example.com", "busy@test.com", message)
+	require.ErrorAs(t, err, &protoErr)
+	assert.Equal(t, 451, protoErr.Code)
+
+	// Rejected messages are never stored by the lower-priority catch-all
+	assert.Empty(t, srv.StoredPaths())
+
+	// Quarantined messages are accepted, stored apart and kept from the
+	// other routes
+	require.NoError(t, sendRaw(srv.Addr, "a@example.com", "suspicious@test.com", message))
+	paths := srv.StoredPaths()
+	require.NotEmpty(t, paths)
+	for _, path := range paths {
+		assert.True(t, strings.HasPrefix(path, "quarantine/"), path)
+	}
+
+	require.NoError(t, sendRaw(srv.Addr, "a@example.com", "someone@test.com", message))
+	assert.Greater(t, len(srv.StoredPaths()), len(paths))
+}
+
+func TestVerdictsRunBeforeOtherRoutes(t *testing.T) {
+	srv := emailcatch.NewTestServer(t, emailcatch.WithConfig(func(cfg *config.Config) {
+		cfg.Routing.PerRecipient = true
+		cfg.Routes = append(cfg.Routes, config.RouteConfig{
+			Name:      "blocked",
+			Enabled:   true,
+			Priority:  -10,
+			Condition: config.Condition{RecipientPattern: "^blocked@"},
+			Actions:   []config.Action{{Type: "reject", Enabled: true}},
+		})
+	}))
+
+	// The catch-all outranks the reject and the first recipient is fine, yet
+	// nothing is stored for a refused message
+	err := netsmtp.SendMail(srv.Addr, nil, "a@example.com", []string{"someone@test.com", "blocked@test.com"},
+		[]byte("Subject: hello\r\n\r\nbody\r\n"))
+	var protoErr *textproto.Error
+	require.ErrorAs(t, err, &protoErr)
+	assert.Equal(t, 550, protoErr.Code)
+
+	assert.Empty(t, srv.StoredPaths())
+	assert.Empty(t, srv.Emails(), "refused messages are not reported as received")
+}
@@ -0,0 +1,350 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/pkg/action"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingAction struct {
+	route    string
+	label    string
+	received *[]string
+}
+
+func (a *recordingAction) Init(env email.ActionEnv, cfg action.Config) error {
+	a.route = env.Route.Name
+	a.label = cfg.Config["label"]
+	return nil
+}
+
+func (a *recordingAction) Execute(ctx context.Context, msg *email.Email) error {
+	*a.received = append(*a.received, a.route+"/"+a.label+"/"+msg.Subject)
+	return nil
+}
+
+// failingAction fails with the configured message, optionally after a delay
+type failingAction struct {
+	message string
+	delay   time.Duration
+}
+
+func (a *failingAction) Init(env email.ActionEnv, cfg action.Config) error {
+	a.message = cfg.Config["error"]
+	if ms, err := strconv.Atoi(cfg.Config["sleep_ms"]); err == nil {
+		a.delay = time.Duration(ms) * time.Millisecond
+	}
+	return nil
+}
+
+func (a *failingAction) Execute(ctx context.Context, msg *email.Email) error {
+	if a.delay > 0 {
+		time.Sleep(a.delay)
+	}
+	if a.message != "" {
+		return errors.New(a.message)
+	}
+	return nil
+}
+
+// retitleAction changes the subject, optionally after ignoring its context
+// for a while
+type retitleAction struct {
+	subject string
+	delay   time.Duration
+}
+
+func (a *retitleAction) Init(env email.ActionEnv, cfg action.Config) error {
+	a.subject = cfg.Config["subject"]
+	if ms, err := strconv.Atoi(cfg.Config["sleep_ms"]); err == nil {
+		a.delay = time.Duration(ms) * time.Millisecond
+	}
+	return nil
+}
+
+func (a *retitleAction) Execute(ctx context.Context, msg *email.Email) error {
+	time.Sleep(a.delay)
+	msg.Subject = a.subject
+	return nil
+}
+
+var recorded []string
+
+func init() {
+	email.RegisterAction("test_record", func() email.Action {
+		return &recordingAction{received: &recorded}
+	})
+	email.RegisterAction("test_fail", func() email.Action { return &failingAction{} })
+	email.RegisterAction("test_retitle", func() email.Action { return &retitleAction{} })
+}
+
+func processWithActions(t *testing.T, parallel bool, actions ...config.Action) error {
+	t.Helper()
+
+	for i := range actions {
+		actions[i].Enabled = true
+	}
+	processor, _ := processorFor(&config.Config{
+		Routes: []config.RouteConfig{{
+			Name:     "policy",
+			Enabled:  true,
+			Parallel: parallel,
+			Actions:  actions,
+		}},
+	})
+
+	raw := []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: Policy\r\n\r\nbody\r\n")
+	_, err := processor.ProcessEmail("a@example.com", []string{"b@example.com"}, raw)
+	return err
+}
+
+func failing(message, onError string) config.Action {
+	return config.Action{Type: "test_fail", OnError: onError, Config: map[string]string{"error": message}}
+}
+
+func record(label string) config.Action {
+	return config.Action{Type: "test_record", Config: map[string]string{"label": label}}
+}
+
+func TestActionErrorPolicies(t *testing.T) {
+	var deliveryErr *email.DeliveryError
+
+	// continue: the next action still runs and the message is accepted
+	recorded = nil
+	require.NoError(t, processWithActions(t, false, failing("boom", ""), record("after")))
+	assert.Equal(t, []string{"policy/after/Policy"}, recorded)
+
+	// A failure with nothing else succeeding is never acknowledged
+	err := processWithActions(t, false, failing("boom", "continue"))
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.True(t, deliveryErr.Temporary)
+
+	// abort: the route stops and the failure is permanent
+	recorded = nil
+	err = processWithActions(t, false, record("before"), failing("bad config", "abort"), record("after"))
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.False(t, deliveryErr.Temporary)
+	assert.Contains(t, err.Error(), "bad config")
+	assert.Equal(t, []string{"policy/before/Policy"}, recorded)
+
+	// tempfail: the route stops and the client should retry
+	recorded = nil
+	err = processWithActions(t, false, failing("backend down", "tempfail"), record("after"))
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.True(t, deliveryErr.Temporary)
+	assert.Empty(t, recorded)
+}
+
+func TestRejectActionStopsRoute(t *testing.T) {
+	var deliveryErr *email.DeliveryError
+
+	// The reject decides the reply even though a failure came first
+	recorded = nil
+	reject := config.Action{Type: "reject", Config: map[string]string{"code": "554", "message": "No thanks"}}
+	err := processWithActions(t, false, failing("boom", "continue"), reject, record("after"))
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.Equal(t, 554, deliveryErr.Code)
+	assert.Equal(t, "No thanks", deliveryErr.Message)
+	assert.False(t, deliveryErr.Temporary)
+	assert.Empty(t, recorded)
+
+	// A reject code outside 5xx is a configuration error
+	err = processWithActions(t, false, config.Action{Type: "reject", OnError: "abort", Config: map[string]string{"code": "451"}})
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.Zero(t, deliveryErr.Code)
+	assert.Contains(t, err.Error(), "expected 5xx")
+}
+
+func TestActionTimeout(t *testing.T) {
+	slow := config.Action{
+		Type:      "test_fail",
+		OnError:   "tempfail",
+		TimeoutMs: 50,
+		Config:    map[string]string{"sleep_ms": "2000"},
+	}
+
+	start := time.Now()
+	err := processWithActions(t, false, slow)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestTimedActionsWorkOnTheirOwnCopy(t *testing.T) {
+	retitle := func(sleepMs string, timeoutMs int) config.Action {
+		return config.Action{
+			Type:      "test_retitle",
+			TimeoutMs: timeoutMs,
+			Config:    map[string]string{"subject": "Retitled", "sleep_ms": sleepMs},
+		}
+	}
+
+	// Changes of an action that finished in time are kept
+	recorded = nil
+	require.NoError(t, processWithActions(t, false, retitle("0", 1000), record("after")))
+	assert.Equal(t, []string{"policy/after/Retitled"}, recorded)
+
+	// An abandoned action cannot change the message under the next one
+	recorded = nil
+	sleepy := config.Action{Type: "test_fail", Config: map[string]string{"sleep_ms": "200"}}
+	require.NoError(t, processWithActions(t, false, retitle("100", 20), sleepy, record("after")))
+	assert.Equal(t, []string{"policy/after/Policy"}, recorded)
+}
+
+func TestParallelActions(t *testing.T) {
+	sleepy := func() config.Action {
+		return config.Action{Type: "test_fail", Config: map[string]string{"sleep_ms": "200"}}
+	}
+
+	start := time.Now()
+	require.NoError(t, processWithActions(t, true, sleepy(), sleepy(), sleepy()))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	// Siblings keep running when one of them aborts
+	recorded = nil
+	err := processWithActions(t, true, failing("bad", "abort"), record("sibling"))
+	require.Error(t, err)
+	assert.Equal(t, []string{"policy/sibling/Policy"}, recorded)
+
+	// Parallel actions do not see each other's changes
+	recorded = nil
+	retitle := config.Action{Type: "test_retitle", Config: map[string]string{"subject": "Retitled"}}
+	require.NoError(t, processWithActions(t, true, retitle, record("sibling")))
+	assert.Equal(t, []string{"policy/sibling/Policy"}, recorded)
+}
+
+func TestBuiltinActionTypesKnownToConfig(t *testing.T) {
+	registered := email.RegisteredActions()
+	for _, name := range config.BuiltinActionTypes() {
+		assert.Contains(t, registered, name)
+	}
+	for _, name := range registered {
+		if !strings.HasPrefix(name, "test_") {
+			assert.Contains(t, config.BuiltinActionTypes(), name, "new built-in actions must be listed in internal/config")
+		}
+	}
+}
+
+func TestCustomActionExecutes(t *testing.T) {
+	recorded = nil
+
+	processor, backend := processorFor(&config.Config{
+		Routes: []config.RouteConfig{{
+			Name:      "tickets",
+			Enabled:   true,
+			Condition: config.Condition{RecipientPattern: "^support@"},
+			Actions: []config.Action{
+				{Type: "test_record", Enabled: true, Config: map[string]string{"label": "crm"}},
+				{Type: "store_local", Enabled: true},
+			},
+		}},
+	})
+
+	raw := []byte("From: a@example.com\r\nTo: support@example.com\r\nSubject: Help\r\n\r\nbody\r\n")
+	_, err := processor.ProcessEmail("a@example.com", []string{"support@example.com"}, raw)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"tickets/crm/Help"}, recorded)
+	assert.NotEmpty(t, backend.Paths())
+	assert.Contains(t, email.RegisteredActions(), "test_record")
+}
+
+func TestConfigValidationUnknownActionType(t *testing.T) {
+	configData := `
+server:
+  ports: [2525]
+  hostname: "localhost"
+
+storage:
+  local:
+    enabled: true
+    directory: "./test"
+
+routes:
+  - name: "test"
+    condition:
+      recipient_pattern: ".*"
+    actions:
+      - type: "store_locl"
+        enabled: true
+    enabled: true
+`
+
+	tmpFile, err := os.CreateTemp("", "config-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(configData)
+	require.NoError(t, err)
+	tmpFile.Close()
+
+	_, err = config.LoadConfig(tmpFile.Name())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `route test: action 0 has unknown type "store_locl"`)
+}
+
+func TestProcessingResult(t *testing.T) {
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer hook.Close()
+
+	cfg := &config.Config{
+		Routes: []config.RouteConfig{{
+			Name:    "invoices",
+			Enabled: true,
+			Actions: []config.Action{
+				{Type: "store_local", Enabled: true, Config: map[string]string{"folder": "invoices"}},
+				{Type: "webhook", Enabled: true, Config: map[string]string{"url": hook.URL}},
+				failing("storage quota exceeded", ""),
+			},
+		}},
+	}
+	cfg.Routes[0].Actions[2].Enabled = true
+	processor, backend := processorFor(cfg)
+
+	raw := []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: Invoice\r\nMessage-ID: <inv-1@example.com>\r\n\r\nbody\r\n")
+	result, err := processor.ProcessEmail("a@example.com", []string{"b@example.com"}, raw)
+	require.NoError(t, err)
+
+	assert.Equal(t, "<inv-1@example.com>", result.MessageID)
+	assert.Equal(t, []string{"invoices"}, result.MatchedRoutes)
+	require.Len(t, result.Actions, 3)
+
+	stored := result.Actions[0]
+	assert.Equal(t, email.ActionStatusOK, stored.Status)
+	require.Len(t, stored.Paths, 2)
+	assert.True(t, strings.HasSuffix(stored.Paths[0], ".eml"))
+	assert.True(t, strings.HasSuffix(stored.Paths[1], ".json"))
+
+	assert.Equal(t, email.ActionStatusOK, result.Actions[1].Status)
+	assert.Equal(t, http.StatusAccepted, result.Actions[1].WebhookStatus)
+
+	assert.Equal(t, email.ActionStatusFailed, result.Actions[2].Status)
+	assert.Equal(t, "storage quota exceeded", result.Actions[2].Error)
+	assert.Len(t, result.Failed(), 1)
+
+	// The stored JSON payload carries the complete result
+	data, ok := backend.Get(stored.Paths[1])
+	require.True(t, ok)
+	var payload struct {
+		Processing email.ProcessingResult `json:"processing"`
+	}
+	require.NoError(t, json.Unmarshal(data, &payload))
+	assert.Len(t, payload.Processing.Actions, 3)
+	assert.Contains(t, string(data), `"webhook_status": 202`)
+	assert.Contains(t, string(data), `"duration_ms"`)
+}
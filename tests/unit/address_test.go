@@ -0,0 +1,114 @@
+package unit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAddress(t *testing.T) {
+	assert.Equal(t, email.Address{User: "capture", Tag: "order123", Domain: "example.com"},
+		email.ParseAddress("capture+order123@Example.COM", "+"))
+	assert.Equal(t, email.Address{User: "capture", Tag: "order-123", Domain: "example.com"},
+		email.ParseAddress("capture-order-123@example.com", "+-"))
+	assert.Equal(t, email.Address{User: "plain", Domain: "example.com"},
+		email.ParseAddress("plain@example.com", "+"))
+	assert.Equal(t, email.Address{User: "+leading", Domain: "example.com"},
+		email.ParseAddress("+leading@example.com", "+"))
+}
+
+func TestSubaddressConditionsAndPaths(t *testing.T) {
+	orders := routeFor("orders", "")
+	orders.Condition.RecipientUserPattern = "^capture$"
+	orders.Condition.RecipientTagPattern = "^order[0-9]+$"
+	orders.Actions[0].Config = map[string]string{"path_template": "{{recipient_user}}/{{recipient_tag}}"}
+
+	processor, backend := processorFor(&config.Config{
+		Routes:  []config.RouteConfig{orders},
+		Routing: config.RoutingConfig{SubaddressSeparators: "+-"},
+	})
+
+	raw := []byte("From: shop@vendor.test\r\nSubject: Order\r\n\r\nbody\r\n")
+	result, err := processor.ProcessEmail("shop@vendor.test", []string{"capture-order123@example.com"}, raw)
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders"}, result.MatchedRoutes)
+
+	var payload []byte
+	for _, path := range result.Actions[0].Paths {
+		assert.True(t, strings.HasPrefix(path, "capture/order123/"), path)
+		if strings.HasSuffix(path, ".json") {
+			payload, _ = backend.Get(path)
+		}
+	}
+	var stored struct {
+		Recipients []email.Address `json:"recipients"`
+	}
+	require.NoError(t, json.Unmarshal(payload, &stored))
+	assert.Equal(t, []email.Address{{User: "capture", Tag: "order123", Domain: "example.com"}}, stored.Recipients)
+
+	// User and tag must come from the same recipient
+	result, err = processor.ProcessEmail("shop@vendor.test", []string{"capture@example.com", "other-order7@example.com"}, raw)
+	require.NoError(t, err)
+	assert.Empty(t, result.MatchedRoutes)
+}
+
+func TestAliasTable(t *testing.T) {
+	aliasFile := filepath.Join(t.TempDir(), "aliases")
+	require.NoError(t, os.WriteFile(aliasFile, []byte(`# team aliases
+sales@example.com     alice@example.com, bob@example.com
+capture@example.com   intake@example.com
+bob@example.com       bob@example.com robert@example.org
+@legacy.example       archive@example.com
+`), 0644))
+
+	processor, _ := processorFor(&config.Config{
+		Routes:  []config.RouteConfig{routeFor("all", ".*")},
+		Routing: config.RoutingConfig{AliasFile: aliasFile},
+	})
+	var seen *email.Email
+	processor.OnProcessed(func(e *email.Email) { seen = e })
+
+	deliver := func(to ...string) []string {
+		_, err := processor.ProcessEmail("someone@sender.test", to, []byte("Subject: hi\r\n\r\nbody\r\n"))
+		require.NoError(t, err)
+		return seen.To
+	}
+
+	// Aliases expand recursively, and a target may keep itself
+	assert.Equal(t, []string{"alice@example.com", "bob@example.com", "robert@example.org"}, deliver("Sales@example.com"))
+	assert.Equal(t, []string{"Sales@example.com"}, seen.Envelope.OriginalTo)
+
+	// The tag survives an alias of the untagged address
+	assert.Equal(t, []string{"intake+order1@example.com"}, deliver("capture+order1@example.com"))
+	assert.Equal(t, []string{"archive@example.com", "nobody@example.com"}, deliver("old@legacy.example", "nobody@example.com", "archive@example.com"))
+
+	// Changes to the file are picked up without a restart
+	require.NoError(t, os.WriteFile(aliasFile, []byte("nobody@example.com postmaster@example.com\n"), 0644))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(aliasFile, later, later))
+	assert.Equal(t, []string{"postmaster@example.com"}, deliver("nobody@example.com"))
+	assert.Equal(t, []string{"sales@example.com"}, deliver("sales@example.com"))
+	assert.Nil(t, seen.Envelope.OriginalTo)
+}
+
+func TestAcceptsAliasedRecipient(t *testing.T) {
+	aliasFile := filepath.Join(t.TempDir(), "aliases")
+	require.NoError(t, os.WriteFile(aliasFile, []byte("support@example.com capture@example.com\n"), 0644))
+
+	processor, _ := processorFor(&config.Config{
+		Routes:  []config.RouteConfig{routeFor("capture", "^capture@")},
+		Routing: config.RoutingConfig{AliasFile: aliasFile},
+	})
+
+	assert.True(t, processor.AcceptsRecipient("capture@example.com"))
+	assert.True(t, processor.AcceptsRecipient("support@example.com"))
+	assert.False(t, processor.AcceptsRecipient("sales@example.com"))
+}
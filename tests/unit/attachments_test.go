@@ -0,0 +1,139 @@
+package unit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/storage"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// multipartMessage builds a message with a text part and one base64
+// attachment per name, declared as application/pdf whatever the content
+func multipartMessage(attachments map[string]string, order ...string) []byte {
+	var b strings.Builder
+	b.WriteString("From: a@example.com\r\nTo: b@example.com\r\nSubject: Files\r\nMIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: multipart/mixed; boundary=\"outer\"\r\n\r\npreamble\r\n")
+	b.WriteString("--outer\r\nContent-Type: text/plain\r\n\r\nSee attached.\r\n")
+	for _, name := range order {
+		fmt.Fprintf(&b, "--outer\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"%s\"\r\n", name)
+		fmt.Fprintf(&b, "Content-Transfer-Encoding: base64\r\n\r\n%s\r\n", base64.StdEncoding.EncodeToString([]byte(attachments[name])))
+	}
+	b.WriteString("--outer--\r\nepilogue\r\n")
+	return []byte(b.String())
+}
+
+func TestAttachmentFilenamesAreSanitized(t *testing.T) {
+	raw := multipartMessage(map[string]string{
+		"../../etc/cron.d/x": "a",
+		"Report.pdf":         "b",
+		"report.pdf":         "c",
+		"..":                 "d",
+	}, "../../etc/cron.d/x", "Report.pdf", "report.pdf", "..")
+
+	msg, err := email.ParseEmail(raw, "a@example.com", []string{"b@example.com"})
+	require.NoError(t, err)
+	require.Len(t, msg.Attachments, 4)
+
+	var names []string
+	for _, attachment := range msg.Attachments {
+		names = append(names, attachment.Filename)
+	}
+	assert.Equal(t, []string{"x", "Report.pdf", "report-2.pdf", "attachment_4.pdf"}, names)
+	assert.Equal(t, "../../etc/cron.d/x", msg.Attachments[0].OriginalFilename)
+}
+
+func attachmentPolicyProcessor(policy config.AttachmentPolicy) (*email.Processor, *storage.MemoryBackend) {
+	route := routeFor("inbox", ".*")
+	route.Attachments = &policy
+	return processorFor(&config.Config{Routes: []config.RouteConfig{route}})
+}
+
+var policyAttachments = map[string]string{
+	"report.pdf":  "%PDF-1.4 real report",
+	"invoice.pdf": "MZ\x90\x00 a program pretending to be a PDF",
+	"tool.exe":    "%PDF-1.4 a PDF with the wrong name",
+}
+
+func TestAttachmentPolicyStrip(t *testing.T) {
+	processor, backend := attachmentPolicyProcessor(config.AttachmentPolicy{
+		AllowTypes:     []string{"application/pdf", "image/*"},
+		DenyExtensions: []string{".EXE"},
+	})
+
+	raw := multipartMessage(policyAttachments, "report.pdf", "invoice.pdf", "tool.exe")
+	result, err := processor.ProcessEmail("a@example.com", []string{"b@example.com"}, raw)
+	require.NoError(t, err)
+	require.Len(t, result.Actions, 2)
+	assert.Equal(t, "attachment_policy", result.Actions[0].Type)
+
+	files := make(map[string]string)
+	for _, path := range result.Actions[1].Paths {
+		data, ok := backend.Get(path)
+		require.True(t, ok)
+		files[path[strings.LastIndex(path, "/")+1:]] = string(data)
+	}
+
+	var eml, orig, payload string
+	for name, data := range files {
+		switch {
+		case strings.HasSuffix(name, ".orig.eml"):
+			orig = data
+		case strings.HasSuffix(name, ".eml"):
+			eml = data
+		case strings.HasSuffix(name, ".json"):
+			payload = data
+		}
+	}
+
+	assert.Contains(t, files, "report.pdf")
+	assert.NotContains(t, files, "invoice.pdf")
+	assert.NotContains(t, files, "tool.exe")
+	assert.Equal(t, string(raw), orig)
+
+	// Stripped parts are replaced by a note; everything else is untouched
+	assert.Contains(t, eml, `The attachment "invoice.pdf" was removed: type application/octet-stream is not allowed.`)
+	assert.Contains(t, eml, `The attachment "tool.exe" was removed: extension .exe is not allowed.`)
+	assert.Contains(t, eml, base64.StdEncoding.EncodeToString([]byte(policyAttachments["report.pdf"])))
+	assert.NotContains(t, eml, base64.StdEncoding.EncodeToString([]byte(policyAttachments["invoice.pdf"])))
+	assert.True(t, strings.HasSuffix(eml, "--outer--\r\nepilogue\r\n"))
+
+	var stored struct {
+		Attachments      []struct{ Filename string } `json:"attachments"`
+		AttachmentPolicy []email.AttachmentDecision  `json:"attachment_policy"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(payload), &stored))
+	require.Len(t, stored.Attachments, 1)
+	assert.Equal(t, "report.pdf", stored.Attachments[0].Filename)
+	require.Len(t, stored.AttachmentPolicy, 3)
+	assert.Equal(t, "allow", stored.AttachmentPolicy[0].Action)
+	assert.Equal(t, "strip", stored.AttachmentPolicy[1].Action)
+	assert.Equal(t, "application/octet-stream", stored.AttachmentPolicy[1].DetectedType)
+	assert.Equal(t, "strip", stored.AttachmentPolicy[2].Action)
+}
+
+func TestAttachmentPolicyRejectAndQuarantine(t *testing.T) {
+	raw := multipartMessage(policyAttachments, "report.pdf", "tool.exe")
+
+	processor, backend := attachmentPolicyProcessor(config.AttachmentPolicy{MaxSize: 10, Action: "reject"})
+	_, err := processor.ProcessEmail("a@example.com", []string{"b@example.com"}, raw)
+	var deliveryErr *email.DeliveryError
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.Equal(t, 550, deliveryErr.Code)
+	assert.Empty(t, backend.Paths())
+
+	processor, _ = attachmentPolicyProcessor(config.AttachmentPolicy{DenyExtensions: []string{"exe"}, Action: "quarantine"})
+	result, err := processor.ProcessEmail("a@example.com", []string{"b@example.com"}, raw)
+	require.NoError(t, err)
+	require.NotNil(t, result.Verdict)
+	require.Len(t, result.Actions, 1)
+	for _, path := range result.Paths() {
+		assert.True(t, strings.HasPrefix(path, "quarantine/"), path)
+	}
+}
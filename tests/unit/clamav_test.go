@@ -0,0 +1,216 @@
+package unit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/slav123/email-catch/internal/clamav"
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/storage"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClamd speaks enough of the clamd protocol for INSTREAM scans in
+// sessions. Streams containing "EICAR" are reported as infected.
+type fakeClamd struct {
+	listener net.Listener
+	conns    atomic.Int32
+	scanned  atomic.Int64
+	// oneShot closes each connection after its first reply, like a clamd
+	// that timed out an idle session
+	oneShot atomic.Bool
+}
+
+func startFakeClamd(t *testing.T) *fakeClamd {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	clamd := &fakeClamd{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			clamd.conns.Add(1)
+			go clamd.serve(conn)
+		}
+	}()
+	return clamd
+}
+
+func (c *fakeClamd) Addr() string {
+	return c.listener.Addr().String()
+}
+
+func (c *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	session, id := false, 0
+
+	for {
+		command, err := r.ReadString(0)
+		if err != nil {
+			return
+		}
+		switch strings.TrimSuffix(command, "\x00") {
+		case "zIDSESSION":
+			session = true
+			continue
+		case "zEND":
+			return
+		case "zINSTREAM":
+		default:
+			fmt.Fprintf(conn, "UNKNOWN COMMAND\x00")
+			return
+		}
+
+		var stream bytes.Buffer
+		for {
+			var size uint32
+			if binary.Read(r, binary.BigEndian, &size) != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+				return
+			}
+		}
+		c.scanned.Add(int64(stream.Len()))
+
+		reply := "stream: OK"
+		if bytes.Contains(stream.Bytes(), []byte("EICAR")) {
+			reply = "stream: Eicar-Test-Signature FOUND"
+		}
+		if session {
+			id++
+			reply = fmt.Sprintf("%d: %s", id, reply)
+		}
+		fmt.Fprintf(conn, "%s\x00", reply)
+
+		if !session || c.oneShot.Load() {
+			return
+		}
+	}
+}
+
+func TestClamavClientReusesSessions(t *testing.T) {
+	clamd := startFakeClamd(t)
+	client, err := clamav.NewClient(clamav.Config{Address: "tcp://" + clamd.Addr()})
+	require.NoError(t, err)
+	defer client.Close()
+
+	large := bytes.Repeat([]byte("x"), 200*1024)
+	for _, data := range [][]byte{[]byte("hello"), large, []byte("more")} {
+		result, err := client.Scan(context.Background(), data)
+		require.NoError(t, err)
+		assert.False(t, result.Infected)
+	}
+	assert.Equal(t, int32(1), clamd.conns.Load())
+	assert.Equal(t, int64(len(large)+9), clamd.scanned.Load())
+
+	result, err := client.Scan(context.Background(), []byte("X5O!P%@AP EICAR"))
+	require.NoError(t, err)
+	assert.True(t, result.Infected)
+	assert.Equal(t, "Eicar-Test-Signature", result.Signature)
+
+	// A session closed by clamd is replaced transparently
+	clamd.oneShot.Store(true)
+	for i := 0; i < 3; i++ {
+		_, err = client.Scan(context.Background(), []byte("hello"))
+		require.NoError(t, err)
+	}
+
+	_, err = clamav.NewClient(clamav.Config{Address: "clamd"})
+	assert.Error(t, err)
+}
+
+func clamavProcessor(options map[string]string) (*email.Processor, *storage.MemoryBackend) {
+	route := routeFor("inbox", ".*")
+	route.Actions = []config.Action{
+		{Type: "scan_clamav", Enabled: true, Config: options},
+		{Type: "store_local", Enabled: true},
+	}
+	return processorFor(&config.Config{Routes: []config.RouteConfig{route}})
+}
+
+func storedFile(t *testing.T, backend *storage.MemoryBackend, suffix string) string {
+	for _, path := range backend.Paths() {
+		if strings.HasSuffix(path, suffix) && !strings.HasSuffix(path, ".orig"+suffix) {
+			data, _ := backend.Get(path)
+			return string(data)
+		}
+	}
+	t.Fatalf("no %s file among %v", suffix, backend.Paths())
+	return ""
+}
+
+func TestClamavAction(t *testing.T) {
+	clamd := startFakeClamd(t)
+	infected := multipartMessage(map[string]string{"invoice.pdf": "X5O!P%@AP EICAR"}, "invoice.pdf")
+	clean := multipartMessage(map[string]string{"invoice.pdf": "%PDF-1.4"}, "invoice.pdf")
+
+	processor, backend := clamavProcessor(map[string]string{"address": clamd.Addr()})
+	_, err := processor.ProcessEmail("a@example.com", []string{"b@example.com"}, infected)
+	var deliveryErr *email.DeliveryError
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.Equal(t, 550, deliveryErr.Code)
+	assert.Empty(t, backend.Paths())
+
+	_, err = processor.ProcessEmail("a@example.com", []string{"b@example.com"}, clean)
+	require.NoError(t, err)
+	var payload struct {
+		VirusScan email.VirusScan `json:"virus_scan"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(storedFile(t, backend, ".json")), &payload))
+	assert.Equal(t, email.ScanClean, payload.VirusScan.Status)
+
+	processor, backend = clamavProcessor(map[string]string{
+		"address": clamd.Addr(), "on_infected": "tag", "subject_prefix": "[VIRUS] ",
+	})
+	_, err = processor.ProcessEmail("a@example.com", []string{"b@example.com"}, infected)
+	require.NoError(t, err)
+	eml := storedFile(t, backend, ".eml")
+	assert.Contains(t, eml, "X-Virus-Status: Infected (Eicar-Test-Signature in invoice.pdf)\r\n")
+	assert.Contains(t, eml, "Subject: [VIRUS] Files\r\n")
+	require.NoError(t, json.Unmarshal([]byte(storedFile(t, backend, ".json")), &payload))
+	assert.Equal(t, email.VirusScan{
+		Scanner: "clamav", Status: email.ScanInfected, Signature: "Eicar-Test-Signature", Part: "invoice.pdf",
+	}, payload.VirusScan)
+}
+
+func TestClamavActionFailOpenAndClosed(t *testing.T) {
+	// Nothing listens on the address of a closed listener
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	message := []byte("Subject: hi\r\n\r\nbody\r\n")
+
+	processor, backend := clamavProcessor(map[string]string{"address": address})
+	_, err = processor.ProcessEmail("a@example.com", []string{"b@example.com"}, message)
+	var deliveryErr *email.DeliveryError
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.Equal(t, 451, deliveryErr.Code)
+	assert.Empty(t, backend.Paths())
+
+	processor, backend = clamavProcessor(map[string]string{"address": address, "fail": "open"})
+	_, err = processor.ProcessEmail("a@example.com", []string{"b@example.com"}, message)
+	require.NoError(t, err)
+	assert.Contains(t, storedFile(t, backend, ".json"), `"status": "error"`)
+}
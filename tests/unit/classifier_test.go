@@ -0,0 +1,105 @@
+package unit
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/slav123/email-catch/internal/classifier"
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var trainingMessages = map[string][][2]string{
+	"invoice": {
+		{"Invoice 2024-113", "Please find attached the invoice for March. Payment is due within 14 days."},
+		{"Your invoice is ready", "The amount due is 120 EUR. Pay by bank transfer before the due date."},
+	},
+	"newsletter": {
+		{"Weekly digest", "Top stories this week. Read more on our blog. Unsubscribe from this newsletter."},
+		{"Our spring newsletter", "News from the team, upcoming events. Click here to unsubscribe."},
+	},
+}
+
+func trainedModel() *classifier.Model {
+	model := classifier.NewModel()
+	for category, messages := range trainingMessages {
+		for _, message := range messages {
+			model.Train(category, classifier.Tokenize(message[0], message[1]))
+		}
+	}
+	return model
+}
+
+func TestClassifierModel(t *testing.T) {
+	model := trainedModel()
+
+	category, confidence, ok := model.Classify(classifier.Tokenize("Invoice 2024-200", "Payment due in 30 days"))
+	require.True(t, ok)
+	assert.Equal(t, "invoice", category)
+	assert.Greater(t, confidence, 0.9)
+
+	category, _, _ = model.Classify(classifier.Tokenize("Monthly digest", "Stories and events. Unsubscribe."))
+	assert.Equal(t, "newsletter", category)
+
+	path := filepath.Join(t.TempDir(), "model.json")
+	require.NoError(t, model.Save(path))
+	loaded, err := classifier.Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"invoice", "newsletter"}, loaded.Names())
+	assert.Equal(t, 2, loaded.Categories["invoice"].Documents)
+
+	// Training counts the vocabulary as it goes; loading counts it afresh
+	tokens := classifier.Tokenize("Invoice 2024-200", "Payment due in 30 days")
+	_, trainedConfidence, _ := model.Classify(tokens)
+	_, loadedConfidence, _ := loaded.Classify(tokens)
+	assert.Equal(t, trainedConfidence, loadedConfidence)
+
+	assert.True(t, loaded.Remove("newsletter"))
+	category, confidence, _ = loaded.Classify(classifier.Tokenize("Monthly digest", "Unsubscribe."))
+	assert.Equal(t, "invoice", category)
+	assert.Equal(t, 1.0, confidence)
+
+	_, _, ok = classifier.NewModel().Classify([]string{"anything"})
+	assert.False(t, ok)
+}
+
+func TestClassifierRouting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model.json")
+	require.NoError(t, trainedModel().Save(path))
+
+	confident := 0.8
+	invoices := routeFor("invoices", ".*")
+	invoices.Condition.CategoryPattern = "^invoice$"
+	invoices.Condition.MinCategoryConfidence = &confident
+	other := routeFor("other", ".*")
+	other.Type = config.RouteTypeFallback
+
+	processor, backend := processorFor(&config.Config{
+		Routes:     []config.RouteConfig{invoices, other},
+		Classifier: config.ClassifierConfig{Enabled: true, ModelFile: path},
+	})
+
+	invoice := "Subject: Invoice 7781\r\nContent-Type: text/html\r\n\r\n<p>The <b>payment</b> is due on Friday.</p>\r\n"
+	result, err := processor.ProcessEmail("a@example.com", []string{"b@example.com"}, []byte(invoice))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"invoices"}, result.MatchedRoutes)
+
+	var payload struct {
+		Classification email.Classification `json:"classification"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(storedFile(t, backend, ".json")), &payload))
+	assert.Equal(t, "invoice", payload.Classification.Category)
+	assert.Greater(t, payload.Classification.Confidence, confident)
+
+	// Retraining takes effect without a restart
+	model := classifier.NewModel()
+	model.Train("newsletter", classifier.Tokenize("News", "unsubscribe"))
+	require.NoError(t, model.Save(path))
+
+	result, err = processor.ProcessEmail("a@example.com", []string{"b@example.com"}, []byte(invoice))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"other"}, result.MatchedRoutes)
+}
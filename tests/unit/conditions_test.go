@@ -0,0 +1,114 @@
+package unit
+
+import (
+	"testing"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const supplierInvoiceRoute = `
+name: "supplier_invoices"
+enabled: true
+condition:
+  recipient_pattern: "^faktury@"
+  all:
+    - attachment_type_pattern: "application/pdf"
+    - any:
+        - sender_pattern: "@supplier-one\\.com>?$"
+        - sender_pattern: "@supplier-two\\.com>?$"
+  not:
+    envelope_from_pattern: "@hib\\.pl$"
+actions:
+  - type: "store_local"
+    enabled: true
+`
+
+func newConditionProcessor(t *testing.T, routeYAML string) *email.Processor {
+	var route config.RouteConfig
+	require.NoError(t, yaml.Unmarshal([]byte(routeYAML), &route))
+
+	processor, _ := processorFor(&config.Config{
+		Routes: []config.RouteConfig{route},
+	})
+	return processor
+}
+
+func invoiceEmail(sender, envelopeFrom string, attachmentType string) *email.Email {
+	msg := &email.Email{
+		From:     sender,
+		To:       []string{"faktury@hib.pl"},
+		Subject:  "Invoice 2024/05",
+		Headers:  map[string][]string{},
+		Envelope: email.Envelope{From: envelopeFrom},
+	}
+	if attachmentType != "" {
+		msg.Attachments = []email.Attachment{{Filename: "invoice", ContentType: attachmentType, Size: 10}}
+	}
+	return msg
+}
+
+func TestNestedConditionComposition(t *testing.T) {
+	processor := newConditionProcessor(t, supplierInvoiceRoute)
+
+	tests := []struct {
+		name    string
+		email   *email.Email
+		matches bool
+	}{
+		{"supplier with pdf", invoiceEmail("Billing <billing@supplier-one.com>", "bounce@supplier-one.com", "application/pdf"), true},
+		{"second supplier", invoiceEmail("billing@supplier-two.com", "bounce@supplier-two.com", "application/pdf"), true},
+		{"no attachment", invoiceEmail("billing@supplier-one.com", "bounce@supplier-one.com", ""), false},
+		{"wrong attachment type", invoiceEmail("billing@supplier-one.com", "bounce@supplier-one.com", "image/png"), false},
+		{"unknown sender", invoiceEmail("billing@random.com", "bounce@random.com", "application/pdf"), false},
+		{"own domain", invoiceEmail("billing@supplier-one.com", "forwarder@hib.pl", "application/pdf"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matched := processor.MatchingRoutes(tt.email)
+			if tt.matches {
+				assert.Equal(t, []string{"supplier_invoices"}, matched)
+			} else {
+				assert.Empty(t, matched)
+			}
+		})
+	}
+}
+
+func TestHeaderSizeAndAuthConditions(t *testing.T) {
+	processor := newConditionProcessor(t, `
+name: "trusted_alerts"
+enabled: true
+condition:
+  headers:
+    x-alert-level: "^(high|critical)$"
+  auth_results:
+    dkim: "^pass$"
+  max_size: 1000
+actions:
+  - type: "store_local"
+    enabled: true
+`)
+
+	msg := &email.Email{
+		To: []string{"alerts@example.com"},
+		Headers: map[string][]string{
+			"X-Alert-Level":          {"critical"},
+			"Authentication-Results": {"mx.example.com; spf=pass smtp.mailfrom=example.com; dkim=pass header.d=example.com"},
+		},
+		Raw: make([]byte, 500),
+	}
+	assert.Equal(t, []string{"trusted_alerts"}, processor.MatchingRoutes(msg))
+	assert.Equal(t, map[string]string{"spf": "pass", "dkim": "pass"}, msg.AuthResults())
+
+	msg.Headers["Authentication-Results"] = []string{"mx.example.com; dkim=fail"}
+	assert.Empty(t, processor.MatchingRoutes(msg))
+
+	msg.Headers["Authentication-Results"] = []string{"mx.example.com; dkim=pass"}
+	msg.Raw = make([]byte, 2000)
+	assert.Empty(t, processor.MatchingRoutes(msg))
+}
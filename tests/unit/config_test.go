@@ -322,4 +322,85 @@ routes:
 	require.NoError(t, err)
 
 	assert.Equal(t, "localhost", cfg.Server.Hostname)
-}
\ No newline at end of file
+}
+
+func TestConfigTarpitDefaults(t *testing.T) {
+	configData := `
+server:
+  ports: [2525]
+  hostname: "localhost"
+  tarpit:
+    enabled: true
+    pregreet_delay_ms: 500
+
+storage:
+  local:
+    enabled: true
+    directory: "./test"
+
+routes:
+  - name: "test"
+    condition:
+      recipient_pattern: ".*"
+    actions:
+      - type: "store_local"
+        enabled: true
+    enabled: true
+`
+
+	tmpFile, err := os.CreateTemp("", "config-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(configData)
+	require.NoError(t, err)
+	tmpFile.Close()
+
+	cfg, err := config.LoadConfig(tmpFile.Name())
+	require.NoError(t, err)
+
+	tarpit := cfg.Server.Tarpit
+	assert.True(t, tarpit.Enabled)
+	assert.Equal(t, 500, tarpit.PregreetDelayMs)
+	assert.Equal(t, 3, tarpit.ErrorThreshold)
+	assert.Equal(t, 1000, tarpit.DelayStepMs)
+	assert.Equal(t, 30000, tarpit.MaxDelayMs)
+	assert.Equal(t, 20, tarpit.HardLimit)
+}
+
+func TestConfigValidationInvalidRoutePattern(t *testing.T) {
+	configData := `
+server:
+  ports: [2525]
+  hostname: "localhost"
+
+storage:
+  local:
+    enabled: true
+    directory: "./test"
+
+routes:
+  - name: "invoices"
+    condition:
+      recipient_pattern: "^faktury@"
+      any:
+        - sender_pattern: "@supplier\\.com"
+        - sender_pattern: "(unclosed"
+    actions:
+      - type: "store_local"
+        enabled: true
+    enabled: false
+`
+
+	tmpFile, err := os.CreateTemp("", "config-*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.WriteString(configData)
+	require.NoError(t, err)
+	tmpFile.Close()
+
+	_, err = config.LoadConfig(tmpFile.Name())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `route invoices: condition.any[1].sender_pattern: invalid pattern "(unclosed"`)
+}
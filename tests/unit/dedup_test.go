@@ -0,0 +1,112 @@
+package unit
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/storage"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dedupProcessor(storeFile string, routes ...config.RouteConfig) (*email.Processor, *storage.MemoryBackend) {
+	return processorFor(&config.Config{
+		Routes: routes,
+		Dedup:  config.DedupConfig{Enabled: true, WindowMinutes: 60, StoreFile: storeFile},
+	})
+}
+
+// listCopy is the same message as delivered to a different alias, with its
+// own trace headers
+func listCopy(alias string) []byte {
+	return []byte("Received: from list.test by mx for " + alias + "\r\nFrom: news@list.test\r\nTo: " + alias + "\r\nSubject: Weekly digest\r\nMessage-ID: <digest-42@list.test>\r\n\r\nThis week...\r\n")
+}
+
+func TestDedupTagAndDrop(t *testing.T) {
+	tagged := routeFor("archive", ".*")
+	dropped := routeFor("tickets", "^support@")
+	dropped.Dedup = config.DedupDrop
+	processor, _ := dedupProcessor("", tagged, dropped)
+
+	first, err := processor.ProcessEmail("news@list.test", []string{"support@example.com"}, listCopy("support@example.com"))
+	require.NoError(t, err)
+	assert.Nil(t, first.Duplicate)
+	assert.Equal(t, []string{"archive", "tickets"}, first.MatchedRoutes)
+
+	second, err := processor.ProcessEmail("news@list.test", []string{"support@example.com"}, listCopy("sales@example.com"))
+	require.NoError(t, err)
+	require.NotNil(t, second.Duplicate)
+	assert.Equal(t, first.ID, second.Duplicate.OriginalID)
+	assert.Equal(t, []string{"archive"}, second.MatchedRoutes)
+	assert.Equal(t, []string{"tickets"}, second.DroppedRoutes)
+
+	require.NotEmpty(t, second.Duplicate.OriginalPaths)
+	assert.Contains(t, second.Duplicate.OriginalPaths[0], first.ID)
+
+	// A different body is a different message, even with the same Message-ID
+	changed := strings.Replace(string(listCopy("support@example.com")), "This week", "Next week", 1)
+	third, err := processor.ProcessEmail("news@list.test", []string{"support@example.com"}, []byte(changed))
+	require.NoError(t, err)
+	assert.Nil(t, third.Duplicate)
+}
+
+func TestDedupLinkStoresOnlyPayload(t *testing.T) {
+	route := routeFor("archive", ".*")
+	route.Dedup = config.DedupLink
+	processor, backend := dedupProcessor("", route)
+
+	first, err := processor.ProcessEmail("news@list.test", []string{"a@example.com"}, listCopy("a@example.com"))
+	require.NoError(t, err)
+	second, err := processor.ProcessEmail("news@list.test", []string{"b@example.com"}, listCopy("b@example.com"))
+	require.NoError(t, err)
+
+	paths := second.Actions[0].Paths
+	require.Len(t, paths, 1)
+	assert.True(t, strings.HasSuffix(paths[0], ".json"))
+
+	data, ok := backend.Get(paths[0])
+	require.True(t, ok)
+	assert.Contains(t, string(data), `"original_id": "`+first.ID+`"`)
+	assert.Contains(t, string(data), first.Paths()[0])
+}
+
+func TestDedupOriginalPathsSkipUnmodifiedCopy(t *testing.T) {
+	route := routeFor("archive", ".*")
+	route.Actions = append([]config.Action{{Type: "modify", Enabled: true, Config: map[string]string{"subject_prefix": "[LIST] "}}}, route.Actions...)
+	processor, _ := dedupProcessor("", route)
+
+	_, err := processor.ProcessEmail("news@list.test", []string{"a@example.com"}, listCopy("a@example.com"))
+	require.NoError(t, err)
+	second, err := processor.ProcessEmail("news@list.test", []string{"b@example.com"}, listCopy("b@example.com"))
+	require.NoError(t, err)
+
+	require.NotNil(t, second.Duplicate)
+	require.Len(t, second.Duplicate.OriginalPaths, 1)
+	assert.False(t, strings.HasSuffix(second.Duplicate.OriginalPaths[0], ".orig.eml"))
+}
+
+func TestDedupStorePersists(t *testing.T) {
+	storeFile := filepath.Join(t.TempDir(), "dedup.json")
+	processor, _ := dedupProcessor(storeFile, routeFor("archive", ".*"))
+
+	_, err := processor.ProcessEmail("news@list.test", []string{"a@example.com"}, listCopy("a@example.com"))
+	require.NoError(t, err)
+
+	restarted, _ := dedupProcessor(storeFile, routeFor("archive", ".*"))
+	result, err := restarted.ProcessEmail("news@list.test", []string{"a@example.com"}, listCopy("a@example.com"))
+	require.NoError(t, err)
+	assert.NotNil(t, result.Duplicate)
+
+	// Reprocessing a message under its own ID is not a duplicate
+	envelope := email.Envelope{ID: email.NewID(time.Now()), From: "x@list.test", To: []string{"a@example.com"}}
+	raw := []byte("Subject: Once\r\nMessage-ID: <once@list.test>\r\n\r\nbody\r\n")
+	_, err = restarted.ProcessEnvelope(envelope, raw)
+	require.NoError(t, err)
+	again, err := restarted.ProcessEnvelope(envelope, raw)
+	require.NoError(t, err)
+	assert.Nil(t, again.Duplicate)
+}
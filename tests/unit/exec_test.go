@@ -0,0 +1,144 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// execScript writes a shell script that saves its stdin and environment
+// next to itself and exits with $EXEC_STATUS
+func execScript(t *testing.T) (script, dir string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("exec tests use a shell script")
+	}
+
+	dir = t.TempDir()
+	script = filepath.Join(dir, "filter.sh")
+	body := "#!/bin/sh\ncat > \"$EXEC_DIR/stdin\"\nenv | grep '^EMAILCATCH_' > \"$EXEC_DIR/env\"\necho \"filter says hi\"\nexit ${EXEC_STATUS:-0}\n"
+	require.NoError(t, os.WriteFile(script, []byte(body), 0755))
+	t.Setenv("EXEC_DIR", dir)
+
+	return script, dir
+}
+
+func runExec(t *testing.T, options map[string]string, onError string) (*email.ProcessingResult, error) {
+	t.Helper()
+
+	processor, _ := processorFor(&config.Config{
+		Routes: []config.RouteConfig{{
+			Name:    "importer",
+			Enabled: true,
+			Actions: []config.Action{{Type: "exec", Enabled: true, OnError: onError, Config: options}},
+		}},
+	})
+
+	raw := []byte("From: Billing <billing@vendor.test>\r\nTo: faktury@example.com\r\nSubject: Invoice 42\r\nMessage-ID: <inv42@vendor.test>\r\n\r\nPlease pay.\r\n")
+	return processor.ProcessEnvelope(email.Envelope{
+		From:       "bounce@vendor.test",
+		To:         []string{"faktury@example.com"},
+		Helo:       "mx.vendor.test",
+		RemoteAddr: "192.0.2.10:4242",
+	}, raw)
+}
+
+func TestExecActionPipesMessage(t *testing.T) {
+	script, dir := execScript(t)
+
+	result, err := runExec(t, map[string]string{"command": script}, "")
+	require.NoError(t, err)
+	assert.Equal(t, email.ActionStatusOK, result.Actions[0].Status)
+
+	stdin, err := os.ReadFile(filepath.Join(dir, "stdin"))
+	require.NoError(t, err)
+	assert.Contains(t, string(stdin), "Subject: Invoice 42\r\n")
+
+	env, err := os.ReadFile(filepath.Join(dir, "env"))
+	require.NoError(t, err)
+	assert.Contains(t, string(env), "EMAILCATCH_FROM=bounce@vendor.test\n")
+	assert.Contains(t, string(env), "EMAILCATCH_TO=faktury@example.com\n")
+	assert.Contains(t, string(env), "EMAILCATCH_SUBJECT=Invoice 42\n")
+	assert.Contains(t, string(env), "EMAILCATCH_HELO=mx.vendor.test\n")
+	assert.Contains(t, string(env), "EMAILCATCH_ROUTE=importer\n")
+}
+
+func TestExecActionJSONStdin(t *testing.T) {
+	script, dir := execScript(t)
+
+	_, err := runExec(t, map[string]string{"command": script, "stdin": "json"}, "")
+	require.NoError(t, err)
+
+	stdin, err := os.ReadFile(filepath.Join(dir, "stdin"))
+	require.NoError(t, err)
+	assert.Contains(t, string(stdin), `"subject":"Invoice 42"`)
+	assert.Contains(t, string(stdin), `"matched_routes":["importer"]`)
+}
+
+func TestExecActionExitCodes(t *testing.T) {
+	script, _ := execScript(t)
+	var deliveryErr *email.DeliveryError
+
+	// EX_TEMPFAIL asks the client to retry
+	t.Setenv("EXEC_STATUS", "75")
+	_, err := runExec(t, map[string]string{"command": script}, "abort")
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.True(t, deliveryErr.Temporary)
+	assert.Contains(t, err.Error(), "filter says hi")
+
+	// Any other failure is permanent
+	t.Setenv("EXEC_STATUS", "1")
+	_, err = runExec(t, map[string]string{"command": script}, "tempfail")
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.False(t, deliveryErr.Temporary)
+}
+
+func TestExecActionTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("exec tests use a shell script")
+	}
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "slow.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\nhead -c 10000 /dev/zero | tr '\\0' x\nsleep 5\n"), 0755))
+
+	processor, _ := processorFor(&config.Config{
+		Routes: []config.RouteConfig{{
+			Name:    "slow",
+			Enabled: true,
+			Actions: []config.Action{{
+				Type:      "exec",
+				Enabled:   true,
+				OnError:   "abort",
+				TimeoutMs: 200,
+				Config:    map[string]string{"command": script, "max_output_bytes": "100"},
+			}},
+		}},
+	})
+
+	result, err := processor.ProcessEmail("a@example.com", []string{"b@example.com"}, []byte("Subject: x\r\n\r\nbody\r\n"))
+	require.Error(t, err)
+	assert.Contains(t, result.Actions[0].Error, "timed out")
+	assert.Less(t, result.Actions[0].Duration.Seconds(), 3.0)
+}
+
+func TestExecActionOutputCap(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("exec tests use a shell script")
+	}
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "noisy.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\nhead -c 100000 /dev/zero | tr '\\0' x\nexit 1\n"), 0755))
+
+	result, err := runExec(t, map[string]string{"command": script, "max_output_bytes": "100"}, "abort")
+	require.Error(t, err)
+	assert.Contains(t, result.Actions[0].Error, "exited with status 1")
+	assert.Less(t, len(result.Actions[0].Error), 300)
+}
@@ -0,0 +1,86 @@
+package unit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewIDIsSortableAndUnique(t *testing.T) {
+	at := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	ids := make([]string, 1000)
+	seen := make(map[string]bool)
+	for i := range ids {
+		ids[i] = email.NewID(at)
+		require.Len(t, ids[i], 26)
+		require.False(t, seen[ids[i]], "duplicate ID %s", ids[i])
+		seen[ids[i]] = true
+	}
+	assert.True(t, sort.StringsAreSorted(ids), "IDs from the same millisecond must increase")
+
+	later := email.NewID(at.Add(time.Hour))
+	assert.Greater(t, later, ids[len(ids)-1])
+	assert.Regexp(t, `^[0-9A-HJKMNP-TV-Z]{26}$`, later)
+}
+
+func TestMessagesInSameSecondDoNotCollide(t *testing.T) {
+	processor, _ := processorFor(&config.Config{
+		Routes: []config.RouteConfig{routeFor("all", ".*")},
+	})
+
+	// Same Date header and the usual "<" prefix on every Message-ID
+	raw := func(id string) []byte {
+		return []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: Burst\r\nDate: Mon, 04 May 2026 10:00:00 +0000\r\nMessage-ID: <" + id + "@example.com>\r\n\r\nbody\r\n")
+	}
+
+	first, err := processor.ProcessEmail("a@example.com", []string{"b@example.com"}, raw("one"))
+	require.NoError(t, err)
+	second, err := processor.ProcessEmail("a@example.com", []string{"b@example.com"}, raw("two"))
+	require.NoError(t, err)
+
+	assert.NotEqual(t, first.ID, second.ID)
+	assert.NotEqual(t, first.Paths()[0], second.Paths()[0])
+	assert.Contains(t, first.Paths()[0], first.ID)
+}
+
+func TestReprocessingWithSameIDIsIdempotent(t *testing.T) {
+	var keys []string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+	}))
+	defer hook.Close()
+
+	route := routeFor("all", ".*")
+	route.Actions = append(route.Actions, config.Action{Type: "webhook", Enabled: true, Config: map[string]string{"url": hook.URL}})
+	processor, backend := processorFor(&config.Config{
+		Routes: []config.RouteConfig{route},
+	})
+
+	envelope := email.Envelope{
+		ID:       email.NewID(time.Now()),
+		From:     "a@example.com",
+		To:       []string{"b@example.com"},
+		Received: time.Now(),
+	}
+	raw := []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: Replay\r\n\r\nbody\r\n")
+
+	first, err := processor.ProcessEnvelope(envelope, raw)
+	require.NoError(t, err)
+	stored := backend.Paths()
+
+	second, err := processor.ProcessEnvelope(envelope, raw)
+	require.NoError(t, err)
+
+	assert.Equal(t, envelope.ID, first.ID)
+	assert.Equal(t, first.Paths(), second.Paths())
+	assert.Equal(t, stored, backend.Paths(), "replaying must overwrite, not add, objects")
+	assert.Equal(t, []string{envelope.ID, envelope.ID}, keys)
+}
@@ -0,0 +1,78 @@
+package unit
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModifyAction(t *testing.T) {
+	tagged := routeFor("external", ".*")
+	tagged.Actions = []config.Action{
+		{Type: "modify", Enabled: true, OnError: "abort", Config: map[string]string{
+			"remove_headers":         "X-Mailer",
+			"set.X-Priority":         "5",
+			"add.X-EmailCatch-Route": "{{route}} for {{recipient_user}}",
+			"subject_prefix":         "[EXTERNAL] ",
+		}},
+		{Type: "store_local", Enabled: true, Config: map[string]string{"folder": "external"}},
+	}
+	plain := routeFor("archive", ".*")
+	plain.Actions[0].Config = map[string]string{"folder": "archive"}
+
+	processor, backend := processorFor(&config.Config{
+		Routes: []config.RouteConfig{tagged, plain},
+	})
+
+	raw := "From: someone@outside.test\r\nX-Mailer: Bulk\r\n Mailer 2.0\r\nX-Priority: 1\r\nSubject: =?utf-8?q?Zam=C3=B3wienie?=\r\nTo: sales@example.com\r\n\r\nbody\r\n"
+	result, err := processor.ProcessEmail("someone@outside.test", []string{"sales@example.com"}, []byte(raw))
+	require.NoError(t, err)
+	require.Len(t, result.Actions, 3)
+	for _, action := range result.Actions {
+		require.Equal(t, "ok", action.Status, action.Error)
+	}
+
+	stored := func(action email.ActionResult, suffix string) string {
+		for _, path := range action.Paths {
+			if strings.HasSuffix(path, suffix) && (suffix != ".eml" || !strings.HasSuffix(path, ".orig.eml")) {
+				data, ok := backend.Get(path)
+				require.True(t, ok)
+				return string(data)
+			}
+		}
+		t.Fatalf("no %s file among %v", suffix, action.Paths)
+		return ""
+	}
+
+	modified := stored(result.Actions[1], ".eml")
+	assert.True(t, strings.HasPrefix(modified, "X-EmailCatch-Route: external for sales\r\n"), modified)
+	assert.NotContains(t, modified, "X-Mailer")
+	assert.NotContains(t, modified, "Mailer 2.0")
+	assert.Contains(t, modified, "X-Priority: 5\r\n")
+	assert.Contains(t, modified, "Subject: [EXTERNAL] =?utf-8?q?Zam=C3=B3wienie?=\r\n")
+	assert.True(t, strings.HasSuffix(modified, "\r\n\r\nbody\r\n"))
+	assert.Contains(t, stored(result.Actions[1], ".json"), `"subject": "[EXTERNAL] Zamówienie"`)
+
+	// The original is kept next to the modified copy, and other routes
+	// never see the changes
+	assert.Equal(t, raw, stored(result.Actions[1], ".orig.eml"))
+	assert.Equal(t, raw, stored(result.Actions[2], ".eml"))
+}
+
+func TestModifyActionInParallelRoute(t *testing.T) {
+	route := routeFor("parallel", ".*")
+	route.Parallel = true
+	route.Actions = []config.Action{{Type: "modify", Enabled: true, OnError: "abort", Config: map[string]string{"subject_prefix": "[X] "}}}
+
+	processor, _ := processorFor(&config.Config{
+		Routes: []config.RouteConfig{route},
+	})
+
+	result, err := processor.ProcessEmail("a@test", []string{"b@test"}, []byte("Subject: hi\r\n\r\nbody\r\n"))
+	require.Error(t, err)
+	assert.Contains(t, result.Actions[0].Error, "cannot run in a parallel route")
+}
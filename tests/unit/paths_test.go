@@ -0,0 +1,86 @@
+package unit
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func storeWithTemplate(t *testing.T, template string, envelope email.Envelope) (*email.ProcessingResult, error) {
+	t.Helper()
+
+	processor, _ := processorFor(&config.Config{
+		Routes: []config.RouteConfig{{
+			Name:    "invoices",
+			Enabled: true,
+			Actions: []config.Action{{
+				Type:    "store_local",
+				Enabled: true,
+				OnError: "abort",
+				Config:  map[string]string{"folder": "invoices", "path_template": template},
+			}},
+		}},
+	})
+
+	// The Date header claims 1999; paths must use the time of receipt
+	raw := []byte("From: billing@vendor.test\r\nTo: faktury@example.com\r\nSubject: Invoice\r\nDate: Fri, 31 Dec 1999 23:59:59 +0000\r\nMessage-ID: <inv@vendor.test>\r\n\r\nbody\r\n")
+	return processor.ProcessEnvelope(envelope, raw)
+}
+
+func TestPathTemplate(t *testing.T) {
+	received := time.Date(2026, 3, 7, 10, 0, 0, 0, time.UTC)
+	result, err := storeWithTemplate(t, "{{folder}}/{{sender_domain}}/{{yyyy}}/{{mm}}/{{recipient_local}}/{{plus_tag}}", email.Envelope{
+		From:     "billing@Vendor.TEST",
+		To:       []string{"faktury+q1@example.com"},
+		Received: received,
+	})
+	require.NoError(t, err)
+
+	paths := result.Actions[0].Paths
+	require.NotEmpty(t, paths)
+	assert.True(t, strings.HasPrefix(paths[0], "invoices/vendor.test/2026/03/faktury+q1/q1/"), paths[0])
+	assert.True(t, strings.HasSuffix(paths[0], ".eml"))
+
+	// Every message still gets its own folder below the template
+	parts := strings.Split(paths[0], "/")
+	assert.Len(t, parts, 8)
+}
+
+func TestDefaultPathUsesReceivedTime(t *testing.T) {
+	result, err := storeWithTemplate(t, "", email.Envelope{
+		From:     "billing@vendor.test",
+		To:       []string{"faktury@example.com"},
+		Received: time.Date(2026, 3, 7, 10, 0, 0, 0, time.UTC),
+	})
+	require.NoError(t, err)
+
+	paths := result.Actions[0].Paths
+	require.NotEmpty(t, paths)
+	assert.True(t, strings.HasPrefix(paths[0], "invoices/2026/03/"), paths[0])
+}
+
+func TestPathTemplateEmptyAndHostileValues(t *testing.T) {
+	result, err := storeWithTemplate(t, "{{plus_tag}}/{{sender_local}}/{{unique_id}}", email.Envelope{
+		From: "../../etc/passwd@vendor.test",
+		To:   []string{"faktury@example.com"},
+	})
+	require.NoError(t, err)
+
+	path := result.Actions[0].Paths[0]
+	assert.False(t, strings.HasPrefix(path, "/"), path)
+	segments := strings.Split(path, "/")
+	for _, segment := range segments {
+		assert.NotEqual(t, "..", segment)
+	}
+	assert.Equal(t, ".._.._etc_passwd", segments[0])
+	assert.Len(t, segments, 3, "empty plus_tag collapses and unique_id is not repeated: %s", path)
+
+	_, err = storeWithTemplate(t, "{{folder}}/{{tenant}}", email.Envelope{From: "a@b.test", To: []string{"c@d.test"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown variable {{tenant}}")
+}
@@ -0,0 +1,87 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/slav123/email-catch/internal/relay"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSRSRewrite(t *testing.T) {
+	srs, err := relay.NewSRS("catch.example", "s3cret")
+	require.NoError(t, err)
+
+	first := srs.Rewrite("alice@sender.test")
+	assert.Regexp(t, regexp.MustCompile(`^SRS0=[A-Za-z0-9+/]{4}=[A-Z2-7]{2}=sender\.test=alice@catch\.example$`), first)
+	assert.Equal(t, first, srs.Rewrite("alice@sender.test"), "rewriting must be deterministic")
+
+	// Bounces and local senders are left alone
+	assert.Equal(t, "", srs.Rewrite(""))
+	assert.Equal(t, "ops@catch.example", srs.Rewrite("ops@catch.example"))
+
+	// A second forwarder wraps the first rewrite as SRS1
+	other, err := relay.NewSRS("second.example", "other")
+	require.NoError(t, err)
+	second := other.Rewrite(first)
+	assert.Regexp(t, regexp.MustCompile(`^SRS1=[A-Za-z0-9+/]{4}=catch\.example==`), second)
+	assert.Contains(t, second, "=sender.test=alice@second.example")
+
+	_, err = relay.NewSRS("catch.example", "")
+	assert.Error(t, err)
+}
+
+func TestRelayQueueRetries(t *testing.T) {
+	var attempts atomic.Int32
+	delivered := make(chan struct{})
+
+	queue := relay.NewQueue(func(ctx context.Context, msg *relay.Message) error {
+		if attempts.Add(1) < 3 {
+			return &relay.Error{Err: errors.New("451 try later")}
+		}
+		close(delivered)
+		return nil
+	}, 5, 10*time.Millisecond)
+	defer queue.Close()
+
+	require.True(t, queue.Enqueue(&relay.Message{From: "a@example.com", To: []string{"b@example.com"}}))
+
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Fatal("message was not retried")
+	}
+	assert.Equal(t, int32(3), attempts.Load())
+}
+
+func TestRelayClientRequiresTLSForAuth(t *testing.T) {
+	_, err := relay.NewClient(relay.Config{Host: "smtp.example.com", TLS: relay.TLSNone, Username: "user", Password: "secret"})
+	assert.Error(t, err)
+
+	_, err = relay.NewClient(relay.Config{Host: "127.0.0.1", TLS: relay.TLSNone, Username: "user", Password: "secret"})
+	assert.NoError(t, err)
+
+	_, err = relay.NewClient(relay.Config{Host: "smtp.example.com", TLS: relay.TLSStartTLS, Username: "user", Password: "secret"})
+	assert.NoError(t, err)
+}
+
+func TestRelayQueueStopsOnPermanentFailure(t *testing.T) {
+	var attempts atomic.Int32
+
+	queue := relay.NewQueue(func(ctx context.Context, msg *relay.Message) error {
+		attempts.Add(1)
+		return &relay.Error{Permanent: true, Err: errors.New("550 no such user")}
+	}, 5, time.Millisecond)
+
+	require.True(t, queue.Enqueue(&relay.Message{To: []string{"b@example.com"}}))
+	assert.Eventually(t, func() bool { return queue.Pending() == 0 }, time.Second, 5*time.Millisecond)
+	queue.Close()
+
+	assert.Equal(t, int32(1), attempts.Load())
+	assert.False(t, queue.Enqueue(&relay.Message{To: []string{"b@example.com"}}), "closed queue accepts no messages")
+}
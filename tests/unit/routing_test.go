@@ -0,0 +1,135 @@
+package unit
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/storage"
+	"github.com/slav123/email-catch/internal/webhook"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func routeFor(name, pattern string) config.RouteConfig {
+	return config.RouteConfig{
+		Name:      name,
+		Enabled:   true,
+		Condition: config.Condition{RecipientPattern: pattern},
+		Actions:   []config.Action{{Type: "store_local", Enabled: true}},
+	}
+}
+
+// processorFor builds a processor that stores into memory and can send
+// webhooks. Local storage is enabled, so a test only sets the parts of cfg it
+// is about.
+func processorFor(cfg *config.Config) (*email.Processor, *storage.MemoryBackend) {
+	cfg.Storage.Local.Enabled = true
+	backend := storage.NewMemoryBackend()
+	return email.NewProcessor(cfg, backend, webhook.NewClient()), backend
+}
+
+func TestRoutePriorityFinalAndFallback(t *testing.T) {
+	capture := routeFor("capture", "^capture@")
+	audit := routeFor("audit", ".*")
+	urgent := routeFor("urgent", "^capture@")
+	urgent.Priority = 10
+	urgent.Final = true
+	catchAll := routeFor("catch_all", ".*")
+	catchAll.Type = config.RouteTypeFallback
+
+	cfg := &config.Config{
+		Routes: []config.RouteConfig{capture, audit, urgent, catchAll},
+	}
+	// Routes are compiled when the processor is created
+	newProcessor := func() *email.Processor {
+		processor, _ := processorFor(cfg)
+		return processor
+	}
+
+	// The final high-priority route wins and stops evaluation
+	matched := newProcessor().MatchingRoutes(&email.Email{To: []string{"capture@test.com"}})
+	assert.Equal(t, []string{"urgent"}, matched)
+
+	// Without it, normal routes run in file order and the fallback is skipped
+	cfg.Routes[2].Enabled = false
+	matched = newProcessor().MatchingRoutes(&email.Email{To: []string{"capture@test.com"}})
+	assert.Equal(t, []string{"capture", "audit"}, matched)
+
+	// The fallback only runs when nothing else matched
+	cfg.Routes[1].Enabled = false
+	matched = newProcessor().MatchingRoutes(&email.Email{To: []string{"someone@test.com"}})
+	assert.Equal(t, []string{"catch_all"}, matched)
+}
+
+func TestPerRecipientRouting(t *testing.T) {
+	tenants := routeFor("tenants", "@brand[0-9]\\.test$")
+	tenants.Actions[0].Config = map[string]string{"path_template": "{{recipient_domain}}"}
+	brand2 := routeFor("brand2", "@brand2\\.test$")
+
+	processor, backend := processorFor(&config.Config{
+		Routes:  []config.RouteConfig{tenants, brand2},
+		Routing: config.RoutingConfig{PerRecipient: true},
+	})
+
+	raw := []byte("From: someone@sender.test\r\nTo: a@brand1.test, b@brand2.test\r\nSubject: Hello\r\nMessage-ID: <fan@sender.test>\r\n\r\nbody\r\n")
+	result, err := processor.ProcessEmail("someone@sender.test", []string{"a@brand1.test", "b@brand2.test"}, raw)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tenants", "brand2"}, result.MatchedRoutes)
+	require.Len(t, result.Actions, 3)
+
+	for _, action := range result.Actions {
+		if action.Route != "tenants" {
+			assert.Equal(t, "b@brand2.test", action.Recipient)
+			continue
+		}
+
+		domain := strings.SplitN(action.Recipient, "@", 2)[1]
+		var payload string
+		for _, path := range action.Paths {
+			assert.True(t, strings.HasPrefix(path, domain+"/"), path)
+			if strings.HasSuffix(path, ".json") {
+				data, ok := backend.Get(path)
+				require.True(t, ok)
+				payload = string(data)
+			}
+		}
+
+		// Each copy carries only its own recipient
+		var stored struct {
+			ID        string   `json:"id"`
+			Recipient string   `json:"recipient"`
+			To        []string `json:"to"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(payload), &stored))
+		assert.Equal(t, []string{action.Recipient}, stored.To)
+		assert.Equal(t, action.Recipient, stored.Recipient)
+		assert.True(t, strings.HasPrefix(stored.ID, result.ID+"-"), stored.ID)
+	}
+}
+
+func BenchmarkRouteMatching(b *testing.B) {
+	var routes []config.RouteConfig
+	for _, pattern := range []string{"^capture@", "^test@", "^webhook@", "^attachments@", "^faktury@hib\\.pl$"} {
+		route := routeFor(pattern, pattern)
+		route.Condition.SenderPattern = ".*@example\\.com"
+		route.Condition.SubjectPattern = "(?i)invoice|receipt"
+		routes = append(routes, route)
+	}
+
+	processor, _ := processorFor(&config.Config{
+		Routes: routes,
+	})
+	msg := &email.Email{
+		From:    "billing@example.com",
+		To:      []string{"faktury@hib.pl"},
+		Subject: "Your receipt",
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		processor.MatchingRoutes(msg)
+	}
+}
@@ -0,0 +1,128 @@
+package unit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/slav123/email-catch/internal/config"
+	"github.com/slav123/email-catch/internal/storage"
+	"github.com/slav123/email-catch/pkg/email"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startFakeSpamd answers SYMBOLS requests like spamd. Messages mentioning
+// "viagra" score 7.5, others 0.3.
+func startFakeSpamd(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				reader := textproto.NewReader(r)
+				if line, err := reader.ReadLine(); err != nil || line != "SYMBOLS SPAMC/1.5" {
+					fmt.Fprintf(conn, "SPAMD/1.5 76 Bad header line: %s\r\n", line)
+					return
+				}
+				header, err := reader.ReadMIMEHeader()
+				if err != nil {
+					return
+				}
+				length, _ := strconv.Atoi(header.Get("Content-Length"))
+				message := make([]byte, length)
+				if _, err := io.ReadFull(r, message); err != nil {
+					return
+				}
+
+				verdict, rules := "False ; 0.3 / 5.0", "HTML_MESSAGE"
+				if strings.Contains(string(message), "viagra") {
+					verdict, rules = "True ; 7.5 / 5.0", "BAYES_99,HTML_MESSAGE"
+				}
+				fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: %d\r\nSpam: %s\r\n\r\n%s", len(rules), verdict, rules)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func spamProcessor(spam config.SpamConfig) (*email.Processor, *storage.MemoryBackend) {
+	score := func(f float64) *float64 { return &f }
+
+	clean := routeFor("clean", ".*")
+	clean.Condition.MaxSpamScore = score(5.0)
+	clean.Actions[0].Config = map[string]string{"folder": "clean"}
+	junk := routeFor("junk", ".*")
+	junk.Condition.MinSpamScore = score(5.0)
+	junk.Actions[0].Config = map[string]string{"folder": "junk"}
+	bayes := routeFor("bayes", ".*")
+	bayes.Condition.SpamRulePattern = "^BAYES_9"
+	bayes.Actions[0].Config = map[string]string{"folder": "bayes"}
+	unscored := routeFor("unscored", ".*")
+	unscored.Type = config.RouteTypeFallback
+	unscored.Actions[0].Config = map[string]string{"folder": "unscored"}
+
+	spam.Enabled = true
+	return processorFor(&config.Config{
+		Routes: []config.RouteConfig{clean, junk, bayes, unscored},
+		Spam:   spam,
+	})
+}
+
+func TestSpamScoreConditions(t *testing.T) {
+	processor, backend := spamProcessor(config.SpamConfig{Address: startFakeSpamd(t), AddHeaders: true})
+
+	result, err := processor.ProcessEmail("a@example.com", []string{"b@example.com"}, []byte("Subject: Cheap viagra\r\n\r\nbuy now\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"junk", "bayes"}, result.MatchedRoutes)
+
+	eml := storedFile(t, backend, ".eml")
+	assert.Contains(t, eml, "X-Spam-Flag: YES\r\n")
+	assert.Contains(t, eml, "X-Spam-Status: Yes, score=7.5 required=5.0 tests=BAYES_99,HTML_MESSAGE\r\n")
+
+	var payload struct {
+		Spam email.SpamResult `json:"spam"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(storedFile(t, backend, ".json")), &payload))
+	assert.Equal(t, email.SpamResult{Score: 7.5, Threshold: 5, IsSpam: true, Rules: []string{"BAYES_99", "HTML_MESSAGE"}}, payload.Spam)
+
+	result, err = processor.ProcessEmail("a@example.com", []string{"b@example.com"}, []byte("Subject: Lunch\r\n\r\nat noon?\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"clean"}, result.MatchedRoutes)
+}
+
+func TestSpamCheckFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	message := []byte("Subject: hi\r\n\r\nbody\r\n")
+
+	// Unscored messages match no spam condition
+	processor, _ := spamProcessor(config.SpamConfig{Address: address})
+	result, err := processor.ProcessEmail("a@example.com", []string{"b@example.com"}, message)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"unscored"}, result.MatchedRoutes)
+
+	processor, backend := spamProcessor(config.SpamConfig{Address: address, Fail: config.SpamFailClosed})
+	_, err = processor.ProcessEmail("a@example.com", []string{"b@example.com"}, message)
+	var deliveryErr *email.DeliveryError
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.Equal(t, 451, deliveryErr.Code)
+	assert.Empty(t, backend.Paths())
+}